@@ -3,6 +3,7 @@ package certs
 import (
 	"golang.org/x/crypto/ssh"
 
+	"bytes"
 	"crypto"
 	"fmt"
 	"os"
@@ -26,6 +27,70 @@ func PublicKey(filename string) (crypto.PublicKey, error) {
 	return crypto.CryptoPublicKey(), nil
 }
 
+// Parse all keys from authorized_keys-style file.
+// Empty lines and comments are skipped.
+func AuthorizedKeys(filename string) ([]crypto.PublicKey, error) {
+	entries, err := ParseAuthorizedKeys(filename)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]crypto.PublicKey, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	return keys, nil
+}
+
+// Single entry of authorized_keys-style file
+type AuthorizedKey struct {
+	Key     crypto.PublicKey
+	Options []string
+	Comment string
+}
+
+// Parse all entries from authorized_keys-style file including key options.
+// Empty lines and comments are skipped.
+func ParseAuthorizedKeys(filename string) ([]AuthorizedKey, error) {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var keys []AuthorizedKey
+	for len(bytes.TrimSpace(raw)) > 0 {
+		var (
+			sshkey  ssh.PublicKey
+			comment string
+			options []string
+		)
+		sshkey, comment, options, raw, err = ssh.ParseAuthorizedKey(raw)
+		if err != nil && len(keys) > 0 {
+			break // only comments and unparseable lines remain
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		crypto, ok := sshkey.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unable to convert ssh key to crypto.PublicKey: %T", sshkey)
+		}
+		keys = append(keys, AuthorizedKey{
+			Key:     crypto.CryptoPublicKey(),
+			Options: options,
+			Comment: comment,
+		})
+	}
+	return keys, nil
+}
+
+// SHA256 fingerprint of public key in OpenSSH format
+func Fingerprint(key crypto.PublicKey) (string, error) {
+	sshkey, err := ssh.NewPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(sshkey), nil
+}
+
 func PrivateKey(filename string) (crypto.Signer, error) {
 	raw, err := os.ReadFile(filename)
 	if err != nil {
@@ -0,0 +1,263 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	// Ephemeral certificates are reissued after half of this time passes
+	certLifetime = 24 * time.Hour
+
+	// Tolerate some difference between clocks of both parties
+	clockSkew = time.Hour
+)
+
+// Mutual TLS authentication based on SSH keys (see README.md)
+//
+// Our side is represented by an ephemeral leaf certificate issued by our SSH
+// key. Peers are trusted only if their leaf certificate was issued by one of
+// preapproved SSH keys.
+type PKI struct {
+	key   crypto.Signer
+	peers []crypto.PublicKey
+
+	mu      sync.Mutex
+	expires time.Time
+	leaf    tls.Certificate
+	trusted *x509.CertPool
+}
+
+// Initialize PKI for the given private key and a list of trusted peers
+func NewPKI(key crypto.Signer, peers ...crypto.PublicKey) *PKI {
+	return &PKI{key: key, peers: peers}
+}
+
+// TLS configuration for NBD server.
+//
+// Clients are required to present a certificate issued by one of trusted keys.
+func (p *PKI) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			leaf, trusted, err := p.current()
+			if err != nil {
+				return nil, err
+			}
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS13,
+				Certificates: []tls.Certificate{leaf},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    trusted,
+			}, nil
+		},
+	}
+}
+
+// TLS configuration for NBD client.
+//
+// Server is required to present a certificate issued by one of trusted keys.
+// Host names are not checked: server identity is defined by its key only.
+func (p *PKI) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			leaf, _, err := p.current()
+			if err != nil {
+				return nil, err
+			}
+			return &leaf, nil
+		},
+		InsecureSkipVerify: true, // replaced by VerifyConnection
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server did not provide any certificates")
+			}
+			_, trusted, err := p.current()
+			if err != nil {
+				return err
+			}
+			_, err = state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:     trusted,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			})
+			return err
+		},
+	}
+}
+
+// Obtain current set of ephemeral certificates, reissue them if necessary
+func (p *PKI) current() (leaf tls.Certificate, trusted *x509.CertPool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Now().Before(p.expires) {
+		return p.leaf, p.trusted, nil
+	}
+	leaf, err = tlsLeafCert(certLifetime, p.key)
+	if err != nil {
+		return leaf, nil, fmt.Errorf("issuing leaf certificate: %w", err)
+	}
+	certs, err := tlsTrustedPool(certLifetime, p.peers...)
+	if err != nil {
+		return leaf, nil, fmt.Errorf("issuing peer certificates: %w", err)
+	}
+
+	// Peer certificates are used as trust anchors directly,
+	// root certificate that has issued them is not required for that
+	trusted = x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		trusted.AddCert(cert)
+	}
+	p.leaf, p.trusted = leaf, trusted
+	p.expires = time.Now().Add(certLifetime / 2)
+	return p.leaf, p.trusted, nil
+}
+
+// Extract public key of the peer authenticated by PKI
+func PeerKey(state tls.ConnectionState) (crypto.PublicKey, error) {
+	for _, chain := range state.VerifiedChains {
+		if len(chain) < 2 {
+			continue
+		}
+		return chain[len(chain)-1].PublicKey, nil
+	}
+	return nil, errors.New("peer was not authenticated")
+}
+
+// Issue a leaf certificate for an ephemeral key signed by the given private key.
+// Resulting TLS certificate contains both the leaf and the self-signed root.
+func tlsLeafCert(lifetime time.Duration, key crypto.Signer) (chain tls.Certificate, err error) {
+	keyRepr, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return chain, err
+	}
+	rootCert := &x509.Certificate{
+		IsCA:         true,
+		SerialNumber: big.NewInt(10),
+		NotBefore:    time.Now().Add(-clockSkew),
+		NotAfter:     time.Now().Add(lifetime),
+		Subject: pkix.Name{
+			Organization:       []string{"pond/nbd"},
+			OrganizationalUnit: []string{base64.StdEncoding.EncodeToString(keyRepr)},
+		},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	rootDer, err := x509.CreateCertificate(rand.Reader, rootCert, rootCert, key.Public(), key)
+	if err != nil {
+		return chain, err
+	}
+	rootCert, err = x509.ParseCertificate(rootDer)
+	if err != nil {
+		return chain, err
+	}
+	leafPubKey, leafPrivKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return chain, err
+	}
+	leafCert := &x509.Certificate{
+		IsCA:         false,
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-clockSkew),
+		NotAfter:     time.Now().Add(lifetime),
+		Issuer:       rootCert.Subject,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, leafCert, rootCert, leafPubKey, key)
+	if err != nil {
+		return chain, err
+	}
+	leafCert, err = x509.ParseCertificate(leafDer)
+	if err != nil {
+		return chain, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{leafDer, rootDer},
+		PrivateKey:  leafPrivKey,
+		Leaf:        leafCert,
+	}, nil
+}
+
+// Build a pool of trusted intermediate TLS certificates
+// based on the list of preapproved public keys
+func tlsTrustedPool(lifetime time.Duration, trusted ...crypto.PublicKey) (certs []*x509.Certificate, err error) {
+	_, ephemeralRootKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralRootCert := &x509.Certificate{
+		IsCA:         true,
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-clockSkew),
+		NotAfter:     time.Now().Add(lifetime),
+		Subject: pkix.Name{
+			Organization: []string{"pond/nbd"},
+		},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	ephemeralDer, err := x509.CreateCertificate(
+		rand.Reader,
+		ephemeralRootCert,
+		ephemeralRootCert,
+		ephemeralRootKey.Public(),
+		ephemeralRootKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralRootCert, err = x509.ParseCertificate(ephemeralDer)
+	if err != nil {
+		return nil, err
+	}
+	intermediateCertTemplate := &x509.Certificate{
+		IsCA:      true,
+		NotBefore: time.Now().Add(-clockSkew),
+		NotAfter:  time.Now().Add(lifetime),
+		Subject: pkix.Name{
+			Organization:       []string{"pond/nbd"},
+			OrganizationalUnit: make([]string, 1),
+		},
+		Issuer: pkix.Name{
+			Organization: []string{"pond/nbd"},
+		},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	certs = make([]*x509.Certificate, 0, 1+len(trusted))
+	certs = append(certs, ephemeralRootCert)
+	for index, publicKey := range trusted {
+		intermediateCertTemplate.SerialNumber = big.NewInt(int64(1 + index))
+		keyRepr, err := x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("certificate #%d: %w", index, err)
+		}
+		intermediateCertTemplate.Subject.OrganizationalUnit[0] = base64.StdEncoding.EncodeToString(keyRepr)
+		intermediateDer, err := x509.CreateCertificate(
+			rand.Reader,
+			intermediateCertTemplate,
+			ephemeralRootCert,
+			publicKey,
+			ephemeralRootKey,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("certificate #%d: %w", index, err)
+		}
+		cert, err := x509.ParseCertificate(intermediateDer)
+		if err != nil {
+			return nil, fmt.Errorf("certificate #%d: %w", index, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
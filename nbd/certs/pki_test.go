@@ -3,14 +3,13 @@ package certs
 import (
 	"testing"
 
-	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/base64"
-	"fmt"
-	"math/big"
+	"errors"
+	"io"
+	"net"
 	"time"
 )
 
@@ -49,10 +48,11 @@ func TestPKI(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	clientCert, err := tlsLeafCert(time.Hour, clientKey)
+	clientChain, err := tlsLeafCert(time.Hour, clientKey)
 	if err != nil {
 		t.Fatal(err)
 	}
+	clientCert := clientChain.Leaf
 
 	client, err := PublicKey("testkeys/alice.pub")
 	if err != nil {
@@ -82,122 +82,70 @@ func TestPKI(t *testing.T) {
 	}
 }
 
-// Issue a leaf certificate for the given private key
-func tlsLeafCert(lifetime time.Duration, key crypto.Signer) (*x509.Certificate, error) {
-	keyRepr, err := x509.MarshalPKIXPublicKey(key.Public())
+func TestMutualTLS(t *testing.T) {
+	serverKey, err := PrivateKey("testkeys/bob")
 	if err != nil {
-		return nil, err
-	}
-	rootCert := &x509.Certificate{
-		IsCA:         true,
-		SerialNumber: big.NewInt(10),
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(lifetime),
-		Subject: pkix.Name{
-			Organization:       []string{"pond/nbd"},
-			OrganizationalUnit: []string{base64.StdEncoding.EncodeToString(keyRepr)},
-		},
-	}
-	rootDer, err := x509.CreateCertificate(rand.Reader, rootCert, rootCert, key.Public(), key)
-	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
-	rootCert, err = x509.ParseCertificate(rootDer)
+	clientKey, err := PrivateKey("testkeys/alice")
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
-	leafPubKey, _, err := ed25519.GenerateKey(rand.Reader)
+	serverTrusts, err := AuthorizedKeys("testkeys/alice.pub")
 	if err != nil {
-		return nil, err
-	}
-	leafCert := &x509.Certificate{
-		IsCA:         false,
-		SerialNumber: big.NewInt(time.Now().UnixNano()),
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(lifetime),
-		Issuer:       rootCert.Subject,
+		t.Fatal(err)
 	}
-	leafDer, err := x509.CreateCertificate(rand.Reader, leafCert, rootCert, leafPubKey, key)
+	clientTrusts, err := AuthorizedKeys("testkeys/bob.pub")
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
-	leafCert, err = x509.ParseCertificate(leafDer)
+	stranger, _, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
-	return leafCert, nil
-}
 
-// Build a pool of trusted intermediate TLS certificates
-// based on the list of preapproved public keys
-func tlsTrustedPool(lifetime time.Duration, trusted ...crypto.PublicKey) (certs []*x509.Certificate, err error) {
-	_, ephemeralRootKey, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, err
-	}
-	ephemeralRootCert := &x509.Certificate{
-		IsCA:         true,
-		SerialNumber: big.NewInt(1),
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(lifetime),
-		Subject: pkix.Name{
-			Organization: []string{"pond/nbd"},
-		},
-		KeyUsage:              x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-	}
-	ephemeralDer, err := x509.CreateCertificate(
-		rand.Reader,
-		ephemeralRootCert,
-		ephemeralRootCert,
-		ephemeralRootKey.Public(),
-		ephemeralRootKey,
-	)
-	if err != nil {
-		return nil, err
-	}
-	ephemeralRootCert, err = x509.ParseCertificate(ephemeralDer)
-	if err != nil {
-		return nil, err
-	}
-	intermediateCertTemplate := &x509.Certificate{
-		IsCA:      true,
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().Add(lifetime),
-		Subject: pkix.Name{
-			Organization:       []string{"pond/nbd"},
-			OrganizationalUnit: make([]string, 1),
-		},
-		Issuer: pkix.Name{
-			Organization: []string{"pond/nbd"},
-		},
-		KeyUsage:              x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-	}
-	certs = make([]*x509.Certificate, 0, 1+len(trusted))
-	certs = append(certs, ephemeralRootCert)
-	for index, publicKey := range trusted {
-		intermediateCertTemplate.SerialNumber = big.NewInt(int64(1 + index))
-		keyRepr, err := x509.MarshalPKIXPublicKey(publicKey)
-		if err != nil {
-			return nil, fmt.Errorf("certificate #%d: %w", index, err)
-		}
-		intermediateCertTemplate.Subject.OrganizationalUnit[0] = base64.StdEncoding.EncodeToString(keyRepr)
-		intermediateDer, err := x509.CreateCertificate(
-			rand.Reader,
-			intermediateCertTemplate,
-			ephemeralRootCert,
-			publicKey,
-			ephemeralRootKey,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("certificate #%d: %w", index, err)
-		}
-		cert, err := x509.ParseCertificate(intermediateDer)
-		if err != nil {
-			return nil, fmt.Errorf("certificate #%d: %w", index, err)
-		}
-		certs = append(certs, cert)
+	for _, tt := range []struct {
+		name           string
+		server, client *PKI
+		ok             bool
+	}{
+		{"trusted", NewPKI(serverKey, serverTrusts...), NewPKI(clientKey, clientTrusts...), true},
+		{"untrusted client", NewPKI(serverKey, stranger), NewPKI(clientKey, clientTrusts...), false},
+		{"untrusted server", NewPKI(serverKey, serverTrusts...), NewPKI(clientKey, stranger), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer func() { _ = clientConn.Close() }()
+			defer func() { _ = serverConn.Close() }()
+			_ = clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+			_ = serverConn.SetDeadline(time.Now().Add(10 * time.Second))
+
+			server := tls.Server(serverConn, tt.server.ServerConfig())
+			client := tls.Client(clientConn, tt.client.ClientConfig())
+			serverErr := make(chan error, 1)
+			go func() {
+				serverErr <- server.Handshake()
+				_ = serverConn.Close()
+			}()
+			clientErr := client.Handshake()
+			go func() { _, _ = io.Copy(io.Discard, client) }() // receive TLS alerts if any
+			err := errors.Join(<-serverErr, clientErr)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("handshake succeeded unexpectedly")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			peer, err := PeerKey(server.ConnectionState())
+			if err != nil {
+				t.Fatalf("peer key: %v", err)
+			}
+			if !clientKey.Public().(ed25519.PublicKey).Equal(peer) {
+				t.Fatalf("wrong peer key: %v", peer)
+			}
+		})
 	}
-	return certs, nil
 }
@@ -1,41 +1,138 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
+	"github.com/alecthomas/kong"
+
 	"github.com/sio/pond/nbd/daemon"
 	"github.com/sio/pond/nbd/logger"
 )
 
-const config = `
-{
-	"s3": {
-		"endpoint": "http://127.0.0.55:55555",
-		"bucket": "testdata",
-		"access": "access",
-		"secret": "secret123"
-	},
-	"cache": {"dir": "./cache"},
-	"listen": [
-		{"network": "tcp", "address": "127.0.0.189:10809"}
-	]
-}
-`
+var cli struct {
+	Config    string `short:"c" env:"POND_NBD_CONFIG" type:"existingfile" placeholder:"path" help:"JSON configuration file, re-read on SIGHUP. Other flags override values from this file"`
+	LogFormat string `env:"POND_NBD_LOG_FORMAT" enum:"text,json" default:"text" help:"Log output format: ${enum} (default: ${default})"`
 
-func main() {
-	logger.Setup()
+	S3Endpoint    string `name:"s3-endpoint" env:"POND_NBD_S3_ENDPOINT" placeholder:"url" help:"Remote storage: https://s3.example.com (S3), range+https://example.com/path (any web server), file:///path (local files)"`
+	S3Bucket      string `name:"s3-bucket" env:"POND_NBD_S3_BUCKET" placeholder:"name" help:"S3 bucket (optional for other storage kinds)"`
+	S3Prefix      string `name:"s3-prefix" env:"POND_NBD_S3_PREFIX" placeholder:"path" help:"Prefix for S3 object names"`
+	S3Credentials string `name:"s3-credentials" env:"POND_NBD_S3_CREDENTIALS" type:"existingfile" placeholder:"path" help:"File with S3 access key and secret key on separate lines"`
+	S3Access      string `name:"s3-access" env:"POND_NBD_S3_ACCESS" placeholder:"key" help:"S3 access key (prefer --s3-credentials)"`
+	S3Secret      string `name:"s3-secret" env:"POND_NBD_S3_SECRET" hidden:"" help:"S3 secret key (environment only, prefer --s3-credentials)"`
+
+	CacheDir     string   `env:"POND_NBD_CACHE_DIR" type:"path" placeholder:"path" help:"Local cache directory"`
+	CacheMode    string   `env:"POND_NBD_CACHE_MODE" placeholder:"mode" help:"Where cached data is kept: file (default), memory, pass-through"`
+	CacheMemory  string   `env:"POND_NBD_CACHE_MEMORY" placeholder:"size" help:"Memory limit per object in memory mode, e.g. 512M"`
+	CacheChunk   string   `name:"cache-chunk-size" env:"POND_NBD_CACHE_CHUNK_SIZE" placeholder:"size" help:"Size of remote range requests, power of two between 1M and 1G (default 8M)"`
+	CacheAhead   string   `name:"cache-readahead" env:"POND_NBD_CACHE_READAHEAD" placeholder:"size" help:"Readahead window limit for sequential reads (default 64M, 0 disables)"`
+	CacheTrace   string   `name:"cache-boot-trace" env:"POND_NBD_CACHE_BOOT_TRACE" placeholder:"duration" help:"Record first reads for this long and prefetch them on next open, e.g. 3m"`
+	CacheStrict  bool     `name:"cache-strict" env:"POND_NBD_CACHE_STRICT" help:"Verify fetched chunks against verity hash tree before serving them"`
+	CacheRoot    bool     `name:"cache-require-root-hash" env:"POND_NBD_CACHE_REQUIRE_ROOT_HASH" help:"Refuse to export objects without pinned verity root hash"`
+	CacheMaxSize string   `env:"POND_NBD_CACHE_MAX_SIZE" placeholder:"size" help:"Total size of cached objects, e.g. 200G"`
+	CacheMinFree string   `env:"POND_NBD_CACHE_MIN_FREE" placeholder:"size" help:"Free space to keep on cache filesystem, e.g. 10G or 5%"`
+	Listen       []string `short:"l" env:"POND_NBD_LISTEN" placeholder:"uri" help:"NBD listeners (repeatable): nbd://host[:port], nbd+unix:///?socket=path, systemd://[name]"`
+
+	Serve    serveCmd    `cmd:"" default:"1" help:"Run NBD daemon (default)"`
+	Validate validateCmd `cmd:"" help:"Check configuration and exit"`
+	Show     showCmd     `cmd:"" name:"show-config" help:"Print effective configuration with secrets redacted"`
+}
 
-	var nbd daemon.Daemon
-	err := json.Unmarshal([]byte(config), &nbd)
+type serveCmd struct{}
+
+func (serveCmd) Run() error {
+	nbd, err := load()
 	if err != nil {
-		panic("default config: " + err.Error())
+		return err
 	}
+	return nbd.Run()
+}
 
-	err = nbd.Run()
+type validateCmd struct{}
+
+func (validateCmd) Run() error {
+	nbd, err := load()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
+	err = nbd.Validate()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+type showCmd struct{}
+
+func (showCmd) Run() error {
+	nbd, err := load()
+	if err != nil {
+		return err
+	}
+	return nbd.WriteConfig(os.Stdout)
+}
+
+// Load configuration file and apply command line overrides
+func load() (*daemon.Daemon, error) {
+	return daemon.Load(cli.Config, override)
+}
+
+// Command line flags and environment variables take precedence over
+// configuration file
+func override(d *daemon.Daemon) error {
+	set := func(dest *string, value string) {
+		if value != "" {
+			*dest = value
+		}
+	}
+	set(&d.S3.Endpoint, cli.S3Endpoint)
+	set(&d.S3.Bucket, cli.S3Bucket)
+	set(&d.S3.Prefix, cli.S3Prefix)
+	set(&d.Cache.Dir, cli.CacheDir)
+	set(&d.Cache.Mode, cli.CacheMode)
+	set(&d.Cache.MemoryLimit, cli.CacheMemory)
+	set(&d.Cache.ChunkSize, cli.CacheChunk)
+	set(&d.Cache.Readahead, cli.CacheAhead)
+	set(&d.Cache.BootTrace, cli.CacheTrace)
+	if cli.CacheStrict {
+		d.Cache.Strict = true
+	}
+	if cli.CacheRoot {
+		d.Cache.RequireRootHash = true
+	}
+	set(&d.Cache.MaxSize, cli.CacheMaxSize)
+	set(&d.Cache.MinFree, cli.CacheMinFree)
+	if cli.S3Access != "" || cli.S3Secret != "" {
+		d.S3.Access = cli.S3Access
+		d.S3.Secret = daemon.Secret(cli.S3Secret)
+		d.S3.Credentials = ""
+	}
+	set(&d.S3.Credentials, cli.S3Credentials)
+	if len(cli.Listen) != 0 {
+		d.Listen = make([]daemon.Listener, len(cli.Listen))
+		for i, uri := range cli.Listen {
+			d.Listen[i] = daemon.Listener{URI: uri}
+		}
+	}
+	return nil
+}
+
+func main() {
+	ctx := kong.Parse(&cli,
+		kong.Description("NBD server for S3 objects with local read cache"),
+	)
+	err := logger.SetupFormat(cli.LogFormat)
+	if err != nil {
+		fail(err)
+	}
+	err = ctx.Run()
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(x ...any) {
+	_, _ = fmt.Fprintln(os.Stderr, append([]any{"Error:"}, x...)...)
+	os.Exit(1)
 }
@@ -0,0 +1,90 @@
+package daemon
+
+import (
+	"crypto"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sio/pond/nbd/certs"
+	"github.com/sio/pond/nbd/server"
+)
+
+// Export access policy for authenticated clients.
+//
+// Permissions are granted via `exports` option in authorized_keys file,
+// the value is a comma separated list of shell patterns (see path.Match):
+//
+//	exports="rootfs@*,scratch" ssh-ed25519 AAAA... hostname
+//
+// Keys without such option may access all exports.
+type accessPolicy struct {
+	exports map[string][]string // fingerprint -> patterns, nil means unrestricted
+}
+
+// Load access policy and the list of trusted public keys from authorized_keys file
+func loadAccessPolicy(filename string) (*accessPolicy, []crypto.PublicKey, error) {
+	entries, err := certs.ParseAuthorizedKeys(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	policy := &accessPolicy{exports: make(map[string][]string)}
+	keys := make([]crypto.PublicKey, 0, len(entries))
+	for index, entry := range entries {
+		fingerprint, err := certs.Fingerprint(entry.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("key #%d: %w", index+1, err)
+		}
+		var patterns []string
+		for _, option := range entry.Options {
+			key, value, _ := strings.Cut(option, "=")
+			if !strings.EqualFold(key, "exports") {
+				continue
+			}
+			if patterns == nil {
+				patterns = make([]string, 0)
+			}
+			for _, pattern := range strings.Split(strings.Trim(value, `"`), ",") {
+				pattern = strings.TrimSpace(pattern)
+				if pattern == "" {
+					continue
+				}
+				_, err = path.Match(pattern, "")
+				if err != nil {
+					return nil, nil, fmt.Errorf("key #%d: invalid pattern %q: %w", index+1, pattern, err)
+				}
+				patterns = append(patterns, pattern)
+			}
+		}
+		policy.exports[fingerprint] = patterns
+		keys = append(keys, entry.Key)
+	}
+	return policy, keys, nil
+}
+
+// Check if client is allowed to access the export.
+//
+// Anonymous clients may only connect when TLS is optional, they are refused
+// access to all exports once an access policy is configured.
+func (p *accessPolicy) Check(client server.Client, name string) error {
+	if p == nil {
+		return nil
+	}
+	if client.Fingerprint == "" {
+		return fmt.Errorf("anonymous client %s may not access %q: %w", client, name, server.ErrForbidden)
+	}
+	patterns, found := p.exports[client.Fingerprint]
+	if !found {
+		return fmt.Errorf("unknown client key %s: %w", client.Fingerprint, server.ErrForbidden)
+	}
+	if patterns == nil {
+		return nil
+	}
+	for _, pattern := range patterns {
+		match, _ := path.Match(pattern, name)
+		if match {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s may not access %q: %w", client, name, server.ErrForbidden)
+}
@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"testing"
+
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/sio/pond/nbd/certs"
+	"github.com/sio/pond/nbd/server"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	var (
+		authorized []byte
+		clients    = make(map[string]string) // name -> fingerprint
+	)
+	for _, client := range []struct {
+		name    string
+		options string
+	}{
+		{name: "restricted", options: `exports="rootfs@*,scratch" `},
+		{name: "unrestricted"},
+		{name: "stranger"},
+	} {
+		public, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprint, err := certs.Fingerprint(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[client.name] = fingerprint
+		if client.name == "stranger" {
+			continue
+		}
+		sshkey, err := ssh.NewPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorized = append(authorized, client.options...)
+		authorized = append(authorized, ssh.MarshalAuthorizedKey(sshkey)...)
+	}
+	filename := filepath.Join(t.TempDir(), "authorized_keys")
+	err := os.WriteFile(filename, authorized, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, keys, err := loadAccessPolicy(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("loaded %d keys, want 2", len(keys))
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 10809}
+	for _, tt := range []struct {
+		client string // empty for clients without TLS
+		export string
+		ok     bool
+	}{
+		{client: "restricted", export: "rootfs@latest", ok: true},
+		{client: "restricted", export: "scratch", ok: true},
+		{client: "restricted", export: "home"},
+		{client: "unrestricted", export: "home", ok: true},
+		{client: "stranger", export: "rootfs@latest"},
+		{client: "", export: "rootfs@latest"},
+		{client: "", export: "home"},
+	} {
+		client := server.Client{Addr: addr, Fingerprint: clients[tt.client]}
+		err = policy.Check(client, tt.export)
+		if tt.ok && err != nil {
+			t.Errorf("client %q was refused access to %q: %v", tt.client, tt.export, err)
+		}
+		if !tt.ok && !errors.Is(err, server.ErrForbidden) {
+			t.Errorf("client %q accessing %q: want ErrForbidden, got %v", tt.client, tt.export, err)
+		}
+	}
+
+	var unconfigured *accessPolicy
+	err = unconfigured.Check(server.Client{Addr: addr}, "home")
+	if err != nil {
+		t.Errorf("anonymous client without access policy: %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sio/pond/nbd/s3"
+)
+
+// Remote storage for exported objects.
+//
+// Despite the name, not only S3 is supported: storage kind is selected by
+// endpoint URL scheme, see s3.CheckEndpoint. Bucket is required only for S3.
+type S3Config struct {
+	Endpoint    string // e.g. https://s3.example.com, range+https://images.example.com/pub, file:///srv/images
+	Bucket      string
+	Prefix      string
+	Access      string
+	Secret      Secret
+	Credentials string // file with access key and secret key on separate lines, overrides Access and Secret
+}
+
+type CacheConfig struct {
+	Dir         string
+	Mode        string // "file" (default), "memory" or "pass-through", see s3.Mode
+	MaxSize     string // total size of cached objects, e.g. "200G" (unlimited if empty)
+	MinFree     string // free space to keep on cache filesystem, e.g. "10G" or "5%"
+	MemoryLimit string // memory per object in "memory" mode, e.g. "512M"
+	ChunkSize   string // size of remote range requests, power of two between 1M and 1G (8M if empty)
+	Readahead   string // readahead window limit for sequential reads, e.g. "64M" (default), "0" disables readahead
+	BootTrace   string // record first reads for this long and prefetch them on next open, e.g. "3m" (disabled if empty)
+	Strict      bool   // verify fetched chunks against verity hash tree before serving them, see s3.Options
+
+	// Verity root hashes (hex) pinned by object reference, e.g.
+	// {"rootfs.squashfs?version=ID": "7b26..."}. Clients may pin root hashes
+	// via export names too, see objectRef.
+	RootHashes map[string]string `json:",omitempty"`
+
+	// Refuse to export objects without pinned root hash
+	RequireRootHash bool
+
+	// Verity hash tree of NAME may be stored in a separate NAME+HashSuffix
+	// object, e.g. ".verity" for `veritysetup format NAME NAME.verity`.
+	// Hash objects are not versioned: they must be replaced together with
+	// data objects. Hash tree is looked up in data object if there is no
+	// hash object.
+	HashSuffix string
+
+	// Chunk size overrides for matching objects, the first matching rule wins.
+	// Changing chunk size of a cached object keeps only the chunks that are
+	// fully covered by cached data.
+	ChunkSizeFor []ChunkSizeRule `json:",omitempty"`
+}
+
+// Chunk size for objects whose key matches Pattern (see path.Match),
+// e.g. {"Pattern": "*.iso", "Size": "32M"}
+type ChunkSizeRule struct {
+	Pattern string
+	Size    string
+}
+
+// Sensitive configuration value, never printed or serialized
+type Secret string
+
+const redacted = "<redacted>"
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
+
+// Load daemon configuration from JSON file and apply overrides on top of it
+// (e.g. from command line flags). Empty path means that configuration is
+// built from overrides alone.
+//
+// Daemon loaded from file re-reads it on SIGHUP, overrides are applied again
+// after each reload. The following settings are applied without restart:
+//
+//   - Listen: new listeners are started, removed ones are stopped
+//     (sockets passed by systemd are kept until restart)
+//   - S3: used for all exports opened after reload, credentials file is
+//     re-read too
+//   - Cache: used for all exports opened after reload, exports that are
+//     already open keep their cache files where they are. New disk usage
+//     limits are enforced within a minute
+//   - Overlay: affects new client connections
+//
+// Other settings require restart. Established client connections are never
+// interrupted by reload.
+func Load(path string, overrides ...func(*Daemon) error) (*Daemon, error) {
+	d, err := parseConfig(path, overrides)
+	if err != nil {
+		return nil, err
+	}
+	d.path = path
+	d.overrides = overrides
+	return d, nil
+}
+
+func parseConfig(path string, overrides []func(*Daemon) error) (*Daemon, error) {
+	d := new(Daemon)
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(d)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	for _, override := range overrides {
+		err := override(d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if d.S3.Credentials != "" {
+		var err error
+		d.S3.Access, d.S3.Secret, err = readCredentials(d.S3.Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("reading S3 credentials: %w", err)
+		}
+	}
+	return d, nil
+}
+
+// Read S3 credentials file: access key on the first line, secret key on
+// the second one. Empty lines and lines starting with # are ignored.
+func readCredentials(path string) (access string, secret Secret, err error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		return "", "", fmt.Errorf("%s: expected 2 non-empty lines, got %d", path, len(lines))
+	}
+	return lines[0], Secret(lines[1]), nil
+}
+
+// Check configuration for errors that can be detected without starting
+// the daemon
+func (d *Daemon) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(d.S3.Endpoint != "", "S3 endpoint is required")
+	if d.S3.Endpoint != "" {
+		err := s3.CheckEndpoint(d.S3.Endpoint, d.S3.Bucket)
+		check(err == nil, "S3 endpoint: %w", err)
+	}
+	options, err := d.Cache.options("")
+	check(err == nil, "%w", err)
+	check(d.Cache.Dir != "" || (options.Mode != s3.ModeFile && !d.Overlay.Enabled), "cache directory is required")
+	_, err = d.Cache.limit()
+	check(err == nil, "%w", err)
+	check(!strings.ContainsAny(d.Cache.HashSuffix, "/@?"), "cache hash suffix: unsupported characters: %q", d.Cache.HashSuffix)
+	for name, root := range d.Cache.RootHashes {
+		ref, isPointer, err := parseExportName(name)
+		check(err == nil && !isPointer && ref.String() == name, "root hash for %q: object reference must be NAME or NAME?version=ID (URL encoded)", name)
+		_, err = parseRootHash(root)
+		check(err == nil, "root hash for %q: %w", name, err)
+	}
+	check(len(d.Listen) != 0, "no listeners configured")
+	for _, listener := range d.Listen {
+		_, _, err := listener.endpoint()
+		check(err == nil, "listener %s: %w", listener, err)
+	}
+	check(d.TLS.Key != "" || !d.TLS.Required, "TLS is required but no TLS key was provided")
+	check(d.TLS.AuthorizedKeys != "" || !d.TLS.Required, "TLS is required but no authorized keys were provided")
+	check(d.TLS.AuthorizedKeys == "" || d.TLS.Key != "", "authorized keys require TLS key")
+	if d.Peers.Listen != "" || len(d.Peers.Static) != 0 {
+		check(d.TLS.Key != "", "peers require TLS key")
+		check(d.Peers.AuthorizedKeys != "", "peers require authorized keys")
+	}
+	check(d.Peers.Discovery == "" || d.Peers.Listen != "", "peer discovery requires peer listen address")
+	check(d.Limits.Connections >= 0 && d.Limits.InFlight >= 0 && d.Limits.Backend >= 0, "negative limits are not allowed")
+	if d.Limits.IdleTimeout != "" {
+		timeout, err := time.ParseDuration(d.Limits.IdleTimeout)
+		check(err == nil, "idle timeout: %w", err)
+		check(timeout >= 0, "idle timeout: negative value: %s", d.Limits.IdleTimeout)
+	}
+	return errors.Join(errs...)
+}
+
+// Print effective configuration as JSON, with secrets redacted
+func (d *Daemon) WriteConfig(w io.Writer) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(d)
+}
@@ -0,0 +1,106 @@
+package daemon
+
+import (
+	"testing"
+
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.json")
+	credentials := filepath.Join(dir, "credentials")
+	err := os.WriteFile(config, []byte(`{
+		"s3": {"endpoint": "http://127.0.0.1:9000", "bucket": "images", "credentials": "`+credentials+`"},
+		"cache": {"dir": "/var/cache/pond"},
+		"listen": [{"uri": "nbd://127.0.0.1"}]
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(credentials, []byte("# comment\nACCESSKEY\n\nsupersecret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := Load(config, func(d *Daemon) error {
+		d.S3.Prefix = "rootfs"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.S3.Access != "ACCESSKEY" || d.S3.Secret != "supersecret" {
+		t.Errorf("credentials were not loaded: %q, %q", d.S3.Access, string(d.S3.Secret))
+	}
+	if d.S3.Prefix != "rootfs" || d.S3.Bucket != "images" {
+		t.Errorf("override was not applied: %+v", d.S3)
+	}
+	err = d.Validate()
+	if err != nil {
+		t.Errorf("validation failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	err = d.WriteConfig(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "supersecret") {
+		t.Errorf("secret was not redacted:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), `"Secret": "<redacted>"`) {
+		t.Errorf("redacted secret not found:\n%s", out.String())
+	}
+	if d.S3.Secret.String() == "supersecret" {
+		t.Errorf("secret leaks via String()")
+	}
+
+	err = os.WriteFile(credentials, []byte("ACCESSKEY\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load(config)
+	if err == nil {
+		t.Errorf("incomplete credentials file was accepted")
+	}
+
+	d = new(Daemon)
+	d.Limits.IdleTimeout = "soon"
+	d.TLS.Required = true
+	d.Peers.Discovery = "239.255.77.77:10810"
+	d.Peers.Static = []string{"10.0.0.2:10810"}
+	d.Cache.RootHashes = map[string]string{"rootfs@latest": "7b26", "rootfs?roothash=7b26": ""}
+	d.Cache.HashSuffix = "/verity"
+	err = d.Validate()
+	for _, want := range []string{"endpoint", "cache", "listeners", "TLS", "no authorized keys", "idle timeout", "peers require", "peer discovery", "root hash for \"rootfs@latest\"", "root hash for \"rootfs?roothash=7b26\"", "hash suffix"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("validation error does not mention %s: %v", want, err)
+		}
+	}
+
+	d.S3.Endpoint = "https://s3.example.com"
+	err = d.Validate()
+	if err == nil || !strings.Contains(err.Error(), "bucket") {
+		t.Errorf("validation error does not mention bucket: %v", err)
+	}
+
+	// Diskless configuration
+	d = new(Daemon)
+	d.S3.Endpoint = "range+https://images.example.com/pub"
+	d.Listen = []Listener{{URI: "nbd://127.0.0.1"}}
+	d.Cache.Mode = "memory"
+	d.Cache.MemoryLimit = "1G"
+	err = d.Validate()
+	if err != nil {
+		t.Errorf("memory-only cache does not need cache directory: %v", err)
+	}
+	d.Overlay.Enabled = true
+	err = d.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cache directory") {
+		t.Errorf("overlays require cache directory: %v", err)
+	}
+}
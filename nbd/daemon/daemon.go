@@ -2,106 +2,464 @@ package daemon
 
 import (
 	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/sio/pond/nbd/certs"
 	"github.com/sio/pond/nbd/logger"
+	"github.com/sio/pond/nbd/overlay"
+	"github.com/sio/pond/nbd/peer"
 	"github.com/sio/pond/nbd/s3"
 	"github.com/sio/pond/nbd/server"
 )
 
 type Daemon struct {
-	S3 struct {
-		Endpoint string
-		Bucket   string
-		Prefix   string
-		Access   string
-		Secret   string
+	S3      S3Config
+	Cache   CacheConfig
+	Listen  []Listener
+	Overlay struct {
+		Enabled bool // writable exports with per-client copy-on-write overlays in cache directory
 	}
-	Cache struct {
-		Dir string
+	TLS struct {
+		Key            string // SSH private key of this server
+		AuthorizedKeys string // SSH public keys of clients (authorized_keys format, see accessPolicy), enables NBD over TLS
+		Required       bool   // refuse to serve clients over plain text connection
 	}
-	Listen []struct {
-		Network string
-		Address string
+	Limits struct {
+		Connections int    // simultaneous client connections
+		InFlight    int    // concurrent commands per connection
+		Backend     int    // concurrent backend operations, shared fairly between clients
+		IdleTimeout string // disconnect idle clients, e.g. "15m"
 	}
+	Metrics struct {
+		Listen string // TCP address for HTTP metrics endpoint (/metrics), disabled if empty
+	}
+	Peers struct {
+		Listen         string   // TCP address for sharing cached chunks with other daemons, e.g. ":10810" (disabled if empty)
+		Discovery      string   // UDP multicast group for finding peers on LAN, e.g. "239.255.77.77:10810"
+		Static         []string // peer addresses (host:port) that are not announced via multicast
+		AuthorizedKeys string   // SSH public keys of peers (authorized_keys format), our key is TLS.Key
+	}
+
+	path      string                // configuration file for hot reload (see Load)
+	overrides []func(*Daemon) error // applied on top of configuration file
+	mu        sync.RWMutex          // protects settings that are changed by reload
 }
 
+// Time limit for enumerating S3 objects on behalf of NBD client
+const listTimeout = 10 * time.Second
+
 func (d *Daemon) Run() error {
 	ctx, cancel := context.WithCancelCause(context.Background())
 	defer cancel(server.NBD_ESHUTDOWN)
 	log := logger.FromContext(ctx)
 
-	// Exclusive lock on local cache directory
-	abs, err := filepath.Abs(d.Cache.Dir)
-	if err == nil {
-		d.Cache.Dir = abs
+	err := d.Validate()
+	if err != nil {
+		return err
 	}
-	lock, err := Lock(filepath.Join(d.Cache.Dir, "lock"))
+
+	// Exclusive lock on local cache directory (if any)
+	if d.Cache.Dir != "" {
+		abs, err := filepath.Abs(d.Cache.Dir)
+		if err == nil {
+			d.Cache.Dir = abs
+		}
+	}
+	locks := make(cacheLocks)
+	_, err = locks.acquire(d.Cache.Dir)
 	if err != nil {
-		return fmt.Errorf("acquire cache directory lock: %w", err)
+		return err
+	}
+	defer locks.releaseAll(log)
+
+	// Client authentication and authorization
+	var (
+		tlsConfig *tls.Config
+		access    *accessPolicy
+		identity  crypto.Signer
+	)
+	if d.TLS.Key != "" {
+		identity, err = certs.PrivateKey(d.TLS.Key)
+		if err != nil {
+			return fmt.Errorf("loading TLS key: %w", err)
+		}
 	}
-	defer func() {
-		err := lock.Close()
+	if d.TLS.AuthorizedKeys != "" {
+		// Without authorized keys nobody could pass client authentication,
+		// TLS key is then used only for talking to peers
+		var clients []crypto.PublicKey
+		access, clients, err = loadAccessPolicy(d.TLS.AuthorizedKeys)
 		if err != nil {
-			log.Error("failed to release the lock file", "lock", lock, "error", err)
+			return fmt.Errorf("loading authorized keys: %w", err)
 		}
-	}()
+		tlsConfig = certs.NewPKI(identity, clients...).ServerConfig()
+	}
+
+	// NBD listeners
+	activated, err := activatedListeners()
+	if err != nil {
+		return err
+	}
+	tasks, err := prepareListeners(d.Listen, activated)
+	if err != nil {
+		return err
+	}
+
+	// Client resource limits (zero means unlimited)
+	limits := server.Limits{
+		Connections: d.Limits.Connections,
+		InFlight:    d.Limits.InFlight,
+		Backend:     d.Limits.Backend,
+	}
+	if d.Limits.IdleTimeout != "" {
+		limits.IdleTimeout, err = time.ParseDuration(d.Limits.IdleTimeout)
+		if err != nil {
+			return fmt.Errorf("parsing idle timeout: %w", err)
+		}
+	}
 
 	// Cache object memoization
 	var (
-		volume   = make(map[string]server.Backend)
+		volumes  = make(volumeMap)
 		volumeMu sync.Mutex
+		stopped  bool // volumes are closed, see below
+		overlays = newOverlaySet(&volumeMu, overlayIdleTimeout, log)
 	)
-	export := func(name string) (server.Backend, error) {
+	stats := newMetrics(func(each func(string, s3.Stats)) {
+		volumeMu.Lock()
+		defer volumeMu.Unlock()
+		for name, vol := range volumes {
+			if vol.cache != nil {
+				each(name, vol.cache.Stats())
+			}
+		}
+	})
+
+	// Chunk sharing with other daemons
+	var peers *peer.Client
+	if d.Peers.Listen != "" || len(d.Peers.Static) != 0 {
+		peers, err = d.startPeers(ctx, identity, func(id s3.ObjectID) peer.Source {
+			volumeMu.Lock()
+			defer volumeMu.Unlock()
+			for _, vol := range volumes {
+				if vol.cache != nil && vol.cache.ID() == id && vol.cache.Err() == nil {
+					return vol.cache
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Obtain a reference to cache object, the caller must drop it via
+	// release(). Opening takes a while (remote requests, hash tree
+	// verification), volumeMu is not held meanwhile: concurrent requests for
+	// the same volume wait for the first one, other volumes are not blocked.
+	openCache := func(ref objectRef) (*volume, error) {
+		remote, local, _ := d.current()
+		root, err := local.rootHash(ref)
+		if err != nil {
+			return nil, err
+		}
+		key := volumeKey(ref, root)
+		volumeMu.Lock()
+		for {
+			vol, found := volumes[key]
+			if !found {
+				break
+			}
+			vol.users++
+			volumeMu.Unlock()
+			<-vol.ready
+			volumeMu.Lock()
+			if vol.err == nil && vol.cache.Err() == nil {
+				volumeMu.Unlock()
+				return vol, nil
+			}
+			vol.users--
+			if vol.err != nil {
+				volumeMu.Unlock()
+				return nil, vol.err
+			}
+			if volumes[key] != vol {
+				continue // reopened concurrently
+			}
+			// Remote object has changed: connected clients can not continue
+			// anyway, new ones will get the new revision
+			log.Warn("reopening cache object", "name", key, "reason", vol.cache.Err())
+			err := vol.cache.Close()
+			if err != nil {
+				log.Error("closing cache failed", "name", key, "error", err)
+			}
+			delete(volumes, key)
+		}
+		vol := &volume{
+			name:   key,
+			object: ref.String(),
+			users:  1,
+			ready:  make(chan struct{}),
+		}
+		for _, other := range volumes {
+			// Local files can not be shared with the volume that is
+			// pinned to another root hash (or is not pinned at all)
+			vol.transient = vol.transient || other.object == vol.object
+		}
+		volumes[key] = vol
+		volumeMu.Unlock()
+
+		cache, err := func() (*s3.Cache, error) {
+			limit, err := local.limit()
+			if err != nil {
+				return nil, err
+			}
+			options, err := local.options(ref.key)
+			if err != nil {
+				return nil, err
+			}
+			if vol.transient && options.Mode == s3.ModeFile {
+				options.Mode = s3.ModeMemory
+			}
+			options.Reserve = func(path string, size int64) error {
+				volumeMu.Lock()
+				defer volumeMu.Unlock()
+				vol.path = path // not to be evicted while being opened
+				return volumes.reserve(local.Dir, limit, path, size, log)
+			}
+			if peers != nil {
+				options.Peers = peers
+			}
+			options.RootHash = root
+			if local.HashSuffix != "" {
+				options.HashObject = filepath.Join(remote.Prefix, ref.key) + local.HashSuffix
+			}
+			open := func() (*s3.Cache, error) {
+				return s3.OpenWithOptions(
+					remote.Endpoint,
+					remote.Access,
+					string(remote.Secret),
+					remote.Bucket,
+					filepath.Join(remote.Prefix, ref.key),
+					ref.version,
+					local.Dir,
+					options,
+				)
+			}
+			cache, err := open()
+			if errors.Is(err, errNoSpace) {
+				// Serving without cache is slow but better than not serving
+				log.Warn("not enough space in cache directory, serving without cache", "name", key, "error", err)
+				options.Mode = s3.ModePassThrough
+				cache, err = open()
+			}
+			return cache, err
+		}()
+
+		volumeMu.Lock()
+		defer volumeMu.Unlock()
+		defer close(vol.ready)
+		if err == nil && stopped {
+			_ = cache.Close()
+			err = server.NBD_ESHUTDOWN
+		}
+		if err != nil {
+			vol.err = err
+			delete(volumes, key)
+			return nil, err
+		}
+		vol.cache = cache
+		vol.path = cache.Path()
+		// Volumes of the same object are replaced only after the new one
+		// was opened successfully (e.g. requested root hash was verified)
+		volumes.closeSuperseded(vol, log)
+		return vol, nil
+	}
+	// Drop a reference obtained via openCache
+	release := func(vol *volume) {
+		volumeMu.Lock()
+		defer volumeMu.Unlock()
+		vol.users--
+	}
+
+	// Enforce disk usage limits after reload and when other programs
+	// consume disk space
+	go func() {
+		ticker := time.NewTicker(evictInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			_, local, _ := d.current()
+			limit, err := local.limit()
+			if err != nil || local.Dir == "" {
+				continue
+			}
+			volumeMu.Lock()
+			volumes.closeTransient(log)
+			err = volumes.reserve(local.Dir, limit, "", 0, log)
+			volumeMu.Unlock()
+			if err != nil {
+				log.Warn("cache disk usage over limit", "error", err)
+			}
+		}
+	}()
+
+	export := func(client server.Client, name string) (server.Backend, error) {
+		err := access.Check(client, name)
+		if err != nil {
+			return nil, err
+		}
+
+		ref, err := d.resolve(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		vol, err := openCache(ref)
+		if err != nil {
+			return nil, err
+		}
 		volumeMu.Lock()
 		defer volumeMu.Unlock()
+		base := &dontClose{
+			c:       vol.cache,
+			reader:  vol.cache.Readahead(),
+			name:    vol.name,
+			metrics: stats,
+			release: func() { release(vol) },
+		}
+		canPrefetch := vol.cache.Mode() != s3.ModePassThrough
+		_, local, overlayEnabled := d.current()
+		if !overlayEnabled && canPrefetch {
+			return prefetching{base}, nil
+		}
+		if !overlayEnabled {
+			return base, nil
+		}
+
+		key := overlayKey{owner: overlayOwner(client), export: vol.name}
+		entry, err := overlays.acquire(key, vol, func() (*overlay.Overlay, error) {
+			return overlay.Open(
+				filepath.Join(local.Dir, overlayDir, url.PathEscape(key.owner), url.PathEscape(key.export)),
+				&dontClose{c: vol.cache, reader: vol.cache.Readahead()}, // reads are accounted for by writable wrapper
+			)
+		})
+		if err != nil {
+			vol.users--
+			return nil, fmt.Errorf("open overlay: %w", err)
+		}
+		upper := &writable{
+			overlay: entry.layer,
+			base:    base,
+			release: func() { overlays.release(key, entry) },
+		}
+		if canPrefetch {
+			return prefetchingWritable{upper}, nil
+		}
+		return upper, nil
+	}
 
-		cache, found := volume[name]
-		if found {
-			return &dontClose{r: cache}, nil
-		}
-		cache, err := s3.Open(
-			d.S3.Endpoint,
-			d.S3.Access,
-			d.S3.Secret,
-			d.S3.Bucket,
-			filepath.Join(d.S3.Prefix, name),
-			d.Cache.Dir,
+	list := func(client server.Client) ([]server.Export, error) {
+		ctx, cancel := context.WithTimeout(ctx, listTimeout)
+		defer cancel()
+		remote, _, _ := d.current()
+		objects, err := s3.List(
+			ctx,
+			remote.Endpoint,
+			remote.Access,
+			string(remote.Secret),
+			remote.Bucket,
+			remote.Prefix,
 		)
 		if err != nil {
 			return nil, err
 		}
-		// TODO: clean up old cache artifacts when running low on disk space
-		volume[name] = cache
-		return &dontClose{r: cache}, nil
+		exports := make([]server.Export, 0, len(objects))
+		for _, object := range objects {
+			if access.Check(client, object.Name) != nil {
+				continue // clients do not see exports they can not access
+			}
+			exports = append(exports, server.Export{
+				Name:        object.Name,
+				Description: object.Description,
+			})
+		}
+		return exports, nil
+	}
+
+	// Metrics endpoint
+	if d.Metrics.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", stats)
+		web := &http.Server{
+			Addr:              d.Metrics.Listen,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		socket, err := net.Listen("tcp", d.Metrics.Listen)
+		if err != nil {
+			return fmt.Errorf("metrics endpoint: %w", err)
+		}
+		go func() {
+			err := web.Serve(socket)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error("metrics endpoint failed", "address", d.Metrics.Listen, "error", err)
+			}
+		}()
+		defer func() { _ = web.Close() }()
 	}
 
 	// Launch NBD server
 	nbd := server.New(ctx, export)
+	nbd.SetExportList(list)
+	nbd.SetLimits(limits)
+	if tlsConfig != nil {
+		nbd.SetTLS(tlsConfig, d.TLS.Required)
+	}
 	go nbd.ListenShutdown()
 	var group errgroup.Group
-	for _, listener := range d.Listen {
-		listener := listener
-		group.Go(func() error {
-			err := nbd.Listen(listener.Network, listener.Address)
-			if err != nil {
-				log.Error("nbd listener failed", "listener", fmt.Sprintf("%s://%s", listener.Network, listener.Address), "error", err)
-			}
-			return err
-		})
+	listeners := newListenerSet(nbd, &group, log)
+	err = listeners.apply(tasks)
+	if err != nil {
+		nbd.Shutdown()
+		return err
 	}
+	reloading := make(chan struct{})
+	go func() {
+		defer close(reloading)
+		d.watchReload(ctx, listeners, locks)
+	}()
 	err = group.Wait()
-	for name, cache := range volume {
-		closer, ok := cache.(io.Closer)
-		if !ok {
-			continue
+
+	// Cache locks are released only after reload watcher is gone
+	cancel(server.NBD_ESHUTDOWN)
+	<-reloading
+
+	volumeMu.Lock()
+	defer volumeMu.Unlock()
+	stopped = true
+	overlays.closeAll()
+	for name, vol := range volumes {
+		if vol.cache == nil {
+			continue // still being opened by a client that is gone
 		}
-		e := closer.Close()
+		e := vol.cache.Close()
 		if e != nil {
 			log.Error("closing cache failed", "name", name, "error", e)
 		}
@@ -109,12 +467,88 @@ func (d *Daemon) Run() error {
 	return err
 }
 
-// Hide Close() method from type assertion to avoid accidental closing of
-// memoized cache objects
+// Hide Close() method of memoized cache objects from NBD server.
+// Close() releases a reference to cache object instead: objects without
+// references may be evicted from local cache.
 type dontClose struct {
-	r io.ReaderAt
+	c       *s3.Cache
+	reader  io.ReaderAt // per-client readahead (optional)
+	name    string
+	metrics *daemonMetrics // optional
+	release func()         // optional
+	once    sync.Once
+}
+
+func (r *dontClose) Close() error {
+	if r.release != nil {
+		r.once.Do(r.release)
+	}
+	return nil
 }
 
 func (r *dontClose) ReadAt(p []byte, offset int64) (int, error) {
-	return r.r.ReadAt(p, offset)
+	var reader io.ReaderAt = r.c
+	if r.reader != nil {
+		reader = r.reader
+	}
+	start := time.Now()
+	n, err := reader.ReadAt(p, offset)
+	r.metrics.read(r.name, start, n, err)
+	return n, err
+}
+
+func (r *dontClose) Size() int64 {
+	return r.c.Size()
+}
+
+func (r *dontClose) BlockSize() (minimum, preferred, maximum uint32) {
+	return r.c.BlockSize()
+}
+
+func (r *dontClose) Description() string {
+	return r.c.Description()
+}
+
+// Export that serves NBD_CMD_CACHE as a prefetch hint.
+// Pass-through caches do not keep prefetched data and are exported without it.
+type prefetching struct {
+	*dontClose
+}
+
+func (r prefetching) Prefetch(offset, length int64) error {
+	return r.c.Prefetch(offset, length)
+}
+
+// Custom metadata context for NBD_CMD_BLOCK_STATUS:
+// status flag is set for byte ranges that are available in local cache
+const (
+	metaContextCached        = "pond:cached"
+	metaStateCached   uint32 = 1 << 0
+)
+
+func (r *dontClose) MetaContexts() []string {
+	return []string{metaContextCached}
 }
+
+func (r *dontClose) BlockStatus(context string, offset, length int64) ([]server.Extent, error) {
+	if context != metaContextCached {
+		return nil, fmt.Errorf("unsupported metadata context: %s", context)
+	}
+	cached := r.c.Cached(offset, length)
+	extents := make([]server.Extent, len(cached))
+	for i, extent := range cached {
+		extents[i].Length = extent.Length
+		if extent.Cached {
+			extents[i].Flags = metaStateCached
+		}
+	}
+	return extents, nil
+}
+
+var (
+	_ server.Sizer         = new(dontClose)
+	_ server.BlockSizer    = new(dontClose)
+	_ server.Describer     = new(dontClose)
+	_ server.Prefetcher    = prefetching{}
+	_ server.BlockStatuser = new(dontClose)
+)
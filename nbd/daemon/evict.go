@@ -0,0 +1,288 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sio/pond/nbd/logger"
+	"github.com/sio/pond/nbd/s3"
+)
+
+// Cache object opened by the daemon
+type volume struct {
+	cache  *s3.Cache // nil until ready
+	name   string    // key in volumeMap, see volumeKey
+	object string    // objectRef.String(), shared by volumes with different root hashes
+	path   string    // local data file, see s3.LocalObject
+	users  int       // client connections and overlays that use this object
+
+	// Cache object is being opened until ready is closed, err is set if
+	// that has failed
+	ready chan struct{}
+	err   error
+
+	// Opened in memory because another volume of the same object was using
+	// local files, closed once idle (see closeTransient)
+	transient bool
+}
+
+// Opened cache objects by volumeKey().
+// Access must be synchronized by the caller.
+type volumeMap map[string]*volume
+
+// Close idle volumes of the same object with other root hashes: the new
+// volume takes their place
+func (v volumeMap) closeSuperseded(current *volume, log logger.Logger) {
+	v.closeIdle(func(vol *volume) bool { return vol != current && vol.object == current.object }, log)
+}
+
+// Close idle volumes that were opened in memory only, see volume.transient
+func (v volumeMap) closeTransient(log logger.Logger) {
+	v.closeIdle(func(vol *volume) bool { return vol.transient }, log)
+}
+
+func (v volumeMap) closeIdle(match func(*volume) bool, log logger.Logger) {
+	for key, vol := range v {
+		if vol.users > 0 || vol.cache == nil || !match(vol) {
+			continue
+		}
+		err := vol.cache.Close()
+		if err != nil {
+			log.Error("closing cache failed", "name", key, "error", err)
+		}
+		delete(v, key)
+	}
+}
+
+// How often disk usage limits are enforced in background. Limits are also
+// checked each time a new cache object is opened.
+const evictInterval = time.Minute
+
+// Make room for a cache object of the given size by removing least recently
+// used objects from cache directory.
+//
+// Objects that are in use by clients are never removed. Objects that are open
+// but idle are closed before removal. Overlays are never removed either, but
+// they count towards disk usage. Zero size (and empty path) enforces disk
+// usage limits without reserving anything.
+func (v volumeMap) reserve(dir string, limit cacheLimit, path string, size int64, log logger.Logger) error {
+	objects, err := s3.ScanLocal(dir)
+	if err != nil {
+		return fmt.Errorf("scanning cache directory: %w", err)
+	}
+	overlays := filepath.Join(dir, overlayDir)
+	usage, err := s3.DiskUsage(overlays)
+	if err != nil {
+		return fmt.Errorf("scanning overlay directory: %w", err)
+	}
+	open := make(map[string]string, len(v))
+	for key, vol := range v {
+		open[vol.path] = key
+	}
+	var current int64
+	candidates := objects[:0]
+	for _, object := range objects {
+		if strings.HasPrefix(object.Path, overlays+string(filepath.Separator)) {
+			continue // overlay file that looks like a cache object
+		}
+		usage += object.Size
+		if object.Path == path {
+			current = object.Size
+			continue
+		}
+		if key, found := open[object.Path]; found {
+			vol := v[key]
+			if vol.users > 0 {
+				continue
+			}
+			object.Accessed = vol.cache.LastAccess()
+		}
+		candidates = append(candidates, object)
+	}
+	need := max(size-current, 0)
+	slices.SortFunc(candidates, func(a, b s3.LocalObject) int {
+		return a.Accessed.Compare(b.Accessed)
+	})
+	for {
+		ok, err := limit.fits(dir, usage, need)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		victim := candidates[0]
+		candidates = candidates[1:]
+		if key, found := open[victim.Path]; found {
+			err = v[key].cache.Close()
+			if err != nil {
+				log.Warn("closing cache object before eviction", "name", key, "error", err)
+			}
+			delete(v, key)
+		}
+		err = s3.RemoveLocal(victim.Path)
+		if err != nil {
+			log.Error("cache eviction failed", "path", victim.Path, "error", err)
+			continue
+		}
+		usage -= victim.Size
+		log.Info("evicted cache object", "path", victim.Path, "size", victim.Size, "accessed", victim.Accessed)
+	}
+	if path == "" {
+		return fmt.Errorf("%w: %s", errNoSpace, dir)
+	}
+	return fmt.Errorf("%w: %s: %d bytes required for %s", errNoSpace, dir, need, path)
+}
+
+var errNoSpace = errors.New("cache disk usage limit reached and all cached objects are in use")
+
+// Disk usage limits for cache directory
+type cacheLimit struct {
+	maxSize     int64   // total size of cache objects, zero means unlimited
+	minFree     int64   // free space to keep on cache filesystem
+	minFreeRate float64 // same as above, fraction of filesystem size
+}
+
+func (c CacheConfig) limit() (limit cacheLimit, err error) {
+	if c.MaxSize != "" {
+		limit.maxSize, err = parseSize(c.MaxSize)
+		if err != nil {
+			return limit, fmt.Errorf("cache max size: %w", err)
+		}
+	}
+	if percent, ok := strings.CutSuffix(c.MinFree, "%"); ok {
+		limit.minFreeRate, err = strconv.ParseFloat(percent, 64)
+		if err != nil || !(limit.minFreeRate >= 0 && limit.minFreeRate <= 100) {
+			return limit, fmt.Errorf("cache min free: invalid percentage: %s", c.MinFree)
+		}
+		limit.minFreeRate /= 100
+	} else if c.MinFree != "" {
+		limit.minFree, err = parseSize(c.MinFree)
+		if err != nil {
+			return limit, fmt.Errorf("cache min free: %w", err)
+		}
+	}
+	return limit, nil
+}
+
+// Cache object settings except for Reserve callback.
+// All chunk size rules are validated regardless of object key.
+func (c CacheConfig) options(key string) (opt s3.Options, err error) {
+	opt.Mode, err = s3.ParseMode(c.Mode)
+	if err != nil {
+		return opt, err
+	}
+	if c.MemoryLimit != "" {
+		opt.MemoryLimit, err = parseSize(c.MemoryLimit)
+		if err != nil {
+			return opt, fmt.Errorf("cache memory limit: %w", err)
+		}
+	}
+	if c.Readahead != "" {
+		opt.Readahead, err = parseSize(c.Readahead)
+		if err != nil {
+			return opt, fmt.Errorf("cache readahead: %w", err)
+		}
+		if opt.Readahead == 0 {
+			opt.Readahead = -1 // disabled
+		}
+	}
+	if c.BootTrace != "" {
+		opt.BootTrace, err = time.ParseDuration(c.BootTrace)
+		if err != nil {
+			return opt, fmt.Errorf("cache boot trace: %w", err)
+		}
+		if opt.BootTrace < 0 {
+			return opt, fmt.Errorf("cache boot trace: negative duration: %s", c.BootTrace)
+		}
+	}
+	opt.Strict = c.Strict
+	opt.ChunkSize, err = parseChunkSize(c.ChunkSize)
+	if err != nil {
+		return opt, fmt.Errorf("cache chunk size: %w", err)
+	}
+	matched := false
+	for _, rule := range c.ChunkSizeFor {
+		size, err := parseChunkSize(rule.Size)
+		if err != nil {
+			return opt, fmt.Errorf("cache chunk size for %q: %w", rule.Pattern, err)
+		}
+		match, err := path.Match(rule.Pattern, key)
+		if err != nil {
+			return opt, fmt.Errorf("cache chunk size for %q: %w", rule.Pattern, err)
+		}
+		if match && !matched {
+			opt.ChunkSize = size
+			matched = true
+		}
+	}
+	return opt, nil
+}
+
+// Parse chunk size, empty string selects the default one
+func parseChunkSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	size, err := parseSize(s)
+	if err != nil {
+		return 0, err
+	}
+	return size, s3.CheckChunkSize(size)
+}
+
+// Check if extra bytes may be allocated in cache directory
+func (l cacheLimit) fits(dir string, usage, extra int64) (bool, error) {
+	if l.maxSize > 0 && usage+extra > l.maxSize {
+		return false, nil
+	}
+	if l.minFree == 0 && l.minFreeRate == 0 {
+		return true, nil
+	}
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(dir, &fs)
+	if err != nil {
+		return false, fmt.Errorf("statfs: %s: %w", dir, err)
+	}
+	free := int64(fs.Bavail) * fs.Bsize
+	floor := max(l.minFree, int64(l.minFreeRate*float64(fs.Blocks)*float64(fs.Bsize)))
+	return free-extra >= floor, nil
+}
+
+// Parse human readable size: number of bytes with optional binary suffix,
+// e.g. "4096", "512M", "1.5T"
+func parseSize(s string) (int64, error) {
+	number := strings.TrimSuffix(strings.TrimSpace(s), "B")
+	number, binary := strings.CutSuffix(number, "i")
+	multiplier := int64(1)
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'K', 'k':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+	}
+	if multiplier != 1 {
+		number = number[:len(number)-1]
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || (binary && multiplier == 1) || !(value >= 0 && value*float64(multiplier) < 1<<63) {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
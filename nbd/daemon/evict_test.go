@@ -0,0 +1,190 @@
+package daemon
+
+import (
+	"testing"
+
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sio/pond/nbd/s3"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		size  int64
+		fail  bool
+	}{
+		{input: "4096", size: 4096},
+		{input: "512M", size: 512 << 20},
+		{input: "1.5G", size: 3 << 29},
+		{input: "2TiB", size: 2 << 40},
+		{input: "10k", size: 10 << 10},
+		{input: "", fail: true},
+		{input: "G", fail: true},
+		{input: "-1G", fail: true},
+		{input: "10i", fail: true},
+		{input: "NaN", fail: true},
+		{input: "9000000T", fail: true},
+	} {
+		size, err := parseSize(tt.input)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %d", tt.input, size)
+			}
+			continue
+		}
+		if err != nil || size != tt.size {
+			t.Errorf("%q: got %d (%v), want %d", tt.input, size, err, tt.size)
+		}
+	}
+
+	var c CacheConfig
+	c.MinFree = "5%"
+	limit, err := c.limit()
+	if err != nil || limit.minFreeRate != 0.05 {
+		t.Errorf("%s: got %+v (%v)", c.MinFree, limit, err)
+	}
+	c.MinFree = "105%"
+	_, err = c.limit()
+	if err == nil {
+		t.Errorf("%s: expected an error", c.MinFree)
+	}
+}
+
+func TestChunkSizeRules(t *testing.T) {
+	c := CacheConfig{
+		ChunkSize: "4M",
+		ChunkSizeFor: []ChunkSizeRule{
+			{Pattern: "*.iso", Size: "32M"},
+			{Pattern: "*", Size: "1M"},
+			{Pattern: "debian.iso", Size: "64M"},
+		},
+	}
+	for key, want := range map[string]int64{
+		"debian.iso":     32 << 20,
+		"disk.img":       1 << 20,
+		"images/foo.iso": 4 << 20, // path.Match does not cross slashes
+	} {
+		opt, err := c.options(key)
+		if err != nil || opt.ChunkSize != want {
+			t.Errorf("%s: got %d (%v), want %d", key, opt.ChunkSize, err, want)
+		}
+	}
+	for _, size := range []string{"3M", "512K", "2G"} {
+		c.ChunkSizeFor[1].Size = size
+		_, err := c.options("")
+		if err == nil {
+			t.Errorf("%s: expected an error", size)
+		}
+	}
+}
+
+func TestEviction(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	var objects []string
+	for i, name := range []string{"recent", "old", "older", "busy"} {
+		path := filepath.Join(dir, "images", name)
+		for _, file := range []string{path, path + ".chunk"} {
+			err := os.MkdirAll(filepath.Dir(file), 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(file, make([]byte, 100), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		accessed := now.Add(-time.Duration(i) * time.Hour)
+		if name == "busy" {
+			accessed = now.Add(-24 * time.Hour)
+		}
+		err := os.Chtimes(path, accessed, accessed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, path)
+	}
+	err := os.WriteFile(filepath.Join(dir, "lock"), nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan, err := s3.ScanLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scan) != len(objects) {
+		t.Fatalf("found %d cache objects, want %d: %v", len(scan), len(objects), scan)
+	}
+	object := scan[0].Size // all objects occupy the same space
+
+	volumes := volumeMap{"busy": {path: objects[3], users: 1}}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	// Room for one more object: the least recently used idle one is removed
+	limit := cacheLimit{maxSize: 4 * object}
+	err = volumes.reserve(dir, limit, filepath.Join(dir, "new"), object, slog.Default())
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	for i, want := range []bool{true, true, false, true} {
+		if exists(objects[i]) != want || exists(objects[i]+".chunk") != want {
+			t.Errorf("%s: exists=%v, want %v", objects[i], !want, want)
+		}
+	}
+
+	// Reserving space for an object that is already allocated is free
+	err = volumes.reserve(dir, limit, objects[0], object, slog.Default())
+	if err != nil {
+		t.Fatalf("reserve existing object: %v", err)
+	}
+	if !exists(objects[1]) {
+		t.Errorf("unnecessary eviction")
+	}
+
+	// Objects in use are never evicted
+	limit.maxSize = object - 1
+	err = volumes.reserve(dir, limit, "", 0, slog.Default())
+	if !errors.Is(err, errNoSpace) {
+		t.Fatalf("expected no space error, got %v", err)
+	}
+	if !exists(objects[3]) {
+		t.Errorf("object in use was evicted")
+	}
+	if exists(objects[0]) || exists(objects[1]) {
+		t.Errorf("idle objects were not evicted")
+	}
+
+	// Overlays are never evicted but count towards disk usage
+	overlay := filepath.Join(dir, overlayDir, "local", "images%2Fbusy")
+	for _, file := range []string{overlay, overlay + ".chunk"} {
+		err = os.MkdirAll(filepath.Dir(file), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(file, make([]byte, 100), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	limit.maxSize = 2*object - 1
+	err = volumes.reserve(dir, limit, "", 0, slog.Default())
+	if !errors.Is(err, errNoSpace) {
+		t.Fatalf("overlays were not counted: %v", err)
+	}
+	if !exists(overlay) || !exists(overlay+".chunk") {
+		t.Errorf("overlay was evicted")
+	}
+	limit.maxSize = 2 * object
+	err = volumes.reserve(dir, limit, "", 0, slog.Default())
+	if err != nil {
+		t.Errorf("reserve with overlays: %v", err)
+	}
+}
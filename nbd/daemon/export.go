@@ -0,0 +1,181 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sio/pond/nbd/logger"
+	"github.com/sio/pond/nbd/s3"
+)
+
+// Export name syntax
+//
+//	NAME             latest version of PREFIX/NAME object
+//	NAME?version=ID  specific version of PREFIX/NAME object (S3 bucket versioning)
+//	NAME@TAG         object referenced by PREFIX/NAME@TAG pointer object
+//
+// Any of the above may be pinned to verity root hash of the object by adding
+// roothash=HEX parameter, e.g. NAME?version=ID&roothash=HEX or
+// NAME@TAG?roothash=HEX. Objects with pinned root hash are served only after
+// verifying the whole verity hash tree (see s3.Options.RootHash).
+//
+// Pointer objects are small text files that contain a reference to the target
+// object relative to PREFIX: either NAME or NAME?version=ID. Pointers to
+// other pointers are not followed. Object keys that contain "@" are reserved
+// for pointers. Pointer target may carry a root hash too, it must match the
+// one requested by client if both are present.
+//
+// Tags are arbitrary: publisher may maintain a symlink-like NAME@latest
+// pointer that is updated on each release, as well as permanent tags like
+// NAME@2026-10-01 or NAME@stable.
+//
+// Pointers are resolved each time a client selects an export. A client that
+// reconnects after the pointer was updated will receive the new revision,
+// clients that can not tolerate that should use NAME?version=ID directly.
+type objectRef struct {
+	key      string // relative to S3 prefix
+	version  string // empty for the latest version
+	rootHash string // lowercase hex, empty if not pinned by export name
+}
+
+func (r objectRef) String() string {
+	if r.version == "" {
+		return r.key
+	}
+	return r.key + "?version=" + url.QueryEscape(r.version)
+}
+
+// Opened cache objects are identified by object reference and verity root
+// hash (nil if not pinned), using export name syntax
+func volumeKey(ref objectRef, root []byte) string {
+	if root == nil {
+		return ref.String()
+	}
+	separator := "?"
+	if ref.version != "" {
+		separator = "&"
+	}
+	return ref.String() + separator + "roothash=" + hex.EncodeToString(root)
+}
+
+// Time limit for resolving pointer objects on behalf of NBD client
+const resolveTimeout = 10 * time.Second
+
+// Parse export name. Pointer objects are returned as is, with isPointer set.
+func parseExportName(name string) (ref objectRef, isPointer bool, err error) {
+	key, query, hasQuery := strings.Cut(name, "?")
+	if key == "" || key == "." || key == ".." || path.Clean(key) != key ||
+		strings.HasPrefix(key, "/") || strings.HasPrefix(key, "../") {
+		return ref, false, fmt.Errorf("invalid object name: %q", key)
+	}
+	ref.key = key
+	isPointer = strings.Contains(key, "@")
+	if !hasQuery {
+		return ref, isPointer, nil
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return ref, false, fmt.Errorf("invalid export parameters: %q: %w", query, err)
+	}
+	for param, values := range params {
+		if len(values) != 1 || values[0] == "" {
+			return ref, false, fmt.Errorf("exactly one non-empty %s is required: %q", param, query)
+		}
+		switch param {
+		case "version":
+			if isPointer {
+				return ref, false, fmt.Errorf("tags and versions are mutually exclusive: %q", name)
+			}
+			ref.version = values[0]
+		case "roothash":
+			root, err := parseRootHash(values[0])
+			if err != nil {
+				return ref, false, err
+			}
+			ref.rootHash = hex.EncodeToString(root)
+		default:
+			return ref, false, fmt.Errorf("unsupported export parameter: %q", param)
+		}
+	}
+	return ref, isPointer, nil
+}
+
+// Parse verity root hash in hex encoding
+func parseRootHash(s string) ([]byte, error) {
+	root, err := hex.DecodeString(s)
+	if err != nil || len(root) < 16 || len(root) > 64 {
+		return nil, fmt.Errorf("invalid root hash: %q", s)
+	}
+	return root, nil
+}
+
+// Verity root hash of the object, nil if it is not pinned.
+//
+// Root hash may be pinned by daemon configuration and by export name at the
+// same time, conflicting values are an error.
+func (c CacheConfig) rootHash(ref objectRef) ([]byte, error) {
+	var root []byte
+	for _, pinned := range []string{c.RootHashes[ref.String()], ref.rootHash} {
+		if pinned == "" {
+			continue
+		}
+		hash, err := parseRootHash(pinned)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ref, err)
+		}
+		if root != nil && !bytes.Equal(root, hash) {
+			return nil, fmt.Errorf("%s: requested root hash %x does not match the configured one %x", ref, hash, root)
+		}
+		root = hash
+	}
+	if root == nil && c.RequireRootHash {
+		return nil, fmt.Errorf("%s: root hash is required", ref)
+	}
+	return root, nil
+}
+
+// Resolve export name to S3 object reference
+func (d *Daemon) resolve(ctx context.Context, name string) (objectRef, error) {
+	ref, isPointer, err := parseExportName(name)
+	if err != nil || !isPointer {
+		return ref, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	remote, _, _ := d.current()
+	target, err := s3.ReadPointer(
+		ctx,
+		remote.Endpoint,
+		remote.Access,
+		string(remote.Secret),
+		remote.Bucket,
+		filepath.Join(remote.Prefix, ref.key),
+	)
+	if err != nil {
+		return ref, fmt.Errorf("resolve %s: %w", name, err)
+	}
+	pinned := ref.rootHash
+	ref, isPointer, err = parseExportName(target)
+	if err != nil {
+		return ref, fmt.Errorf("resolve %s: %w", name, err)
+	}
+	if isPointer {
+		return ref, fmt.Errorf("resolve %s: pointer to another pointer is not allowed: %s", name, target)
+	}
+	if pinned != "" && ref.rootHash != "" && pinned != ref.rootHash {
+		return ref, fmt.Errorf("resolve %s: root hash does not match the requested one: %s", name, target)
+	}
+	if pinned != "" {
+		ref.rootHash = pinned
+	}
+	log := logger.FromContext(ctx)
+	log.Info("export name resolved", "name", name, "object", ref)
+	return ref, nil
+}
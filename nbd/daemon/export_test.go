@@ -0,0 +1,107 @@
+package daemon
+
+import (
+	"testing"
+
+	"encoding/hex"
+)
+
+func TestParseExportName(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		ref     objectRef
+		pointer bool
+		fail    bool
+	}{
+		{name: "rootfs", ref: objectRef{key: "rootfs"}},
+		{name: "images/rootfs.squashfs", ref: objectRef{key: "images/rootfs.squashfs"}},
+		{name: "rootfs?version=3HL4kqtJlcpXroDTDmJ", ref: objectRef{key: "rootfs", version: "3HL4kqtJlcpXroDTDmJ"}},
+		{name: "rootfs@latest", ref: objectRef{key: "rootfs@latest"}, pointer: true},
+		{name: "rootfs@2026-10-01", ref: objectRef{key: "rootfs@2026-10-01"}, pointer: true},
+		{name: "rootfs?roothash=7B26410BA9CD392D5E95C2F373CDFBD894FA406B351ED54AC5B6416E5514F5F4", ref: objectRef{key: "rootfs", rootHash: "7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f4"}},
+		{name: "rootfs?version=1&roothash=7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f4", ref: objectRef{key: "rootfs", version: "1", rootHash: "7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f4"}},
+		{name: "rootfs@latest?roothash=7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f4", ref: objectRef{key: "rootfs@latest", rootHash: "7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f4"}, pointer: true},
+		{name: "rootfs@latest?version=1", fail: true},
+		{name: "rootfs?roothash=7b26", fail: true},
+		{name: "rootfs?roothash=not-hex", fail: true},
+		{name: "rootfs?version=", fail: true},
+		{name: "rootfs?version=1&version=2", fail: true},
+		{name: "rootfs?rev=1", fail: true},
+		{name: "", fail: true},
+		{name: "../secret", fail: true},
+		{name: "/etc/passwd", fail: true},
+		{name: "images/../rootfs", fail: true},
+	} {
+		ref, pointer, err := parseExportName(tt.name)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tt.name, ref)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.name, err)
+			continue
+		}
+		if ref != tt.ref || pointer != tt.pointer {
+			t.Errorf("%q: got %#v (pointer=%t), want %#v (pointer=%t)", tt.name, ref, pointer, tt.ref, tt.pointer)
+		}
+	}
+}
+
+func TestRootHashPinning(t *testing.T) {
+	const (
+		root  = "7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f4"
+		other = "7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f0"
+	)
+	c := CacheConfig{
+		RootHashes: map[string]string{"rootfs?version=1": root},
+	}
+	for _, tt := range []struct {
+		ref  objectRef
+		want string
+		fail bool
+	}{
+		{ref: objectRef{key: "rootfs", version: "1"}, want: root},
+		{ref: objectRef{key: "rootfs", version: "1", rootHash: root}, want: root},
+		{ref: objectRef{key: "rootfs", version: "1", rootHash: other}, fail: true},
+		{ref: objectRef{key: "rootfs", version: "2", rootHash: other}, want: other},
+		{ref: objectRef{key: "rootfs"}},
+	} {
+		got, err := c.rootHash(tt.ref)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%#v: expected an error, got %x", tt.ref, got)
+			}
+			continue
+		}
+		if err != nil || hex.EncodeToString(got) != tt.want {
+			t.Errorf("%#v: got %x (%v), want %s", tt.ref, got, err, tt.want)
+		}
+	}
+
+	c.RequireRootHash = true
+	_, err := c.rootHash(objectRef{key: "rootfs"})
+	if err == nil {
+		t.Error("object without root hash was accepted")
+	}
+}
+
+func TestVolumeKey(t *testing.T) {
+	root, _ := hex.DecodeString("7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f4")
+	for _, ref := range []objectRef{
+		{key: "rootfs"},
+		{key: "rootfs", version: "1"},
+	} {
+		if volumeKey(ref, nil) != ref.String() {
+			t.Errorf("%#v: unpinned volume key: %s", ref, volumeKey(ref, nil))
+		}
+		key := volumeKey(ref, root)
+		parsed, _, err := parseExportName(key)
+		want := ref
+		want.rootHash = hex.EncodeToString(root)
+		if err != nil || parsed != want {
+			t.Errorf("%#v: volume key %s is not a valid export name: %#v (%v)", ref, key, parsed, err)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/sio/pond/nbd/logger"
+	"github.com/sio/pond/nbd/server"
+)
+
+// NBD listener configuration
+//
+// Either Network+Address or URI must be provided:
+//
+//	{"network": "tcp", "address": "0.0.0.0:10809"}
+//	{"network": "unix", "address": "/run/pond/nbd.sock"}
+//	{"uri": "nbd://0.0.0.0"}
+//	{"uri": "nbd+unix:///?socket=/run/pond/nbd.sock"}
+//
+// Sockets passed by systemd (socket activation) are selected by their names
+// from FileDescriptorName= option of the socket unit. Empty name selects all
+// sockets passed to the daemon:
+//
+//	{"network": "systemd", "address": "nbd"}
+//	{"uri": "systemd://nbd"}
+//	{"uri": "systemd://"}
+type Listener struct {
+	Network string
+	Address string
+	URI     string
+}
+
+func (l Listener) String() string {
+	if l.URI != "" {
+		return l.URI
+	}
+	return fmt.Sprintf("%s://%s", l.Network, l.Address)
+}
+
+// Default NBD port (IANA)
+const nbdPort = "10809"
+
+// Network and address to listen on
+func (l Listener) endpoint() (network, address string, err error) {
+	if l.URI == "" {
+		switch l.Network {
+		case "tcp", "tcp4", "tcp6", "unix", "systemd":
+			return l.Network, l.Address, nil
+		default:
+			return "", "", fmt.Errorf("unsupported network: %q", l.Network)
+		}
+	}
+	if l.Network != "" || l.Address != "" {
+		return "", "", fmt.Errorf("network/address and uri are mutually exclusive: %s", l.URI)
+	}
+	uri, err := url.Parse(l.URI)
+	if err != nil {
+		return "", "", err
+	}
+	if uri.Path != "" && uri.Path != "/" {
+		return "", "", fmt.Errorf("export name is not allowed in listener uri: %s", l.URI)
+	}
+	switch uri.Scheme {
+	case "nbd":
+		if uri.Host == "" {
+			return "", "", fmt.Errorf("host is required: %s", l.URI)
+		}
+		if len(uri.Query()) != 0 {
+			return "", "", fmt.Errorf("unsupported parameters: %s", l.URI)
+		}
+		port := uri.Port()
+		if port == "" {
+			port = nbdPort
+		}
+		return "tcp", net.JoinHostPort(uri.Hostname(), port), nil
+	case "nbd+unix":
+		if uri.Host != "" {
+			return "", "", fmt.Errorf("host is not allowed: %s", l.URI)
+		}
+		query := uri.Query()
+		socket := query.Get("socket")
+		if socket == "" || len(query) != 1 || len(query["socket"]) != 1 {
+			return "", "", fmt.Errorf("exactly one socket parameter is required: %s", l.URI)
+		}
+		return "unix", socket, nil
+	case "systemd":
+		if uri.Path != "" || len(uri.Query()) != 0 {
+			return "", "", fmt.Errorf("only socket name is allowed: %s", l.URI)
+		}
+		return "systemd", uri.Host, nil
+	default:
+		return "", "", fmt.Errorf("unsupported uri scheme: %s", l.URI)
+	}
+}
+
+// Validated listener ready to be opened
+type listenTask struct {
+	key       string // network endpoint, unique among all listeners
+	name      string // human readable description
+	activated bool   // socket was passed by systemd
+	open      func() (net.Listener, error)
+}
+
+// Validate listener configuration and match activated sockets.
+// Activated sockets that were not requested by any listener are closed.
+func prepareListeners(config []Listener, activated []activatedListener) (tasks []listenTask, err error) {
+	claimed := make([]bool, len(activated))
+	defer func() {
+		for i, a := range activated {
+			if err != nil || !claimed[i] {
+				_ = a.listener.Close()
+			}
+		}
+	}()
+	seen := make(map[string]bool)
+	for _, listener := range config {
+		network, address, err := listener.endpoint()
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", listener, err)
+		}
+		if network != "systemd" {
+			key := fmt.Sprintf("%s://%s", network, address)
+			if seen[key] {
+				return nil, fmt.Errorf("listener %s: duplicate endpoint: %s", listener, key)
+			}
+			seen[key] = true
+			tasks = append(tasks, listenTask{
+				key:  key,
+				name: listener.String(),
+				open: func() (net.Listener, error) {
+					return server.NewListener(network, address)
+				},
+			})
+			continue
+		}
+		var found bool
+		for i, a := range activated {
+			if claimed[i] || (address != "" && a.name != address) {
+				continue
+			}
+			found = true
+			claimed[i] = true
+			socket := a.listener
+			tasks = append(tasks, listenTask{
+				key:       fmt.Sprintf("systemd://%d", listenFdsStart+i),
+				name:      fmt.Sprintf("systemd://%s (%s)", a.name, server.URI(socket.Addr())),
+				activated: true,
+				open: func() (net.Listener, error) {
+					return socket, nil
+				},
+			})
+		}
+		if !found {
+			return nil, fmt.Errorf("listener %s: no matching sockets were passed by systemd", listener)
+		}
+	}
+	return tasks, nil
+}
+
+// NBD listeners that may be added and removed at runtime
+type listenerSet struct {
+	nbd     *server.Server
+	group   *errgroup.Group
+	log     logger.Logger
+	running map[string]*runningListener // by listenTask.key
+}
+
+type runningListener struct {
+	listenTask
+	listener net.Listener
+}
+
+func newListenerSet(nbd *server.Server, group *errgroup.Group, log logger.Logger) *listenerSet {
+	return &listenerSet{
+		nbd:     nbd,
+		group:   group,
+		log:     log,
+		running: make(map[string]*runningListener),
+	}
+}
+
+// Start listeners that are not running yet and stop the ones that are not
+// in the list anymore. Activated sockets are never stopped: systemd will not
+// pass them again until restart.
+//
+// Either all new listeners are started or none. Established connections are
+// not affected by stopping listeners.
+func (s *listenerSet) apply(tasks []listenTask) error {
+	want := make(map[string]bool)
+	var started []*runningListener
+	for _, task := range tasks {
+		want[task.key] = true
+		if s.running[task.key] != nil {
+			continue
+		}
+		l, err := task.open()
+		if err != nil {
+			for _, r := range started {
+				_ = r.listener.Close()
+			}
+			return fmt.Errorf("listener %s: %w", task.name, err)
+		}
+		started = append(started, &runningListener{listenTask: task, listener: l})
+	}
+	for _, r := range started {
+		r := r
+		s.running[r.key] = r
+		s.group.Go(func() error {
+			err := s.nbd.Serve(r.listener)
+			if err != nil {
+				s.log.Error("nbd listener failed", "listener", r.name, "error", err)
+			}
+			return err
+		})
+	}
+	for key, r := range s.running {
+		if want[key] || r.activated {
+			continue
+		}
+		err := r.listener.Close()
+		if err != nil {
+			s.log.Warn("closing nbd listener", "listener", r.name, "error", err)
+		}
+		delete(s.running, key)
+		s.log.Info("nbd listener stopped", "listener", r.name)
+	}
+	return nil
+}
+
+// Number of listeners passed by systemd
+func (s *listenerSet) activated() (count int) {
+	for _, r := range s.running {
+		if r.activated {
+			count++
+		}
+	}
+	return count
+}
+
+// Socket passed by systemd
+type activatedListener struct {
+	name     string
+	listener net.Listener
+}
+
+// Sockets passed by systemd socket activation, see sd_listen_fds(3).
+//
+// Environment variables are cleared to avoid passing sockets to child
+// processes, so this function may be called only once.
+func activatedListeners() ([]activatedListener, error) {
+	pid := os.Getenv("LISTEN_PID")
+	fds := os.Getenv("LISTEN_FDS")
+	fdnames := os.Getenv("LISTEN_FDNAMES")
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(env)
+	}
+	names, err := parseActivation(pid, fds, fdnames, os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+	listeners := make([]activatedListener, 0, len(names))
+	for i, name := range names {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(file) // duplicates file descriptor
+		_ = file.Close()
+		if err != nil {
+			for _, a := range listeners {
+				_ = a.listener.Close()
+			}
+			return nil, fmt.Errorf("socket activation: file descriptor %d (%s): %w", fd, name, err)
+		}
+		listeners = append(listeners, activatedListener{name: name, listener: l})
+	}
+	return listeners, nil
+}
+
+// First file descriptor passed by systemd (SD_LISTEN_FDS_START)
+const listenFdsStart = 3
+
+// Parse socket activation environment and return names of passed sockets
+func parseActivation(pid, fds, fdnames string, self int) ([]string, error) {
+	if pid == "" && fds == "" {
+		return nil, nil
+	}
+	target, err := strconv.Atoi(pid)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: invalid LISTEN_PID: %q", pid)
+	}
+	if target != self {
+		return nil, nil // sockets were passed to another process
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("socket activation: invalid LISTEN_FDS: %q", fds)
+	}
+	names := strings.Split(fdnames, ":")
+	if fdnames == "" || len(names) != count {
+		names = make([]string, count)
+		for i := range names {
+			names[i] = "unknown" // same default as in sd_listen_fds_with_names(3)
+		}
+	}
+	return names, nil
+}
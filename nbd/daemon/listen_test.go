@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"testing"
+
+	"net"
+	"slices"
+)
+
+func TestListenerEndpoint(t *testing.T) {
+	for _, tt := range []struct {
+		listener Listener
+		network  string
+		address  string
+		fail     bool
+	}{
+		{listener: Listener{Network: "tcp", Address: "127.0.0.1:10809"}, network: "tcp", address: "127.0.0.1:10809"},
+		{listener: Listener{Network: "unix", Address: "/run/nbd.sock"}, network: "unix", address: "/run/nbd.sock"},
+		{listener: Listener{Network: "systemd"}, network: "systemd"},
+		{listener: Listener{URI: "nbd://0.0.0.0"}, network: "tcp", address: "0.0.0.0:10809"},
+		{listener: Listener{URI: "nbd://[::1]:1234"}, network: "tcp", address: "[::1]:1234"},
+		{listener: Listener{URI: "nbd://0.0.0.0/"}, network: "tcp", address: "0.0.0.0:10809"},
+		{listener: Listener{URI: "nbd+unix:///?socket=/run/nbd.sock"}, network: "unix", address: "/run/nbd.sock"},
+		{listener: Listener{URI: "nbd+unix://?socket=/run/nbd.sock"}, network: "unix", address: "/run/nbd.sock"},
+		{listener: Listener{URI: "systemd://nbd"}, network: "systemd", address: "nbd"},
+		{listener: Listener{URI: "systemd://"}, network: "systemd"},
+		{listener: Listener{URI: "systemd://nbd/path"}, fail: true},
+		{listener: Listener{Network: "udp", Address: "127.0.0.1:10809"}, fail: true},
+		{listener: Listener{Network: "tcp", URI: "nbd://0.0.0.0"}, fail: true},
+		{listener: Listener{URI: "nbd://"}, fail: true},
+		{listener: Listener{URI: "nbd://0.0.0.0/export"}, fail: true},
+		{listener: Listener{URI: "nbd://0.0.0.0?tls=1"}, fail: true},
+		{listener: Listener{URI: "nbd+unix:///"}, fail: true},
+		{listener: Listener{URI: "nbd+unix://host/?socket=/run/nbd.sock"}, fail: true},
+		{listener: Listener{URI: "nbd+unix:///?socket=/a&socket=/b"}, fail: true},
+		{listener: Listener{URI: "http://0.0.0.0"}, fail: true},
+	} {
+		network, address, err := tt.listener.endpoint()
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s %s", tt.listener, network, address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.listener, err)
+			continue
+		}
+		if network != tt.network || address != tt.address {
+			t.Errorf("%s: got %s %s, want %s %s", tt.listener, network, address, tt.network, tt.address)
+		}
+	}
+}
+
+func TestParseActivation(t *testing.T) {
+	for _, tt := range []struct {
+		pid, fds, names string
+		want            []string
+		fail            bool
+	}{
+		{},
+		{pid: "42", fds: "2", names: "nbd:metrics", want: []string{"nbd", "metrics"}},
+		{pid: "42", fds: "2", want: []string{"unknown", "unknown"}},
+		{pid: "42", fds: "2", names: "nbd", want: []string{"unknown", "unknown"}},
+		{pid: "1", fds: "2", names: "nbd:metrics"},
+		{pid: "42", fds: "0"},
+		{pid: "", fds: "2", fail: true},
+		{pid: "42", fds: "", fail: true},
+		{pid: "42", fds: "-1", fail: true},
+	} {
+		got, err := parseActivation(tt.pid, tt.fds, tt.names, 42)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%+v: expected an error, got %v", tt, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tt, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt, got, tt.want)
+		}
+	}
+}
+
+func TestPrepareListeners(t *testing.T) {
+	activate := func(names ...string) []activatedListener {
+		var activated []activatedListener
+		for _, name := range names {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = l.Close() })
+			activated = append(activated, activatedListener{name: name, listener: l})
+		}
+		return activated
+	}
+	isClosed := func(l net.Listener) bool {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err != nil
+	}
+
+	activated := activate("nbd", "other", "nbd")
+	tasks, err := prepareListeners([]Listener{
+		{Network: "systemd", Address: "nbd"},
+		{URI: "nbd://127.0.0.1"},
+	}, activated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 3 {
+		t.Errorf("expected 3 listeners, got %d", len(tasks))
+	}
+	if isClosed(activated[0].listener) || isClosed(activated[2].listener) {
+		t.Errorf("matching activated socket was closed")
+	}
+	if !isClosed(activated[1].listener) {
+		t.Errorf("unused activated socket was not closed")
+	}
+
+	activated = activate("nbd")
+	_, err = prepareListeners([]Listener{{Network: "systemd", Address: "missing"}}, activated)
+	if err == nil {
+		t.Errorf("missing activated socket did not cause an error")
+	}
+	if !isClosed(activated[0].listener) {
+		t.Errorf("activated socket was not closed on error")
+	}
+
+	_, err = prepareListeners([]Listener{
+		{Network: "tcp", Address: "127.0.0.1:10809"},
+		{URI: "nbd://127.0.0.1"},
+	}, nil)
+	if err == nil {
+		t.Errorf("duplicate endpoint did not cause an error")
+	}
+}
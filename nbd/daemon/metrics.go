@@ -0,0 +1,103 @@
+package daemon
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/sio/pond/nbd/metrics"
+	"github.com/sio/pond/nbd/s3"
+)
+
+type daemonMetrics struct {
+	*metrics.Registry
+	readBytes   *metrics.Counter
+	readErrors  *metrics.Counter
+	readLatency *metrics.Histogram
+}
+
+// Register daemon metrics. Cache statistics are collected at scrape time
+// by calling volumes() which must report each opened cache object.
+func newMetrics(volumes func(each func(name string, stats s3.Stats))) *daemonMetrics {
+	m := &daemonMetrics{Registry: metrics.New()}
+	m.readBytes = m.Counter(
+		"pond_nbd_read_bytes_total",
+		"Bytes read by NBD clients",
+		"export",
+	)
+	m.readErrors = m.Counter(
+		"pond_nbd_read_errors_total",
+		"Failed reads",
+		"export",
+	)
+	m.readLatency = m.Histogram(
+		"pond_nbd_read_seconds",
+		"Latency of backend reads (at most one cache chunk per read)",
+		[]float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10, 30},
+		"export",
+	)
+
+	cache := func(name, help, kind string, value func(s3.Stats) float64) {
+		collect := func(emit func(float64, ...string)) {
+			volumes(func(export string, stats s3.Stats) {
+				emit(value(stats), export)
+			})
+		}
+		switch kind {
+		case "counter":
+			m.CounterFunc(name, help, collect, "export")
+		case "gauge":
+			m.GaugeFunc(name, help, collect, "export")
+		default:
+			panic("unsupported metric type: " + kind)
+		}
+	}
+	cache("pond_nbd_cache_hits_total", "Reads served from local cache", "counter",
+		func(s s3.Stats) float64 { return float64(s.Hits) })
+	cache("pond_nbd_cache_misses_total", "Reads that waited for remote storage", "counter",
+		func(s s3.Stats) float64 { return float64(s.Misses) })
+	cache("pond_nbd_cache_fetched_bytes_total", "Bytes downloaded from remote storage", "counter",
+		func(s s3.Stats) float64 { return float64(s.FetchedBytes) })
+	cache("pond_nbd_cache_readahead_chunks_total", "Chunks requested by sequential readahead", "counter",
+		func(s s3.Stats) float64 { return float64(s.Readahead) })
+	cache("pond_nbd_peer_fetched_bytes_total", "Bytes received from other daemons", "counter",
+		func(s s3.Stats) float64 { return float64(s.PeerBytes) })
+	cache("pond_nbd_peer_rejected_total", "Chunks received from other daemons that failed verification", "counter",
+		func(s s3.Stats) float64 { return float64(s.PeerRejected) })
+	cache("pond_nbd_cache_chunks_cached", "Chunks available in local cache (background fetch progress)", "gauge",
+		func(s s3.Stats) float64 { return float64(s.ChunksCached) })
+	cache("pond_nbd_cache_chunks_total", "Total number of chunks in cached object", "gauge",
+		func(s s3.Stats) float64 { return float64(s.ChunksTotal) })
+	cache("pond_nbd_integrity_verified_total", "Chunks checked by integrity validation", "counter",
+		func(s s3.Stats) float64 { return float64(s.Verified) })
+	cache("pond_nbd_integrity_failures_total", "Chunks that failed integrity validation", "counter",
+		func(s s3.Stats) float64 { return float64(s.Corrupted) })
+	cache("pond_nbd_s3_queue_used", "Remote connections in use for cached object", "gauge",
+		func(s s3.Stats) float64 { return float64(s.QueueUsed) })
+	cache("pond_nbd_s3_queue_size", "Remote connection limit for cached object", "gauge",
+		func(s s3.Stats) float64 { return float64(s.QueueSize) })
+
+	m.GaugeFunc("pond_nbd_s3_global_queue_used", "Remote connections in use for all objects",
+		func(emit func(float64, ...string)) {
+			used, _ := s3.GlobalQueueOccupancy()
+			emit(float64(used))
+		})
+	m.GaugeFunc("pond_nbd_s3_global_queue_size", "Remote connection limit for all objects",
+		func(emit func(float64, ...string)) {
+			_, size := s3.GlobalQueueOccupancy()
+			emit(float64(size))
+		})
+	return m
+}
+
+// Record a single backend read. Nil receiver is a no-op.
+func (m *daemonMetrics) read(export string, start time.Time, n int, err error) {
+	if m == nil {
+		return
+	}
+	m.readLatency.Observe(time.Since(start).Seconds(), export)
+	m.readBytes.Add(float64(n), export)
+	if err != nil && !errors.Is(err, io.EOF) {
+		m.readErrors.Add(1, export)
+	}
+}
@@ -0,0 +1,214 @@
+package daemon
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sio/pond/nbd/logger"
+	"github.com/sio/pond/nbd/overlay"
+	"github.com/sio/pond/nbd/server"
+)
+
+// Overlay files are stored in this subdirectory of cache directory
+const overlayDir = "overlay"
+
+// Each client gets its own copy-on-write overlay for each export
+type overlayKey struct {
+	owner  string
+	export string
+}
+
+// Copy-on-write overlays of connected and recently disconnected clients.
+//
+// Overlays outlive client connections to survive reconnects. They are closed
+// (and modifications are discarded) after staying idle for a while or when
+// the underlying cache object gets reopened.
+type overlaySet struct {
+	mu      sync.Locker // shared with volumeMap, must be held by the caller unless noted otherwise
+	items   map[overlayKey]*clientOverlay
+	timeout time.Duration
+	log     logger.Logger
+}
+
+// Overlays are kept for this long after the last client connection is closed
+const overlayIdleTimeout = 10 * time.Minute
+
+type clientOverlay struct {
+	layer *overlay.Overlay
+	vol   *volume     // base cache object, referenced until overlay is closed
+	conns int         // client connections that use the overlay
+	idle  *time.Timer // closes the overlay once the last connection is gone
+}
+
+func newOverlaySet(mu sync.Locker, timeout time.Duration, log logger.Logger) *overlaySet {
+	return &overlaySet{
+		mu:      mu,
+		items:   make(map[overlayKey]*clientOverlay),
+		timeout: timeout,
+		log:     log,
+	}
+}
+
+// Obtain overlay for a new client connection, open callback creates a new
+// one if needed. The caller must drop the reference via release().
+func (s *overlaySet) acquire(key overlayKey, vol *volume, open func() (*overlay.Overlay, error)) (*clientOverlay, error) {
+	entry, found := s.items[key]
+	if found && entry.vol != vol {
+		// Cache object was reopened (e.g. after its Err() was set):
+		// modifications made on top of the old one are not valid anymore
+		s.log.Warn("discarding overlay over a stale cache object", "name", key.export, "owner", key.owner)
+		s.close(key, entry)
+		found = false
+	}
+	if !found {
+		layer, err := open()
+		if err != nil {
+			return nil, err
+		}
+		entry = &clientOverlay{layer: layer, vol: vol}
+		vol.users++
+		s.items[key] = entry
+	}
+	if entry.idle != nil {
+		entry.idle.Stop()
+		entry.idle = nil
+	}
+	entry.conns++
+	return entry, nil
+}
+
+// Drop a reference obtained via acquire(). Acquires the lock by itself.
+func (s *overlaySet) release(key overlayKey, entry *clientOverlay) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry.conns--
+	if entry.conns > 0 || s.items[key] != entry {
+		return
+	}
+	entry.idle = time.AfterFunc(s.timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.items[key] == entry && entry.conns == 0 {
+			s.close(key, entry)
+		}
+	})
+}
+
+// Close overlay and drop its reference to cache object
+func (s *overlaySet) close(key overlayKey, entry *clientOverlay) {
+	if entry.idle != nil {
+		entry.idle.Stop()
+	}
+	err := entry.layer.Close()
+	if err != nil {
+		s.log.Error("closing overlay failed", "name", key.export, "owner", key.owner, "error", err)
+	}
+	entry.vol.users--
+	delete(s.items, key)
+}
+
+// Close all overlays regardless of connected clients
+func (s *overlaySet) closeAll() {
+	for key, entry := range s.items {
+		s.close(key, entry)
+	}
+}
+
+// Authenticated clients are identified by their keys,
+// anonymous ones by their network address (without port number)
+func overlayOwner(client server.Client) string {
+	if client.Fingerprint != "" {
+		return client.Fingerprint
+	}
+	if client.Addr == nil {
+		return "anonymous"
+	}
+	if client.Addr.Network() == "unix" {
+		return "local" // peer address of unix socket is usually empty
+	}
+	host, _, err := net.SplitHostPort(client.Addr.String())
+	if err != nil {
+		return client.Addr.String()
+	}
+	return host
+}
+
+// Writable export backed by a shared read-only cache object.
+//
+// Close() does not close the overlay: overlays are reused by consecutive
+// connections from the same client, see overlaySet.
+type writable struct {
+	overlay *overlay.Overlay
+	base    *dontClose
+	release func() // drops connection reference to overlay (optional)
+	once    sync.Once
+}
+
+func (w *writable) ReadAt(p []byte, offset int64) (int, error) {
+	start := time.Now()
+	n, err := w.overlay.ReadAt(p, offset)
+	w.base.metrics.read(w.base.name, start, n, err)
+	return n, err
+}
+
+func (w *writable) Close() error {
+	if w.release != nil {
+		w.once.Do(w.release)
+	}
+	return w.base.Close()
+}
+
+func (w *writable) WriteAt(p []byte, offset int64) (int, error) {
+	return w.overlay.WriteAt(p, offset)
+}
+
+func (w *writable) Flush() error {
+	return w.overlay.Flush()
+}
+
+func (w *writable) Trim(offset, length int64) error {
+	return w.overlay.Trim(offset, length)
+}
+
+func (w *writable) WriteZeroes(offset, length int64, noHole bool) error {
+	return w.overlay.WriteZeroes(offset, length, noHole)
+}
+
+func (w *writable) Size() int64 {
+	return w.overlay.Size()
+}
+
+func (w *writable) BlockSize() (minimum, preferred, maximum uint32) {
+	return w.base.BlockSize()
+}
+
+func (w *writable) Description() string {
+	return w.base.Description()
+}
+
+// Writable export that serves NBD_CMD_CACHE, see prefetching
+type prefetchingWritable struct {
+	*writable
+}
+
+func (w prefetchingWritable) Prefetch(offset, length int64) error {
+	return w.base.c.Prefetch(offset, length)
+}
+
+func (w *writable) MetaContexts() []string {
+	return w.base.MetaContexts()
+}
+
+func (w *writable) BlockStatus(context string, offset, length int64) ([]server.Extent, error) {
+	return w.base.BlockStatus(context, offset, length)
+}
+
+var (
+	_ server.Writable      = new(writable)
+	_ server.Sizer         = new(writable)
+	_ server.BlockSizer    = new(writable)
+	_ server.Describer     = new(writable)
+	_ server.Prefetcher    = prefetchingWritable{}
+	_ server.BlockStatuser = new(writable)
+)
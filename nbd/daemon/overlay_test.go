@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"testing"
+
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sio/pond/nbd/overlay"
+)
+
+func TestOverlayLifetime(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	var mu sync.Mutex
+	overlays := newOverlaySet(&mu, timeout, slog.Default())
+	dir := t.TempDir()
+	var opened int
+	open := func(key overlayKey) func() (*overlay.Overlay, error) {
+		return func() (*overlay.Overlay, error) {
+			opened++
+			return overlay.Open(filepath.Join(dir, key.owner, key.export), bytes.NewReader(make([]byte, overlay.BlockSize)))
+		}
+	}
+	acquire := func(key overlayKey, vol *volume) *clientOverlay {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		entry, err := overlays.acquire(key, vol, open(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+	exists := func(key overlayKey) bool {
+		_, err := os.Stat(filepath.Join(dir, key.owner, key.export))
+		return err == nil
+	}
+	waitClosed := func(key overlayKey) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for exists(key) {
+			if time.Now().After(deadline) {
+				t.Fatalf("idle overlay was not closed: %v", key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Connections of the same client share the overlay
+	vol := &volume{}
+	key := overlayKey{owner: "192.0.2.1", export: "rootfs"}
+	first := acquire(key, vol)
+	second := acquire(key, vol)
+	if first != second || opened != 1 || vol.users != 1 {
+		t.Fatalf("overlay was not reused: opened=%d, users=%d", opened, vol.users)
+	}
+
+	// Reconnecting client gets the same overlay
+	overlays.release(key, first)
+	overlays.release(key, second)
+	if acquire(key, vol) != first || opened != 1 {
+		t.Fatalf("overlay was not reused after reconnect")
+	}
+
+	// Overlay over reopened cache object is discarded
+	reopened := &volume{}
+	replaced := acquire(key, reopened)
+	if replaced == first || opened != 2 || vol.users != 0 || reopened.users != 1 {
+		t.Fatalf("stale overlay was not replaced: opened=%d, users=%d/%d", opened, vol.users, reopened.users)
+	}
+	overlays.release(key, first) // stale connection is gone
+	if !exists(key) {
+		t.Fatalf("overlay in use was removed")
+	}
+
+	// Idle overlays are closed after a timeout
+	overlays.release(key, replaced)
+	waitClosed(key)
+	mu.Lock()
+	if reopened.users != 0 || len(overlays.items) != 0 {
+		t.Errorf("idle overlay was not released: users=%d, overlays=%d", reopened.users, len(overlays.items))
+	}
+	mu.Unlock()
+
+	// Shutdown closes overlays in use
+	other := overlayKey{owner: "192.0.2.2", export: "rootfs"}
+	acquire(other, vol)
+	mu.Lock()
+	overlays.closeAll()
+	mu.Unlock()
+	if exists(other) || vol.users != 0 {
+		t.Errorf("overlay was not closed on shutdown")
+	}
+}
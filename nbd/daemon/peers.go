@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sio/pond/nbd/certs"
+	"github.com/sio/pond/nbd/logger"
+	"github.com/sio/pond/nbd/peer"
+)
+
+// Start serving cached chunks to other daemons and discovering them.
+// Everything is stopped when context is cancelled.
+//
+// Peers authenticate each other with SSH keys the same way NBD clients do,
+// but have a separate list of trusted keys: NBD clients are not allowed to
+// fetch chunks directly and other daemons are not allowed to use exports.
+func (d *Daemon) startPeers(ctx context.Context, identity crypto.Signer, lookup peer.Lookup) (*peer.Client, error) {
+	log := logger.FromContext(ctx)
+	trusted, err := certs.AuthorizedKeys(d.Peers.AuthorizedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("loading peer authorized keys: %w", err)
+	}
+	pki := certs.NewPKI(identity, trusted...)
+	client := peer.NewClient(pki.ClientConfig(), d.Peers.Static...)
+	if d.Peers.Listen == "" {
+		return client, nil
+	}
+
+	socket, err := net.Listen("tcp", d.Peers.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("peer endpoint: %w", err)
+	}
+	web := &http.Server{
+		Handler:           peer.Handler(lookup),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		err := web.Serve(tls.NewListener(socket, pki.ServerConfig()))
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("peer endpoint failed", "address", d.Peers.Listen, "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = web.Close()
+	}()
+
+	if d.Peers.Discovery != "" {
+		port := socket.Addr().(*net.TCPAddr).Port
+		err = peer.Discover(ctx, d.Peers.Discovery, port, client)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Info("sharing cached chunks with peers", "address", d.Peers.Listen, "discovery", d.Peers.Discovery, "static", d.Peers.Static)
+	return client, nil
+}
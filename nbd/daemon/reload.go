@@ -0,0 +1,164 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+
+	"github.com/sio/pond/nbd/logger"
+)
+
+// Consistent snapshot of reloadable settings
+func (d *Daemon) current() (s3 S3Config, cache CacheConfig, overlay bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.S3, d.Cache, d.Overlay.Enabled
+}
+
+// Reload configuration on SIGHUP until context is cancelled
+func (d *Daemon) watchReload(ctx context.Context, listeners *listenerSet, locks cacheLocks) {
+	if d.path == "" {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	log := logger.FromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
+		log.Info("reloading configuration", "path", d.path)
+		err := d.reload(listeners, locks)
+		if err != nil {
+			log.Error("configuration reload failed, keeping previous configuration", "path", d.path, "error", err)
+			continue
+		}
+		log.Info("configuration reloaded", "path", d.path)
+	}
+}
+
+// Apply reloadable settings from configuration file.
+// Nothing is changed if any of the new settings can not be applied.
+func (d *Daemon) reload(listeners *listenerSet, locks cacheLocks) error {
+	next, err := parseConfig(d.path, d.overrides)
+	if err != nil {
+		return err
+	}
+	err = next.Validate()
+	if err != nil {
+		return err
+	}
+	log := listeners.log
+
+	// Sockets passed by systemd are not reloadable
+	var static, dynamic []Listener
+	for _, listener := range next.Listen {
+		network, _, err := listener.endpoint()
+		if err != nil {
+			return fmt.Errorf("listener %s: %w", listener, err)
+		}
+		if network == "systemd" {
+			static = append(static, listener)
+		} else {
+			dynamic = append(dynamic, listener)
+		}
+	}
+	var previous []Listener
+	for _, listener := range d.Listen {
+		network, _, _ := listener.endpoint()
+		if network == "systemd" {
+			previous = append(previous, listener)
+		}
+	}
+	if !reflect.DeepEqual(static, previous) {
+		log.Warn("changes to systemd listeners require restart")
+	}
+	tasks, err := prepareListeners(dynamic, nil)
+	if err != nil {
+		return err
+	}
+	if len(tasks)+listeners.activated() == 0 {
+		return fmt.Errorf("no listeners configured")
+	}
+
+	if next.Cache.Dir != "" {
+		next.Cache.Dir, err = filepath.Abs(next.Cache.Dir)
+		if err != nil {
+			return fmt.Errorf("cache directory: %w", err)
+		}
+	}
+	release, err := locks.acquire(next.Cache.Dir)
+	if err != nil {
+		return err
+	}
+	err = listeners.apply(tasks)
+	if err != nil {
+		release()
+		return err
+	}
+
+	for section, changed := range map[string]bool{
+		"TLS":     !reflect.DeepEqual(d.TLS, next.TLS),
+		"Limits":  !reflect.DeepEqual(d.Limits, next.Limits),
+		"Metrics": !reflect.DeepEqual(d.Metrics, next.Metrics),
+		"Peers":   !reflect.DeepEqual(d.Peers, next.Peers),
+	} {
+		if changed {
+			log.Warn("configuration changes require restart", "section", section)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Listen = next.Listen
+	d.S3 = next.S3
+	d.Cache = next.Cache
+	d.Overlay = next.Overlay
+	return nil
+}
+
+// Exclusive locks on cache directories, by absolute path.
+//
+// Previously used directories stay locked after reload: cache objects
+// opened there are still in use.
+type cacheLocks map[string]*Lockfile
+
+// Lock cache directory unless it is already locked by this process.
+// Release function undoes the lock if it was acquired by this call.
+// Empty directory name (memory-only cache) is ignored.
+func (c cacheLocks) acquire(dir string) (release func(), err error) {
+	if dir == "" || c[dir] != nil {
+		return func() {}, nil
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("create cache directory: %w", err)
+	}
+	lock, err := Lock(filepath.Join(dir, "lock"))
+	if err != nil {
+		return nil, fmt.Errorf("acquire cache directory lock: %w", err)
+	}
+	c[dir] = lock
+	return func() {
+		_ = lock.Close()
+		delete(c, dir)
+	}, nil
+}
+
+// Release all locks
+func (c cacheLocks) releaseAll(log logger.Logger) {
+	for dir, lock := range c {
+		err := lock.Close()
+		if err != nil {
+			log.Error("failed to release the lock file", "lock", lock, "error", err)
+		}
+		delete(c, dir)
+	}
+}
@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"testing"
+
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/sio/pond/nbd/server"
+)
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	write := func(secret, cache string, ports ...int) {
+		t.Helper()
+		var listen string
+		for i, port := range ports {
+			if i != 0 {
+				listen += ","
+			}
+			listen += fmt.Sprintf(`{"uri": "nbd://127.0.0.1:%d"}`, port)
+		}
+		config := fmt.Sprintf(`{
+			"s3": {"endpoint": "http://127.0.0.1:9000", "bucket": "test", "secret": %q},
+			"cache": {"dir": %q},
+			"listen": [%s]
+		}`, secret, filepath.Join(dir, cache), listen)
+		err := os.WriteFile(path, []byte(config), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	accepts := func(port int) bool {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}
+	first, second := freePort(t), freePort(t)
+
+	write("old", "cache1", first)
+	d, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := make(cacheLocks)
+	t.Cleanup(func() { locks.releaseAll(slog.Default()) })
+	_, err = locks.acquire(d.Cache.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := prepareListeners(d.Listen, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nbd := server.New(context.Background(), nil)
+	var group errgroup.Group
+	listeners := newListenerSet(nbd, &group, slog.Default())
+	err = listeners.apply(tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		nbd.Shutdown()
+		err := group.Wait()
+		if err != nil {
+			t.Errorf("listeners: %v", err)
+		}
+	})
+	if !accepts(first) {
+		t.Fatalf("initial listener is not running")
+	}
+
+	write("new", "cache2", second)
+	err = d.reload(listeners, locks)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	remote, local, _ := d.current()
+	if remote.Secret != "new" || local.Dir != filepath.Join(dir, "cache2") {
+		t.Errorf("settings were not reloaded: %+v, %+v", remote, local)
+	}
+	if len(locks) != 2 {
+		t.Errorf("expected both cache directories to be locked, got %d locks", len(locks))
+	}
+	if !accepts(second) {
+		t.Errorf("new listener is not running")
+	}
+	if accepts(first) {
+		t.Errorf("removed listener is still running")
+	}
+
+	// Invalid configuration is rejected as a whole
+	write("broken", "cache3", second, second)
+	err = d.reload(listeners, locks)
+	if err == nil {
+		t.Fatalf("invalid configuration was accepted")
+	}
+	remote, _, _ = d.current()
+	if remote.Secret != "new" || !accepts(second) {
+		t.Errorf("failed reload affected running configuration")
+	}
+	err = os.WriteFile(path, []byte(`{"unknown": true}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.reload(listeners, locks)
+	if err == nil {
+		t.Fatalf("unknown configuration field was accepted")
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	return l.Addr().(*net.TCPAddr).Port
+}
@@ -1,10 +1,11 @@
 module github.com/sio/pond/nbd
 
-go 1.21
+go 1.22
 
 toolchain go1.22.2
 
 require (
+	github.com/alecthomas/kong v0.8.1
 	github.com/minio/minio-go/v7 v7.0.69
 	github.com/testcontainers/testcontainers-go v0.30.0
 	golang.org/x/crypto v0.19.0
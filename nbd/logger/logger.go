@@ -3,6 +3,7 @@ package logger
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"os"
 	"sync"
@@ -38,8 +39,22 @@ var loggerContextKey contextKey
 
 // Configure top level logger
 func Setup() {
+	_ = SetupFormat(FormatText)
+}
+
+// Supported log formats
+const (
+	FormatText = "text" // logfmt-like key=value pairs
+	FormatJSON = "json" // one JSON object per line
+)
+
+// Configure top level logger with the given output format
+func SetupFormat(format string) error {
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("unsupported log format: %q", format)
+	}
 	if !setup.TryLock() {
-		return // setup was already called
+		return nil // setup was already called
 	}
 
 	const timestamp = true // TODO: automatically detect systemd and disable timestamps
@@ -56,10 +71,15 @@ func Setup() {
 		}
 		return attr
 	}
-	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	options := &slog.HandlerOptions{
 		ReplaceAttr: replace,
-	})
+	}
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, options)
+	if format == FormatJSON {
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	}
 	slog.SetDefault(slog.New(handler))
+	return nil
 }
 
 var setup sync.Mutex
@@ -0,0 +1,303 @@
+// Minimal metrics registry with Prometheus text exposition format
+//
+// Only the features required by NBD daemon are implemented: counters,
+// histograms and callbacks that are evaluated at scrape time. Pulling in the
+// official client library for that seemed excessive.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+func New() *Registry {
+	return new(Registry)
+}
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// Write all metrics in text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := slices.Clone(r.families)
+	r.mu.Unlock()
+
+	counter := &countingWriter{w: w}
+	buf := bufio.NewWriter(counter)
+	for _, f := range families {
+		f.write(buf)
+	}
+	err := buf.Flush()
+	return counter.n, err
+}
+
+// Serve metrics over HTTP
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, _ = r.WriteTo(w)
+}
+
+// Metric name, description and label names
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+func (d *desc) check(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+}
+
+// Format a single sample line
+func (d *desc) sample(w *bufio.Writer, suffix string, values []string, extra string, value float64) {
+	w.WriteString(d.name)
+	w.WriteString(suffix)
+	if len(values) != 0 || extra != "" {
+		w.WriteByte('{')
+		for i, label := range d.labels {
+			if i != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label)
+			w.WriteString(`="`)
+			w.WriteString(escape(values[i]))
+			w.WriteByte('"')
+		}
+		if extra != "" {
+			if len(values) != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+// Monotonically increasing counter
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labels []string
+	value  float64
+}
+
+// Register a new counter
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, kind: "counter", labels: labels},
+		series: make(map[string]*counterSeries),
+	}
+	r.register(c)
+	return c
+}
+
+// Increase counter value for the given set of label values
+func (c *Counter) Add(delta float64, labels ...string) {
+	c.check(labels)
+	if delta < 0 {
+		panic(fmt.Sprintf("metric %s: counter can not decrease: %v", c.name, delta))
+	}
+	key := seriesKey(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labels: slices.Clone(labels)}
+		c.series[key] = s
+	}
+	s.value += delta
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		c.sample(w, "", s.labels, "", s.value)
+	}
+}
+
+// Distribution of observed values
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64 // non-cumulative, last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+// Register a new histogram with the given upper bounds of buckets
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	h := &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: slices.Compact(buckets),
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(h)
+	return h
+}
+
+// Record a single observation for the given set of label values
+func (h *Histogram) Observe(value float64, labels ...string) {
+	h.check(labels)
+	bucket, _ := slices.BinarySearch(h.buckets, value)
+	key := seriesKey(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{
+			labels: slices.Clone(labels),
+			counts: make([]uint64, len(h.buckets)+1),
+		}
+		h.series[key] = s
+	}
+	s.counts[bucket]++
+	s.sum += value
+	s.count++
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			bound := math.Inf(+1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			h.sample(w, "_bucket", s.labels, `le="`+formatFloat(bound)+`"`, float64(cumulative))
+		}
+		h.sample(w, "_sum", s.labels, "", s.sum)
+		h.sample(w, "_count", s.labels, "", float64(s.count))
+	}
+}
+
+// Metric that is evaluated at scrape time.
+//
+// Collect function is called for each scrape and must emit one value for
+// each set of label values.
+type callback struct {
+	desc
+	collect func(emit func(value float64, labels ...string))
+}
+
+// Register a counter that is evaluated at scrape time
+func (r *Registry) CounterFunc(name, help string, collect func(emit func(value float64, labels ...string)), labels ...string) {
+	r.register(&callback{
+		desc:    desc{name: name, help: help, kind: "counter", labels: labels},
+		collect: collect,
+	})
+}
+
+// Register a gauge that is evaluated at scrape time
+func (r *Registry) GaugeFunc(name, help string, collect func(emit func(value float64, labels ...string)), labels ...string) {
+	r.register(&callback{
+		desc:    desc{name: name, help: help, kind: "gauge", labels: labels},
+		collect: collect,
+	})
+}
+
+func (c *callback) write(w *bufio.Writer) {
+	c.header(w)
+	c.collect(func(value float64, labels ...string) {
+		c.check(labels)
+		c.sample(w, "", labels, "", value)
+	})
+}
+
+// Label values are joined with a byte that is very unlikely to occur in them
+func seriesKey(labels []string) string {
+	return strings.Join(labels, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, +1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func TestExposition(t *testing.T) {
+	r := New()
+	reads := r.Counter("test_read_bytes_total", "Bytes read", "export")
+	reads.Add(100, "b")
+	reads.Add(10, "a")
+	reads.Add(5, "a")
+	latency := r.Histogram("test_read_seconds", "Read latency", []float64{1, 0.1}, "export")
+	latency.Observe(0.05, "a")
+	latency.Observe(0.1, "a")
+	latency.Observe(5, "a")
+	r.GaugeFunc("test_queue", "Queue\noccupancy", func(emit func(float64, ...string)) {
+		emit(3, `with "quotes"`)
+	}, "queue")
+	r.CounterFunc("test_unlabeled_total", "No labels", func(emit func(float64, ...string)) {
+		emit(42)
+	})
+
+	want := `# HELP test_read_bytes_total Bytes read
+# TYPE test_read_bytes_total counter
+test_read_bytes_total{export="a"} 15
+test_read_bytes_total{export="b"} 100
+# HELP test_read_seconds Read latency
+# TYPE test_read_seconds histogram
+test_read_seconds_bucket{export="a",le="0.1"} 2
+test_read_seconds_bucket{export="a",le="1"} 2
+test_read_seconds_bucket{export="a",le="+Inf"} 3
+test_read_seconds_sum{export="a"} 5.15
+test_read_seconds_count{export="a"} 3
+# HELP test_queue Queue\noccupancy
+# TYPE test_queue gauge
+test_queue{queue="with \"quotes\""} 3
+# HELP test_unlabeled_total No labels
+# TYPE test_unlabeled_total counter
+test_unlabeled_total 42
+`
+	var got strings.Builder
+	n, err := r.WriteTo(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got.String(), want)
+	}
+	if n != int64(got.Len()) {
+		t.Errorf("byte count mismatch: returned %d, written %d", n, got.Len())
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("unexpected HTTP response: %d\n%s", rec.Code, rec.Body.String())
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type: %s", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("missing label value did not panic")
+		}
+	}()
+	New().Counter("test_total", "Test", "export").Add(1)
+}
@@ -0,0 +1,337 @@
+// Copy-on-write overlay for read-only block device images
+//
+// Writes are stored in a sparse local file, reads are served from that file
+// for modified blocks and from the base image for everything else.
+//
+// The map of modified blocks is kept in memory only: overlay file is
+// meaningless without it and gets removed on Close(). This is good enough
+// for scratch storage that is expected to be thrown away eventually.
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Overlay granularity. Partial writes to blocks that were not modified
+// before require reading the rest of the block from base image.
+const BlockSize = 4096
+
+// Read-only image underneath the overlay
+type Base interface {
+	io.ReaderAt
+	Size() int64
+}
+
+type Overlay struct {
+	base Base
+	file *os.File
+	size int64
+
+	// Writers are serialized: partial block writes are read-modify-write
+	// operations and must not interleave with each other
+	write sync.Mutex
+
+	// Bitmap of blocks that are stored in overlay file.
+	// Only writers modify the bitmap, readers need a read lock.
+	mu    sync.RWMutex
+	dirty []uint64
+}
+
+// Create an empty overlay file at the given path.
+// Existing file with the same name gets truncated.
+func Open(path string, base Base) (*Overlay, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	size := base.Size()
+	err = file.Truncate(size)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("truncate overlay file: %w", err)
+	}
+	blocks := (size + BlockSize - 1) / BlockSize
+	return &Overlay{
+		base:  base,
+		file:  file,
+		size:  size,
+		dirty: make([]uint64, (blocks+63)/64),
+	}, nil
+}
+
+// Close and remove overlay file
+func (o *Overlay) Close() error {
+	o.write.Lock()
+	defer o.write.Unlock()
+	return errors.Join(
+		o.file.Close(),
+		os.Remove(o.file.Name()),
+	)
+}
+
+// Size of the overlay device (same as base image)
+func (o *Overlay) Size() int64 {
+	return o.size
+}
+
+func (o *Overlay) ReadAt(p []byte, offset int64) (n int, err error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	if offset >= o.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > o.size-offset {
+		p = p[:o.size-offset]
+		defer func() {
+			if err == nil {
+				err = io.EOF
+			}
+		}()
+	}
+	for n < len(p) {
+		cur := offset + int64(n)
+		stop, dirty := o.run(cur, offset+int64(len(p)))
+		var src io.ReaderAt = o.base
+		if dirty {
+			src = o.file
+		}
+		done, err := src.ReadAt(p[n:stop-offset], cur)
+		n += done
+		if errors.Is(err, io.EOF) && cur+int64(done) == stop {
+			err = nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if done == 0 {
+			return n, io.ErrNoProgress
+		}
+	}
+	return n, nil
+}
+
+// Find the end of a contiguous run of blocks that share the same state
+func (o *Overlay) run(start, end int64) (stop int64, dirty bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	block := start / BlockSize
+	dirty = o.isDirty(block)
+	for block++; block*BlockSize < end && o.isDirty(block) == dirty; block++ {
+	}
+	return min(block*BlockSize, end), dirty
+}
+
+func (o *Overlay) WriteAt(p []byte, offset int64) (n int, err error) {
+	o.write.Lock()
+	defer o.write.Unlock()
+	return o.writeAt(p, offset)
+}
+
+func (o *Overlay) writeAt(p []byte, offset int64) (n int, err error) {
+	end := offset + int64(len(p))
+	if offset < 0 || end > o.size {
+		return 0, fmt.Errorf("%w: write %d bytes at offset %d, device size %d", errOutOfBounds, len(p), offset, o.size)
+	}
+	for n < len(p) {
+		cur := offset + int64(n)
+		block := cur / BlockSize
+		if !o.isDirty(block) && !o.covers(block, cur, end) {
+			err = o.writePartial(block, p[n:], cur)
+			if err != nil {
+				return n, err
+			}
+			n += int(min(end, (block+1)*BlockSize) - cur)
+			continue
+		}
+
+		// Write as many blocks as possible in one go
+		last := block
+		for (last+1)*BlockSize < end && (o.isDirty(last+1) || o.covers(last+1, (last+1)*BlockSize, end)) {
+			last++
+		}
+		stop := min(end, (last+1)*BlockSize)
+		done, err := o.file.WriteAt(p[n:stop-offset], cur)
+		if done == int(stop-cur) {
+			o.mark(block, last, true)
+		}
+		n += done
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Check if a write between start and end covers the whole block
+func (o *Overlay) covers(block, start, end int64) bool {
+	return start <= block*BlockSize && end >= min((block+1)*BlockSize, o.size)
+}
+
+// Merge partial block write with data from base image
+func (o *Overlay) writePartial(block int64, p []byte, offset int64) error {
+	start := block * BlockSize
+	buf := make([]byte, min(BlockSize, o.size-start))
+	err := readFull(o.base, buf, start)
+	if err != nil {
+		return fmt.Errorf("reading block %d from base image: %w", block, err)
+	}
+	copy(buf[offset-start:], p)
+	_, err = o.file.WriteAt(buf, start)
+	if err != nil {
+		return err
+	}
+	o.mark(block, block, true)
+	return nil
+}
+
+// Commit all written data to stable storage
+func (o *Overlay) Flush() error {
+	return o.file.Sync()
+}
+
+// Discard modifications in the given byte range.
+//
+// Only whole blocks are discarded, affected blocks revert to the contents
+// of base image.
+func (o *Overlay) Trim(offset, length int64) error {
+	o.write.Lock()
+	defer o.write.Unlock()
+
+	first, last, ok := o.inner(offset, length)
+	if !ok {
+		return nil
+	}
+	o.mark(first, last, false)
+	err := o.punchHole(first, last)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil // trimmed blocks are not read from overlay file anyway
+	}
+	return err
+}
+
+// Write zeroes to the given byte range.
+//
+// Whole blocks are deallocated from overlay file unless noHole is set.
+func (o *Overlay) WriteZeroes(offset, length int64, noHole bool) error {
+	o.write.Lock()
+	defer o.write.Unlock()
+
+	if offset < 0 || length < 0 || offset+length > o.size {
+		return fmt.Errorf("%w: write %d zeroes at offset %d, device size %d", errOutOfBounds, length, offset, o.size)
+	}
+	first, last, ok := o.inner(offset, length)
+	if noHole || !ok {
+		return o.writeZeroes(offset, offset+length)
+	}
+	err := o.writeZeroes(offset, first*BlockSize)
+	if err != nil {
+		return err
+	}
+	err = o.punchHole(first, last)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		err = o.writeZeroes(first*BlockSize, min((last+1)*BlockSize, o.size))
+	}
+	if err != nil {
+		return err
+	}
+	o.mark(first, last, true)
+	return o.writeZeroes(min((last+1)*BlockSize, o.size), offset+length)
+}
+
+func (o *Overlay) writeZeroes(start, end int64) error {
+	for start < end {
+		n, err := o.writeAt(zeroes[:min(int64(len(zeroes)), end-start)], start)
+		start += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var zeroes [64 << 10]byte
+
+// Find the whole blocks within the given byte range
+func (o *Overlay) inner(offset, length int64) (first, last int64, ok bool) {
+	end := min(offset+length, o.size)
+	first = (offset + BlockSize - 1) / BlockSize
+	last = end/BlockSize - 1
+	if end == o.size {
+		last = (end+BlockSize-1)/BlockSize - 1
+	}
+	return first, last, offset >= 0 && first <= last
+}
+
+// Deallocate overlay file blocks
+func (o *Overlay) punchHole(first, last int64) error {
+	const (
+		FALLOC_FL_KEEP_SIZE  = 0x01
+		FALLOC_FL_PUNCH_HOLE = 0x02
+	)
+	sys, err := o.file.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("open syscall connection: %s: %w", o.file.Name(), err)
+	}
+	var punchErr error
+	err = sys.Control(func(fd uintptr) {
+		start := first * BlockSize
+		end := min((last+1)*BlockSize, o.size)
+		punchErr = syscall.Fallocate(int(fd), FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE, start, end-start)
+	})
+	if err != nil {
+		return fmt.Errorf("syscall connection: %s: %w", o.file.Name(), err)
+	}
+	if punchErr != nil {
+		return fmt.Errorf("punch hole: %s: %w", o.file.Name(), punchErr)
+	}
+	return nil
+}
+
+// Bitmap is only modified by writers, they can check it without locking
+func (o *Overlay) isDirty(block int64) bool {
+	return o.dirty[block/64]&(1<<(block%64)) != 0
+}
+
+func (o *Overlay) mark(first, last int64, dirty bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for block := first; block <= last; block++ {
+		if dirty {
+			o.dirty[block/64] |= 1 << (block % 64)
+		} else {
+			o.dirty[block/64] &^= 1 << (block % 64)
+		}
+	}
+}
+
+// Like io.ReadFull, but for io.ReaderAt that may return short reads
+func readFull(r io.ReaderAt, p []byte, offset int64) error {
+	var n int
+	for n < len(p) {
+		done, err := r.ReadAt(p[n:], offset+int64(n))
+		n += done
+		if errors.Is(err, io.EOF) && n == len(p) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if done == 0 {
+			return io.ErrNoProgress
+		}
+	}
+	return nil
+}
+
+var errOutOfBounds = errors.New("out of bounds")
@@ -0,0 +1,130 @@
+package overlay
+
+import (
+	"testing"
+
+	"bytes"
+	"io"
+	"math/rand"
+	"path/filepath"
+)
+
+func TestOverlay(t *testing.T) {
+	const size = 10*BlockSize + 123
+
+	original := make([]byte, size)
+	_, _ = rand.New(rand.NewSource(42)).Read(original)
+	base := &shortReader{bytes.NewReader(original)}
+
+	overlay, err := Open(filepath.Join(t.TempDir(), "overlay"), base)
+	if err != nil {
+		t.Fatalf("open overlay: %v", err)
+	}
+	t.Cleanup(func() {
+		err := overlay.Close()
+		if err != nil {
+			t.Fatalf("close overlay: %v", err)
+		}
+	})
+
+	// Expected state of the overlay device
+	model := bytes.Clone(original)
+
+	check := func(step string) {
+		t.Helper()
+		got := make([]byte, size)
+		n, err := overlay.ReadAt(got, 0)
+		if err != nil {
+			t.Fatalf("%s: read: %v", step, err)
+		}
+		if n != size {
+			t.Fatalf("%s: short read: %d bytes", step, n)
+		}
+		if !bytes.Equal(got, model) {
+			for i := range got {
+				if got[i] != model[i] {
+					t.Fatalf("%s: data mismatch at offset %d", step, i)
+				}
+			}
+		}
+	}
+	write := func(offset int64, length int) {
+		t.Helper()
+		p := make([]byte, length)
+		_, _ = rand.Read(p)
+		n, err := overlay.WriteAt(p, offset)
+		if err != nil || n != length {
+			t.Fatalf("write %d bytes at %d: n=%d, err=%v", length, offset, n, err)
+		}
+		copy(model[offset:], p)
+	}
+
+	check("pristine")
+
+	write(10, 20)
+	check("partial block")
+
+	write(BlockSize-1, 2*BlockSize+2)
+	check("unaligned multiple blocks")
+
+	write(5*BlockSize, BlockSize)
+	check("aligned block")
+
+	write(size-100, 100)
+	check("tail")
+
+	err = overlay.Trim(0, 3*BlockSize+1)
+	if err != nil {
+		t.Fatalf("trim: %v", err)
+	}
+	copy(model[:3*BlockSize], original)
+	check("trim")
+
+	err = overlay.WriteZeroes(BlockSize+7, 3*BlockSize, false)
+	if err != nil {
+		t.Fatalf("write zeroes: %v", err)
+	}
+	clear(model[BlockSize+7 : 4*BlockSize+7])
+	check("write zeroes")
+
+	err = overlay.WriteZeroes(size-BlockSize-10, BlockSize+10, true)
+	if err != nil {
+		t.Fatalf("write zeroes (no hole): %v", err)
+	}
+	clear(model[size-BlockSize-10:])
+	check("write zeroes without holes")
+
+	err = overlay.Trim(0, size)
+	if err != nil {
+		t.Fatalf("trim everything: %v", err)
+	}
+	model = bytes.Clone(original)
+	check("trim everything")
+
+	err = overlay.Flush()
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	_, err = overlay.WriteAt(make([]byte, 10), size-5)
+	if err == nil {
+		t.Fatalf("out of bounds write did not fail")
+	}
+	n, err := overlay.ReadAt(make([]byte, 10), size-5)
+	if n != 5 || err != io.EOF {
+		t.Fatalf("read past the end: n=%d, err=%v", n, err)
+	}
+}
+
+// Base image that returns short reads like s3.Cache does
+type shortReader struct {
+	*bytes.Reader
+}
+
+func (r *shortReader) ReadAt(p []byte, offset int64) (int, error) {
+	const limit = 1000
+	if len(p) > limit {
+		p = p[:limit]
+	}
+	return r.Reader.ReadAt(p, offset)
+}
@@ -0,0 +1,119 @@
+package peer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/sio/pond/nbd/logger"
+)
+
+const (
+	// How often each daemon announces itself
+	announceInterval = 30 * time.Second
+
+	// Peers that were not heard from for this long are forgotten
+	announceExpiry = 3 * announceInterval
+)
+
+// Multicast announcement of a daemon that serves chunks to peers
+type announcement struct {
+	Service  string // always "pond-nbd"
+	Instance string // random identifier to ignore our own announcements
+	Port     int    // TCP port of peer endpoint on the sender's address
+}
+
+const serviceName = "pond-nbd"
+
+// Announce ourselves to the multicast group and add announced peers to client
+// until context is cancelled.
+//
+// Port is the TCP port our peer endpoint is listening on.
+func Discover(ctx context.Context, group string, port int, client *Client) error {
+	var nonce [8]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return err
+	}
+	self := announcement{
+		Service:  serviceName,
+		Instance: hex.EncodeToString(nonce[:]),
+		Port:     port,
+	}
+	message, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return fmt.Errorf("peer discovery: %w", err)
+	}
+	if !addr.IP.IsMulticast() {
+		return fmt.Errorf("peer discovery: not a multicast address: %s", group)
+	}
+	listener, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		return fmt.Errorf("peer discovery: %w", err)
+	}
+	sender, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("peer discovery: %w", err)
+	}
+	log := logger.FromContext(ctx)
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+		_ = sender.Close()
+	}()
+	go func() {
+		ticker := time.NewTicker(announceInterval)
+		defer ticker.Stop()
+		for {
+			_, err := sender.Write(message)
+			if err != nil && ctx.Err() == nil {
+				log.Warn("peer announcement failed", "group", group, "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, source, err := listener.ReadFromUDP(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error("peer discovery stopped", "group", group, "error", err)
+				}
+				return
+			}
+			address, ok := self.parse(buf[:n], source)
+			if ok {
+				client.Add(address, time.Now().Add(announceExpiry))
+			}
+		}
+	}()
+	return nil
+}
+
+// Extract peer address from announcement, ignore our own ones and garbage
+func (self announcement) parse(message []byte, source *net.UDPAddr) (address string, ok bool) {
+	var peer announcement
+	err := json.Unmarshal(message, &peer)
+	if err != nil || peer.Service != serviceName || peer.Instance == self.Instance {
+		return "", false
+	}
+	if peer.Port <= 0 || peer.Port > 65535 {
+		return "", false
+	}
+	return net.JoinHostPort(source.IP.String(), strconv.Itoa(peer.Port)), true
+}
@@ -0,0 +1,147 @@
+// Chunk sharing between NBD daemons on the same network.
+//
+// Daemons serve chunks from their local caches to each other over HTTPS with
+// mutual TLS authentication based on SSH keys (see certs.PKI). Peers are
+// found via UDP multicast announcements (see Discover) or configured
+// statically.
+//
+// Announcements are merely hints: peers are trusted by their keys only.
+// Authenticated peers are not trusted with data either: every chunk received
+// from a peer is verified against verity hash tree by s3.Cache before it is
+// used.
+package peer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sio/pond/nbd/s3"
+)
+
+const (
+	// Chunks are requested from this many peers at most before falling back
+	// to remote storage
+	maxAttempts = 3
+
+	// Peers are expected to be on the same LAN: slow ones are no better
+	// than remote storage
+	requestTimeout = 30 * time.Second
+
+	// URL path prefix for chunk requests
+	chunkPath = "/v1/chunk/"
+)
+
+// Peer client: fetches chunks from other daemons
+type Client struct {
+	http   *http.Client
+	static []string
+
+	mu         sync.Mutex
+	discovered map[string]time.Time // address -> expiration time
+}
+
+// Initialize peer client with TLS configuration for authenticating peers
+// (see certs.PKI.ClientConfig) and a list of static peer addresses (host:port)
+func NewClient(config *tls.Config, static ...string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:     config,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     time.Minute,
+			},
+			Timeout: requestTimeout,
+		},
+		static:     static,
+		discovered: make(map[string]time.Time),
+	}
+}
+
+// Remember peer address until expiration time
+func (c *Client) Add(address string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.discovered[address] = expires
+}
+
+// Currently known peer addresses
+func (c *Client) Peers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	peers := make([]string, 0, len(c.static)+len(c.discovered))
+	peers = append(peers, c.static...)
+	now := time.Now()
+	for address, expires := range c.discovered {
+		if now.After(expires) {
+			delete(c.discovered, address)
+			continue
+		}
+		peers = append(peers, address)
+	}
+	return peers
+}
+
+// Fetch byte range of the object from any peer that has it cached
+func (c *Client) Fetch(ctx context.Context, id s3.ObjectID, offset int64, size int) ([]byte, error) {
+	peers := c.Peers()
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers")
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	var err error
+	for _, address := range peers[:min(len(peers), maxAttempts)] {
+		var data []byte
+		data, err = c.fetch(ctx, address, id, offset, size)
+		if err == nil {
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (c *Client) fetch(ctx context.Context, address string, id s3.ObjectID, offset int64, size int) ([]byte, error) {
+	location := url.URL{
+		Scheme: "https",
+		Host:   address,
+		Path:   chunkPath + id.String(),
+		RawQuery: url.Values{
+			"offset": []string{strconv.FormatInt(offset, 10)},
+			"size":   []string{strconv.Itoa(size)},
+		}.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", address, resp.Status)
+	}
+	if resp.ContentLength != int64(size) {
+		return nil, fmt.Errorf("%s: unexpected content length: %d", address, resp.ContentLength)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(resp.Body, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", address, err)
+	}
+	return data, nil
+}
+
+var _ s3.Peers = new(Client)
@@ -0,0 +1,120 @@
+package peer
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sio/pond/nbd/certs"
+	"github.com/sio/pond/nbd/s3"
+)
+
+type memorySource struct {
+	data   []byte
+	cached int64 // bytes available from the start of data
+}
+
+func (s *memorySource) ReadCached(p []byte, offset int64) (int, error) {
+	if offset >= s.cached {
+		return 0, s3.ErrNotCached
+	}
+	return copy(p, s.data[offset:s.cached]), nil
+}
+
+func (s *memorySource) Size() int64 {
+	return int64(len(s.data))
+}
+
+func pki(t *testing.T, key, trusted string) *certs.PKI {
+	t.Helper()
+	private, err := certs.PrivateKey("../certs/testkeys/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := certs.AuthorizedKeys("../certs/testkeys/" + trusted + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs.NewPKI(private, public...)
+}
+
+func TestPeerExchange(t *testing.T) {
+	var id s3.ObjectID
+	id[0] = 42
+	source := &memorySource{data: bytes.Repeat([]byte("pond"), 100<<10), cached: 200 << 10}
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := &http.Server{Handler: Handler(func(want s3.ObjectID) Source {
+		if want != id {
+			return nil
+		}
+		return source
+	})}
+	go func() { _ = web.Serve(tls.NewListener(socket, pki(t, "bob", "alice").ServerConfig())) }()
+	t.Cleanup(func() { _ = web.Close() })
+
+	ctx := context.Background()
+	client := NewClient(pki(t, "alice", "bob").ClientConfig())
+	_, err = client.Fetch(ctx, id, 0, 10)
+	if err == nil {
+		t.Errorf("fetched without any peers")
+	}
+	client.Add(socket.Addr().String(), time.Now().Add(time.Minute))
+	client.Add("127.0.0.1:1", time.Now().Add(-time.Minute)) // expired
+	if peers := client.Peers(); len(peers) != 1 {
+		t.Errorf("expired peers were not removed: %v", peers)
+	}
+
+	data, err := client.Fetch(ctx, id, 100, 150<<10)
+	if err != nil || !bytes.Equal(data, source.data[100:100+150<<10]) {
+		t.Errorf("fetching cached range: %v", err)
+	}
+	for _, tt := range []struct {
+		name   string
+		id     s3.ObjectID
+		offset int64
+		size   int
+	}{
+		{"not cached", id, 100 << 10, 200 << 10},
+		{"unknown object", s3.ObjectID{}, 0, 10},
+		{"out of bounds", id, 0, 1 << 20},
+	} {
+		_, err = client.Fetch(ctx, tt.id, tt.offset, tt.size)
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+
+	stranger := NewClient(pki(t, "bob", "bob").ClientConfig(), socket.Addr().String())
+	_, err = stranger.Fetch(ctx, id, 0, 10)
+	if err == nil {
+		t.Errorf("untrusted peer was allowed to fetch data")
+	}
+}
+
+func TestAnnouncement(t *testing.T) {
+	self := announcement{Service: serviceName, Instance: "self", Port: 1234}
+	source := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 5555}
+	for _, tt := range []struct {
+		message string
+		address string
+	}{
+		{`{"Service":"pond-nbd","Instance":"other","Port":10810}`, "192.168.1.10:10810"},
+		{`{"Service":"pond-nbd","Instance":"self","Port":1234}`, ""},
+		{`{"Service":"something","Instance":"other","Port":10810}`, ""},
+		{`{"Service":"pond-nbd","Instance":"other","Port":70000}`, ""},
+		{`garbage`, ""},
+	} {
+		address, ok := self.parse([]byte(tt.message), source)
+		if address != tt.address || ok != (tt.address != "") {
+			t.Errorf("%s: got %q (%v), want %q", tt.message, address, ok, tt.address)
+		}
+	}
+}
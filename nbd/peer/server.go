@@ -0,0 +1,97 @@
+package peer
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sio/pond/nbd/buffer"
+	"github.com/sio/pond/nbd/logger"
+	"github.com/sio/pond/nbd/s3"
+)
+
+// Cached object that may be shared with peers (see s3.Cache.ReadCached)
+type Source interface {
+	ReadCached(p []byte, offset int64) (int, error)
+	Size() int64
+}
+
+// Find cached object by its identifier, nil if it is not open
+type Lookup func(id s3.ObjectID) Source
+
+// Largest byte range that may be requested at once
+const maxRequestSize = 1 << 30
+
+// HTTP handler that serves chunks from local cache to peers.
+//
+// Handler does not authenticate peers, it must be served over TLS with
+// client certificates required (see certs.PKI.ServerConfig).
+func Handler(lookup Lookup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name, found := strings.CutPrefix(r.URL.Path, chunkPath)
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := s3.ParseObjectID(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		if err != nil || size <= 0 || size > maxRequestSize {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+		source := lookup(id)
+		if source == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if offset+size > source.Size() {
+			http.Error(w, "requested range is out of bounds", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		buf := buffer.Get()
+		defer buffer.Put(buf)
+		buf = buf[:cap(buf)]
+		var sent int64
+		for sent < size {
+			n, err := source.ReadCached(buf[:min(int64(len(buf)), size-sent)], offset+sent)
+			if errors.Is(err, s3.ErrNotCached) && sent == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil || n == 0 {
+				if sent == 0 {
+					http.Error(w, "reading from local cache failed", http.StatusInternalServerError)
+					return
+				}
+				log := logger.FromContext(r.Context())
+				log.Warn("serving chunk to peer interrupted", "object", id, "offset", offset, "sent", sent, "error", err)
+				panic(http.ErrAbortHandler) // peer will notice short response
+			}
+			if sent == 0 {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+				w.WriteHeader(http.StatusOK)
+			}
+			_, err = w.Write(buf[:n])
+			if err != nil {
+				return // peer has disconnected
+			}
+			sent += int64(n)
+		}
+	})
+}
@@ -1,12 +1,20 @@
-// Read cache for S3 objects that are assumed to be immutable
+// Read cache for remote objects that are expected to be immutable.
+//
+// Modifications are detected by comparing object revision (ETag, version ID,
+// modification time) with the one that was recorded in chunk map: outdated
+// cache is dropped when opening and ErrChanged is returned if object changes
+// while cache is open.
 package s3
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand/v2"
+	"net/url"
+	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
@@ -23,13 +31,40 @@ type Cache struct {
 
 	// Local backend for cached object
 	local localInterface
+	mode  Mode
+	path  string // empty unless mode is ModeFile
 
 	// Chunk availability map
 	chunk *chunkMap
 
+	// Readahead window limit in bytes, see Readahead
+	readaheadLimit int64
+
+	// Boot trace recorder (optional)
+	trace *bootTrace
+
+	// Other daemons sharing their cached chunks (optional)
+	peers Peers
+	id    ObjectID
+
+	// Verity hash tree, nil until loaded (or if there is none)
+	verity atomic.Pointer[verity.Verity]
+	strict strictMode
+
+	// Expected root hash of verity tree (optional)
+	rootHash []byte
+
+	// Verity hash tree location
+	layout verity.Layout
+	hashes *Cache // separate object with hash tree (optional)
+
 	// Network connection limiter
 	queue *Queue
 
+	// Chunks scheduled by Prefetch, see startPrefetch
+	prefetch     chan chunk
+	prefetchOnce sync.Once
+
 	// Top level context
 	ctx    context.Context
 	cancel context.CancelCauseFunc
@@ -37,28 +72,226 @@ type Cache struct {
 	// Time of the last cache miss
 	atime atomic.Value
 
+	// Time of the last read (unix nanoseconds)
+	accessed atomic.Int64
+
 	// Keep track of spawned goroutines
 	goro *sync.WaitGroup
+
+	// Usage statistics
+	stats cacheStats
 }
 
+// Open read cache for the latest version of S3 object
 func Open(endpoint, access, secret, bucket, object, localdir string) (c *Cache, err error) {
+	return OpenVersion(endpoint, access, secret, bucket, object, "", localdir)
+}
+
+// Open read cache for a specific version of S3 object
+// (empty version refers to the latest one)
+func OpenVersion(endpoint, access, secret, bucket, object, version, localdir string) (c *Cache, err error) {
+	return OpenWithOptions(endpoint, access, secret, bucket, object, version, localdir, Options{})
+}
+
+// Optional cache settings, zero value means defaults
+type Options struct {
+	// Called before allocating local storage for the object of the given
+	// size (see LocalObject for path semantics). Returning an error aborts
+	// opening the cache.
+	// Only ModeFile uses local directory.
+	Reserve func(path string, size int64) error
+
+	// Where cached data is kept
+	Mode Mode
+
+	// Memory limit for ModeMemory in bytes (a reasonable default is used
+	// if zero)
+	MemoryLimit int64
+
+	// Size of remote range requests, see CheckChunkSize (8MB if zero).
+	// Changing chunk size keeps the chunks that are fully covered by
+	// already cached data.
+	ChunkSize int64
+
+	// Readahead window limit for sequential streams in bytes (64MB if zero,
+	// negative value disables readahead). Readahead is always disabled for
+	// ModePassThrough.
+	Readahead int64
+
+	// Record boot trace for the given time after the first read and replay
+	// it next time cache is opened (disabled if zero). Only ModeFile keeps
+	// boot traces.
+	BootTrace time.Duration
+
+	// Fetch chunks from other daemons before falling back to remote storage.
+	// Only objects with verity hash tree are fetched from peers.
+	Peers Peers
+
+	// Verify each fetched chunk against verity hash tree before serving it,
+	// fetch it again if verification fails. Verity hash tree is loaded when
+	// opening the cache, objects without one are served without verification.
+	Strict bool
+
+	// Verify the whole verity hash tree up to this root hash instead of
+	// checking leaf hashes only. Implies Strict, opening the cache fails if
+	// the object has no hash tree matching the root hash.
+	RootHash []byte
+
+	// Separate object with verity hash tree in the same bucket (optional),
+	// e.g. the one created by `veritysetup format DATA HASHES`. Hash tree is
+	// looked up in the data object if hash object is not available.
+	HashObject string
+
+	// Location of verity hash tree within hash object (or data object if
+	// there is no separate one), zero value means autodetection
+	Verity verity.Layout
+}
+
+// Open read cache for a specific version of S3 object with custom options
+func OpenWithOptions(endpoint, access, secret, bucket, object, version, localdir string, opt Options) (c *Cache, err error) {
 	c = new(Cache)
 	c.ctx, c.cancel = context.WithCancelCause(context.TODO())
 	c.ctx, _ = logger.With(c.ctx, "s3", fmt.Sprintf("%s/%s/%s", endpoint, bucket, object))
+	local := filepath.Join(localdir, object)
+	if version != "" {
+		c.ctx, _ = logger.With(c.ctx, "version", version)
+		local += "?version=" + url.QueryEscape(version)
+	}
 	c.goro = new(sync.WaitGroup)
 	c.queue = NewQueue(c.ctx, connLimitPerObject)
 	c.atime.Store(time.Now())
-	c.remote, err = openMinioRemote(endpoint, access, secret, bucket, object)
+	c.accessed.Store(time.Now().UnixNano())
+	defer func(c *Cache) {
+		if err == nil {
+			return
+		}
+		c.cancel(err)
+		c.goro.Wait() // fetches started while loading verity hash tree
+		for _, component := range []io.Closer{c.remote, c.local, c.queue} {
+			if component != nil {
+				_ = component.Close()
+			}
+		}
+		if c.chunk != nil {
+			_ = c.chunk.Close()
+		}
+		if c.hashes != nil {
+			_ = c.hashes.Close()
+		}
+	}(c) // named result is nil on error
+	c.remote, err = openRemote(endpoint, access, secret, bucket, object, version)
 	if err != nil {
 		return nil, fmt.Errorf("open remote: %w", err)
 	}
-	c.local, err = openFileBackend(filepath.Join(localdir, object), c.remote.Size())
-	if err != nil {
-		return nil, fmt.Errorf("open local backend: %w", err)
+	chunkSize := opt.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = defaultChunkSize
 	}
-	c.chunk, err = openChunkMap(filepath.Join(localdir, object+".chunk"), c.remote.Size())
+	err = CheckChunkSize(chunkSize)
 	if err != nil {
-		return nil, fmt.Errorf("open chunk map: %w", err)
+		return nil, err
+	}
+	switch opt.Mode {
+	case ModeFile:
+		if opt.Reserve != nil {
+			err = opt.Reserve(local, c.remote.Size())
+			if err != nil {
+				return nil, err
+			}
+		}
+		c.path = local
+		c.local, err = openFileBackend(local, c.remote.Size())
+		if err != nil {
+			return nil, fmt.Errorf("open local backend: %w", err)
+		}
+		c.chunk, err = openChunkMap(local+chunkSuffix, c.remote.Size(), chunkSize, c.remote.Revision())
+		if err != nil {
+			return nil, fmt.Errorf("open chunk map: %w", err)
+		}
+		if c.chunk.Legacy() {
+			err = c.checkLegacy()
+			if err != nil {
+				return nil, fmt.Errorf("check cached data: %w", err)
+			}
+		}
+	case ModeMemory, ModePassThrough:
+		limit := opt.MemoryLimit
+		if limit <= 0 {
+			limit = defaultMemoryLimit
+		}
+		if opt.Mode == ModePassThrough {
+			limit = passThroughChunks * chunkSize
+		}
+		c.chunk = newChunkMap("", c.remote.Size(), chunkSize, c.remote.Revision())
+		c.local = newMemoryBackend(limit, chunkSize, c.chunk.Lost)
+		c.ctx, _ = logger.With(c.ctx, "mode", opt.Mode.String())
+	default:
+		return nil, fmt.Errorf("unsupported cache mode: %v", opt.Mode)
+	}
+	c.mode = opt.Mode
+	if opt.Peers != nil {
+		var ok bool
+		c.id, ok = objectID(object, c.remote.Revision(), c.remote.Size())
+		if ok {
+			c.peers = opt.Peers
+		}
+	}
+	c.readaheadLimit = opt.Readahead
+	if c.readaheadLimit == 0 {
+		c.readaheadLimit = defaultReadahead
+	}
+	if memory, ok := c.local.(*memoryBackend); ok {
+		// Chunks fetched ahead must not evict each other before being read
+		c.readaheadLimit = min(c.readaheadLimit, memory.limit/2)
+	}
+	if c.mode == ModePassThrough {
+		c.readaheadLimit = 0
+	}
+
+	c.layout = opt.Verity
+	if opt.HashObject != "" {
+		// Hash tree is much smaller than data and is read in small pieces
+		c.hashes, err = OpenWithOptions(endpoint, access, secret, bucket, opt.HashObject, "", localdir, Options{
+			Mode:      ModeMemory,
+			ChunkSize: minChunkSize,
+			Readahead: -1,
+		})
+		if err != nil {
+			log := logger.FromContext(c.ctx)
+			log.Warn("verity hash object is not available, looking for hash tree in data object", "hashes", opt.HashObject, "error", err)
+			c.hashes, err = nil, nil
+		}
+	}
+	c.rootHash = opt.RootHash
+	if c.rootHash != nil {
+		// Chunks cached by previous sessions were not necessarily verified
+		// against this root hash
+		c.chunk.Distrust()
+	}
+	if opt.Strict || c.rootHash != nil {
+		c.strict.enabled.Store(true)
+		_, err := c.loadVerity()
+		if err == nil {
+			c.verifyEarlyChunks()
+		} else if c.rootHash != nil {
+			return nil, fmt.Errorf("verity hash tree: %w", err)
+		} else {
+			log := logger.FromContext(c.ctx)
+			log.Warn("strict mode disabled: fetched chunks will not be verified", "error", err)
+			c.strict.enabled.Store(false)
+		}
+	}
+
+	if c.mode != ModeFile {
+		// Warming up the cache or scrubbing it would only evict useful chunks
+		if c.peers != nil {
+			c.goro.Add(1)
+			go func() {
+				defer c.goro.Done()
+				_, _ = c.loadVerity()
+			}()
+		}
+		return c, nil
 	}
 
 	c.goro.Add(1)
@@ -67,6 +300,27 @@ func Open(endpoint, access, secret, bucket, object, localdir string) (c *Cache,
 		c.chunk.AutoSave(c.ctx)
 	}()
 
+	if opt.BootTrace > 0 {
+		order, err := loadTrace(local+traceSuffix, c.chunk)
+		if err != nil {
+			log := logger.FromContext(c.ctx)
+			log.Warn("ignoring boot trace", "error", err)
+		}
+		c.trace = newBootTrace(local+traceSuffix, opt.BootTrace)
+		c.goro.Add(1)
+		go func() {
+			defer c.goro.Done()
+			c.trace.Run(c.ctx, c.chunk)
+		}()
+		if len(order) > 0 {
+			c.goro.Add(1)
+			go func() {
+				defer c.goro.Done()
+				c.replayTrace(order)
+			}()
+		}
+	}
+
 	c.goro.Add(1)
 	go func() {
 		defer c.goro.Done()
@@ -76,7 +330,7 @@ func Open(endpoint, access, secret, bucket, object, localdir string) (c *Cache,
 	c.goro.Add(1)
 	go func() {
 		defer c.goro.Done()
-		checksum, err := verity.Open(c)
+		checksum, err := c.loadVerity()
 		if err != nil {
 			log := logger.FromContext(c.ctx)
 			log.Info("background data integrity validation disabled", "error", err)
@@ -87,15 +341,38 @@ func Open(endpoint, access, secret, bucket, object, localdir string) (c *Cache,
 	return c, nil
 }
 
+// Parse verity hash tree and make it available for verifying chunks
+// received from peers
+func (c *Cache) loadVerity() (verity.Verity, error) {
+	if loaded := c.verity.Load(); loaded != nil {
+		return *loaded, nil
+	}
+	var hashes io.ReaderAt
+	if c.hashes != nil {
+		hashes = c.hashes
+	}
+	checksum, err := verity.OpenLayout(c, hashes, c.layout, c.rootHash)
+	if err != nil {
+		return checksum, err
+	}
+	shared := checksum
+	c.verity.Store(&shared)
+	return checksum, nil
+}
+
 func (c *Cache) Close() error {
 	c.cancel(fmt.Errorf("cache closed"))
 	errs := make([]error, 0)
-	for _, component := range []io.Closer{
+	components := []io.Closer{
 		c.remote,
 		c.local,
 		c.chunk,
 		c.queue,
-	} {
+	}
+	if c.hashes != nil {
+		components = append(components, c.hashes)
+	}
+	for _, component := range components {
 		errs = append(errs, component.Close())
 	}
 	wait, cancel := context.WithDeadline(context.Background(), time.Now().Add(5*time.Second))
@@ -107,48 +384,210 @@ func (c *Cache) Close() error {
 		}
 	}()
 	c.goro.Wait()
+
+	// Last access time is persisted as modification time of local data file
+	// to be used by cache eviction after restart
+	if c.path != "" {
+		accessed := c.LastAccess()
+		err := os.Chtimes(c.path, accessed, accessed)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
 	return errors.Join(errs...)
 }
 
+// Path of local data file (see LocalObject), empty if cached data is not
+// stored on disk
+func (c *Cache) Path() string {
+	return c.path
+}
+
+// Where cached data is kept
+func (c *Cache) Mode() Mode {
+	return c.mode
+}
+
+// Time of the last read from this cache object
+func (c *Cache) LastAccess() time.Time {
+	return time.Unix(0, c.accessed.Load())
+}
+
 func (c *Cache) ReadAt(p []byte, offset int64) (n int, err error) {
 	ctx, cleanup := context.WithDeadline(c.ctx, time.Now().Add(1*time.Minute))
 	defer cleanup()
 	ctx, cancel := context.WithCancelCause(ctx)
 	defer cancel(errNotRelevant)
+	c.accessed.Store(time.Now().UnixNano())
+	if err := context.Cause(c.ctx); err != nil {
+		return 0, err
+	}
 
 	// Schedule relevant chunks to be fetched
-	first := chunk(offset / chunkSize)
-	part := first
-	for remain := int64(len(p)); remain > 0; remain -= chunkSize {
+	first := c.chunk.Chunk(offset)
+	chunkSize := c.chunk.chunkSize
+	schedule := func(part chunk) {
 		c.goro.Add(1)
-		go func(part chunk) {
+		go func() {
 			defer c.goro.Done()
 			err := c.fetch(part, false)
 			if err != nil {
 				cancel(err)
 			}
-		}(part)
+		}()
+	}
+	part := first
+	for remain := int64(len(p)); remain > 0; remain -= chunkSize {
+		schedule(part)
 		part++
 	}
 
-	// Return data from the first relevant chunk
-	ready, _ := c.chunk.Check(first)
-	select {
-	case <-ready:
-		n, err := c.local.ReadAt(p[:min(len(p), chunkSize)], offset)
-		if err != nil && !errors.Is(err, io.EOF) {
-			offset, size := c.chunk.Offset(first)
-			if size != 0 {
-				log := logger.FromContext(ctx)
-				log.Error("reading from local cache", "error", err, "offset", offset, "size", size)
+	// Return data from the first relevant chunk only: the next one may be
+	// not available yet
+	p = p[:min(int64(len(p)), int64(first+1)*chunkSize-offset)]
+	for attempt := 0; ; attempt++ {
+		ready, hit := c.chunk.Check(first)
+		if attempt == 0 && hit {
+			c.stats.hits.Add(1)
+		} else if attempt == 0 {
+			c.stats.misses.Add(1)
+		}
+		select {
+		case <-ready:
+			n, err := c.local.ReadAt(p, offset)
+			if errors.Is(err, errEvicted) && attempt < evictedRetries {
+				// Memory backend dropped the chunk before we could read it
+				c.chunk.Lost(first)
+				schedule(first)
+				continue
+			}
+			if err != nil && !errors.Is(err, io.EOF) {
+				offset, size := c.chunk.Offset(first)
+				if size != 0 {
+					log := logger.FromContext(ctx)
+					log.Error("reading from local cache", "error", err, "offset", offset, "size", size)
+				}
+			}
+			return n, err
+		case <-ctx.Done():
+			return 0, context.Cause(ctx)
+		}
+	}
+}
+
+// How many times ReadAt fetches a chunk again if it gets evicted from memory
+// before being read
+const evictedRetries = 3
+
+// Schedule chunks covering the given byte range to be fetched in background.
+//
+// This is a hint for warming up the cache: it returns immediately and never
+// waits for the data to arrive. Fetch errors are logged and otherwise ignored,
+// affected chunks will be retried on the next read. Chunks that do not fit
+// into prefetch backlog are skipped.
+//
+// Pass-through cache does not keep fetched data, prefetching is a no-op there.
+func (c *Cache) Prefetch(offset, length int64) error {
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("invalid byte range: offset=%d, length=%d", offset, length)
+	}
+	if err := context.Cause(c.ctx); err != nil {
+		return err
+	}
+	if c.mode == ModePassThrough {
+		return nil
+	}
+	c.prefetchOnce.Do(c.startPrefetch)
+	end := min(offset+length, c.Size())
+	for part := c.chunk.Chunk(offset); int64(part)*c.chunk.chunkSize < end; part++ {
+		if c.chunk.Has(part) {
+			continue
+		}
+		select {
+		case c.prefetch <- part:
+		default:
+			return nil // backlog is full
+		}
+	}
+	return nil
+}
+
+const (
+	// Background workers per cache object that serve Prefetch.
+	// Prefetching uses low priority connections, leave some for reads.
+	prefetchWorkers = connLimitPerObject / 4
+
+	// Maximum number of chunks waiting to be prefetched
+	prefetchBacklog = 256
+)
+
+// Start background workers that fetch chunks scheduled by Prefetch
+func (c *Cache) startPrefetch() {
+	c.prefetch = make(chan chunk, prefetchBacklog)
+	for i := 0; i < prefetchWorkers; i++ {
+		c.goro.Add(1)
+		go func() {
+			defer c.goro.Done()
+			for {
+				select {
+				case part := <-c.prefetch:
+					_ = c.fetch(part, true) // errors are logged by fetch()
+				case <-c.ctx.Done():
+					return
+				}
 			}
+		}()
+	}
+}
+
+// Contiguous byte range that is either fully available in local cache or not
+type Extent struct {
+	Length int64
+	Cached bool
+}
+
+// Report which parts of the given byte range are available in local cache
+func (c *Cache) Cached(offset, length int64) []Extent {
+	var extents []Extent
+	end := min(offset+length, c.Size())
+	for cur := max(offset, 0); cur < end; {
+		part := c.chunk.Chunk(cur)
+		start, size := c.chunk.Offset(part)
+		stop := min(start+int64(size), end)
+		cached := c.chunk.Has(part)
+		if last := len(extents) - 1; last >= 0 && extents[last].Cached == cached {
+			extents[last].Length += stop - cur
+		} else {
+			extents = append(extents, Extent{Length: stop - cur, Cached: cached})
 		}
-		return n, err
-	case <-ctx.Done():
-		return 0, context.Cause(ctx)
+		cur = stop
 	}
+	return extents
+}
+
+// Full size of cached object
+func (c *Cache) Size() int64 {
+	return c.remote.Size()
 }
 
+// Human readable description of cached object
+func (c *Cache) Description() string {
+	return c.remote.Description()
+}
+
+// Block size constraints for NBD clients.
+//
+// Any byte range may be read from cache, but reads aligned to buffer size are
+// the most efficient ones
+func (c *Cache) BlockSize() (minimum, preferred, maximum uint32) {
+	return 1, buffer.Size, maxBlockSize
+}
+
+// Reads larger than this are split by NBD server anyway,
+// no need to allow clients to send them.
+// This is also the default maximum block size in NBD protocol spec.
+const maxBlockSize = 32 << 20
+
 // This function intentionally uses a context independent from ReadAt:
 // even if caller was cancelled it is still useful to finish caching the current
 // chunk for future use.
@@ -161,6 +600,9 @@ func (c *Cache) fetch(part chunk, background bool) (err error) {
 	if done {
 		return nil
 	}
+	if c.chunk.Unverified(part) && c.verifyCached(part) {
+		return nil
+	}
 
 	ctx, cancel := context.WithCancelCause(c.ctx)
 	defer cancel(errNotRelevant)
@@ -175,17 +617,56 @@ func (c *Cache) fetch(part chunk, background bool) (err error) {
 		}
 	}()
 
+	// Peers do not occupy remote connections
+	if c.fetchPeer(ctx, part, offset, size) {
+		return nil
+	}
+
+	var data []byte
+	for attempt := 1; ; attempt++ {
+		data, err = c.download(ctx, cancel, part, background)
+		if err != nil {
+			_, done = c.chunk.Check(part)
+			if done {
+				return nil
+			}
+			return err
+		}
+		// Remote connection is released before verification: reading verity
+		// hash tree may require fetching more chunks
+		err = c.verifyFetched(part, data)
+		if err == nil {
+			break
+		}
+		log := logger.FromContext(ctx)
+		log.Error("fetched chunk failed verification", "chunk", part, "attempt", attempt, "error", err)
+		// Hash tree reads fail for good once cache is closed
+		if attempt >= strictRetries || context.Cause(ctx) != nil {
+			return err
+		}
+	}
+	if store, whole := c.local.(chunkStore); whole {
+		store.Store(part, data)
+	}
+	c.chunk.Done(part)
+	return nil
+}
+
+// How many times strict mode fetches a chunk before giving up
+const strictRetries = 3
+
+// Download chunk from remote storage. Data is written to local backend
+// directly unless it accepts only whole chunks: in that case data is returned
+// to the caller.
+func (c *Cache) download(ctx context.Context, cancel context.CancelCauseFunc, part chunk, background bool) (data []byte, err error) {
+	offset, size := c.chunk.Offset(part)
 	if background {
 		err = AcquireLowPriority(ctx, globalConnectionQueue, c.queue)
 	} else {
 		err = Acquire(ctx, globalConnectionQueue, c.queue)
 	}
 	if err != nil {
-		_, done = c.chunk.Check(part)
-		if done {
-			return nil
-		}
-		return err
+		return nil, err
 	}
 	defer Release(c.queue, globalConnectionQueue)
 
@@ -195,7 +676,8 @@ func (c *Cache) fetch(part chunk, background bool) (err error) {
 
 	remote, err := c.remote.Reader(ctx, offset, int64(size))
 	if err != nil {
-		return err
+		c.checkChanged(err)
+		return nil, err
 	}
 	defer func() {
 		err := remote.Close()
@@ -207,7 +689,13 @@ func (c *Cache) fetch(part chunk, background bool) (err error) {
 	buf := buffer.Get()
 	defer buffer.Put(buf)
 
-	n, err := io.CopyBuffer(io.NewOffsetWriter(c.local, offset), remote, buf[:cap(buf)])
+	var dest io.Writer = io.NewOffsetWriter(c.local, offset)
+	_, whole := c.local.(chunkStore)
+	if whole {
+		// Concurrent fetches of the same chunk must not share the buffer
+		dest = &sliceWriter{buf: make([]byte, 0, size)}
+	}
+	n, err := io.CopyBuffer(dest, remote, buf[:cap(buf)])
 	if err == nil && n != int64(size) {
 		err = fmt.Errorf("%w: written %d bytes, want %d bytes", io.ErrShortWrite, n, size)
 	}
@@ -216,12 +704,73 @@ func (c *Cache) fetch(part chunk, background bool) (err error) {
 			log := logger.FromContext(ctx)
 			log.Error("fetching from remote storage to local cache", "error", err, "offset", offset, "size", size)
 		}
+		c.checkChanged(err)
+		return nil, err
+	}
+	c.stats.fetched.Add(uint64(size))
+	if whole {
+		return dest.(*sliceWriter).buf, nil
+	}
+	return nil, nil
+}
+
+// Stop using cache object if remote object was modified: cached data
+// belongs to the previous revision and must not be mixed with the new one.
+// The cache must be reopened to serve the new revision.
+func (c *Cache) checkChanged(err error) {
+	if !errors.Is(err, ErrChanged) || context.Cause(c.ctx) != nil {
+		return
+	}
+	log := logger.FromContext(c.ctx)
+	log.Error("remote object has changed, cache object must be reopened", "error", err)
+	c.cancel(err)
+}
+
+// Chunk map saved by older version does not tell which object revision the
+// cached data belongs to. Compare the first cached chunk with remote object
+// to detect modifications made since then.
+func (c *Cache) checkLegacy() error {
+	part, found := c.chunk.After(-1)
+	if !found {
+		c.chunk.Checked(true)
+		return nil
+	}
+	offset, size := c.chunk.Offset(part)
+	err := Acquire(c.ctx, globalConnectionQueue, c.queue)
+	if err != nil {
 		return err
 	}
-	c.chunk.Done(part)
+	defer Release(c.queue, globalConnectionQueue)
+	remote, err := c.remote.Reader(c.ctx, offset, int64(size))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = remote.Close() }()
+	want := make([]byte, size)
+	_, err = io.ReadFull(remote, want)
+	if err != nil {
+		return err
+	}
+	got := make([]byte, size)
+	_, err = c.local.ReadAt(got, offset)
+	if err != nil {
+		return err
+	}
+	valid := bytes.Equal(got, want)
+	if !valid {
+		log := logger.FromContext(c.ctx)
+		log.Warn("remote object has changed, dropping cache", "chunk", part)
+	}
+	c.chunk.Checked(valid)
 	return nil
 }
 
+// Error that made cache object unusable (e.g. ErrChanged), nil if cache
+// object is healthy
+func (c *Cache) Err() error {
+	return context.Cause(c.ctx)
+}
+
 // Fetch all data from remote to local storage (warm up the cache)
 func (c *Cache) bgFetchAll() {
 	const (
@@ -233,7 +782,7 @@ func (c *Cache) bgFetchAll() {
 	)
 	var retry int
 	var part chunk
-	for uint64(part)*chunkSize < c.chunk.size {
+	for uint64(part)*uint64(c.chunk.chunkSize) < c.chunk.size {
 		select {
 		case <-c.ctx.Done():
 			return
@@ -276,9 +825,11 @@ func (c *Cache) bgIntegrity(checksum verity.Verity) {
 		}
 		offset, size := c.chunk.Offset(part)
 		err := checksum.Verify(c, offset, size)
+		c.stats.verified.Add(1)
 		if err != nil {
 			log.Error("integrity verification failed", "chunk", part, "error", err)
 			c.chunk.Lost(part)
+			c.stats.corrupted.Add(1)
 		}
 		var ok bool
 		part, ok = c.chunk.After(part)
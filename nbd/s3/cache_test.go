@@ -60,7 +60,7 @@ func TestWithMinio(t *testing.T) {
 			if err != nil {
 				t.Fatalf("stat: %v", err)
 			}
-			if stat.Size() > chunkSize {
+			if stat.Size() > defaultChunkSize {
 				seen |= seenLargeFile
 			} else {
 				seen |= seenSmallFile
@@ -80,7 +80,7 @@ func TestWithMinio(t *testing.T) {
 					continue
 				}
 				t.Run(fmt.Sprintf("@%s+%s", filesize(tt.offset), filesize(tt.size)), func(t *testing.T) {
-					if tt.size > chunkSize {
+					if tt.size > defaultChunkSize {
 						seen |= seenLargeChunk
 					} else {
 						seen |= seenSmallChunk
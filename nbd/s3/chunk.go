@@ -2,10 +2,12 @@ package s3
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math/big"
+	"math/bits"
 	"os"
 	"path/filepath"
 	"sync"
@@ -15,36 +17,56 @@ import (
 )
 
 const (
-	// Target network speed is 100Mbps.
+	// Default chunk size targets network speed of 100Mbps.
 	//
 	// TLS handshake takes around 500ms (at least 3 network roundtrips plus crypto),
 	// that translates into 100/8*0.500 = 6.25MB transfer (lost opportunity).
-	// We need to amortize this overhead.
+	// We need to amortize this overhead. Faster links benefit from larger
+	// chunks, slower links and random access patterns from smaller ones
+	// (see Options.ChunkSize).
 	//
 	// Amazon recommends to use 8..16MB for S3 range requests:
 	// https://docs.aws.amazon.com/whitepapers/latest/s3-optimizing-performance-best-practices/use-byte-range-fetches.html
 	//
 	// TODO: does minio.Client maintain a connection pool for HTTP requests?
-	chunkSize    = 8 << 20
-	chunkVersion = "ChunkMapV02" // always change this when chunkSize is changed
+	defaultChunkSize = 8 << 20
+	minChunkSize     = 1 << 20
+	maxChunkSize     = 1 << 30
+
+	chunkVersion = "ChunkMapV03" // always change this when header format is changed
+
+	// Previous header format without remote object revision
+	chunkVersionV02 = "ChunkMapV02"
 )
 
+// Check that chunk size is supported: a power of two between 1MB and 1GB
+func CheckChunkSize(size int64) error {
+	if size < minChunkSize || size > maxChunkSize || size&(size-1) != 0 {
+		return fmt.Errorf("invalid chunk size: %d (must be a power of two between %d and %d)", size, minChunkSize, maxChunkSize)
+	}
+	return nil
+}
+
 type chunk int
 
 type chunkMap struct {
-	path string
-	size uint64
-
-	bitmap    *big.Int
-	bitmapMu  sync.RWMutex
-	running   map[chunk]chan struct{}
-	runningMu sync.Mutex
-	modified  time.Time
-	saved     time.Time
+	path      string
+	size      uint64
+	chunkSize int64
+	revision  [sha256.Size]byte // remote object contents identifier, see remoteInterface
+	legacy    bool              // saved revision is unknown until checked, see Checked
+
+	bitmap     *big.Int
+	unverified *big.Int // cached chunks that are not trusted until verified, see Distrust
+	bitmapMu   sync.RWMutex
+	running    map[chunk]chan struct{}
+	runningMu  sync.Mutex
+	modified   time.Time
+	saved      time.Time
 }
 
 func (m *chunkMap) Offset(c chunk) (offset int64, size int) {
-	size = chunkSize
+	size = int(m.chunkSize)
 	offset = int64(size) * int64(c)
 	total := int64(m.size)
 	if offset > total || offset < 0 {
@@ -56,7 +78,30 @@ func (m *chunkMap) Offset(c chunk) (offset int64, size int) {
 	return offset, size
 }
 
-func openChunkMap(path string, size int64) (*chunkMap, error) {
+// Chunk containing the given byte offset
+func (m *chunkMap) Chunk(offset int64) chunk {
+	return chunk(offset / m.chunkSize)
+}
+
+// Chunk map without any chunks done.
+// Empty path means that chunk map is never saved to disk.
+func newChunkMap(path string, size, chunkSize int64, revision string) *chunkMap {
+	return &chunkMap{
+		path:       path,
+		size:       uint64(size),
+		chunkSize:  chunkSize,
+		revision:   sha256.Sum256([]byte(revision)),
+		bitmap:     new(big.Int),
+		unverified: new(big.Int),
+		running:    make(map[chunk]chan struct{}),
+	}
+}
+
+// Load chunk map from disk. Saved chunks are discarded if remote object
+// size or revision do not match, chunk map saved with another chunk size
+// is converted (see migrateBitmap). Chunk maps saved before object revision
+// was recorded are loaded as legacy ones and must be checked by the caller.
+func openChunkMap(path string, size, chunkSize int64, revision string) (*chunkMap, error) {
 	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, err
@@ -67,17 +112,13 @@ func openChunkMap(path string, size int64) (*chunkMap, error) {
 		return nil, fmt.Errorf("stat: %w", err)
 	}
 
-	c := &chunkMap{
-		path:    path,
-		size:    uint64(size),
-		bitmap:  new(big.Int),
-		running: make(map[chunk]chan struct{}),
-	}
-
+	c := newChunkMap(path, size, chunkSize, revision)
 	log := logger.FromContext(context.TODO()).With("path", path)
 
+	// Header layout depends on version, the rest of the header is parsed
+	// only for compatible versions
 	var header chunkMapExportHeader
-	err = binary.Read(file, binary.BigEndian, &header)
+	err = binary.Read(file, binary.BigEndian, &header.Version)
 	if err != nil {
 		if stat.Size() == 0 {
 			return c, nil
@@ -89,31 +130,103 @@ func openChunkMap(path string, size int64) (*chunkMap, error) {
 	if len(version) < prefixLen || version[:prefixLen] != chunkVersion[:prefixLen] {
 		return nil, fmt.Errorf("invalid chunk map version: %s", version)
 	}
-	if version[:len(chunkVersion)] != chunkVersion {
+	fields := []any{&header.ChunkSize, &header.TotalSize, &header.Revision}
+	switch {
+	case version[:len(chunkVersion)] == chunkVersion:
+	case version[:len(chunkVersionV02)] == chunkVersionV02:
+		// Older format did not record remote object revision: cached data
+		// is kept until it is checked against remote object (see Checked)
+		fields = fields[:2]
+		c.legacy = true
+	default:
 		// If we receive chunk map with incompatible header, act as if we have
 		// no cached data at all
 		log.Warn("chunk map version incompatible, dropping cache", "version", version)
-		return c, nil // TODO: add backward compaitibility with previous chunkMap formats
+		return c, nil
 	}
-	if header.ChunkSize != chunkSize || header.TotalSize != c.size {
+	headerSize := int64(binary.Size(header.Version))
+	for _, field := range fields {
+		err = binary.Read(file, binary.BigEndian, field)
+		if err != nil {
+			return nil, fmt.Errorf("chunk map header: %w", err)
+		}
+		headerSize += int64(binary.Size(field))
+	}
+	if CheckChunkSize(int64(header.ChunkSize)) != nil || header.TotalSize != c.size {
 		// Drop cache on any irregularities
 		log.Warn("chunk map size validation failed, dropping cache", "chunk_size", header.ChunkSize, "total_size", header.TotalSize)
+		c.legacy = false
+		return c, nil
+	}
+	if !c.legacy && header.Revision != c.revision {
+		log.Warn("remote object has changed, dropping cache")
 		return c, nil
 	}
 	const safeChunkByteCeiling = (10 << 20) / 8 // (10<<20) of (1<<20) chunks == 10TB of data, we'll never encounter that much
-	chunkByteCount := stat.Size() - int64(binary.Size(header))
-	if chunkByteCount > int64(size/chunkSize)/8+1 || chunkByteCount > safeChunkByteCeiling {
-		return nil, fmt.Errorf("chunk map too large: %dMB (%d bytes)", stat.Size()<<20, stat.Size())
+	chunkByteCount := stat.Size() - headerSize
+	if chunkByteCount > size/int64(header.ChunkSize)/8+1 || chunkByteCount > safeChunkByteCeiling {
+		return nil, fmt.Errorf("chunk map too large: %dMB (%d bytes)", stat.Size()>>20, stat.Size())
 	}
 	raw, err := io.ReadAll(file)
 	if err != nil {
 		return nil, fmt.Errorf("reading chunk map: %w", err)
 	}
 	c.bitmap.SetBytes(raw)
+	if int64(header.ChunkSize) != chunkSize {
+		log.Info("converting chunk map to new chunk size", "from", header.ChunkSize, "to", chunkSize)
+		c.bitmap = migrateBitmap(c.bitmap, int64(header.ChunkSize), chunkSize, size)
+		c.modified = time.Now()
+		return c, nil
+	}
+	if c.legacy {
+		log.Info("chunk map does not record remote object revision, cached data will be checked", "version", version)
+		return c, nil
+	}
 	c.saved = time.Now()
 	return c, nil
 }
 
+// Whether saved chunks need to be checked against remote object: chunk map
+// was saved by an older version that did not record object revision
+func (m *chunkMap) Legacy() bool {
+	m.bitmapMu.RLock()
+	defer m.bitmapMu.RUnlock()
+	return m.legacy
+}
+
+// Record the outcome of checking legacy chunk map: saved chunks are dropped
+// if they do not belong to current object revision. Chunk map is saved in
+// current format afterwards.
+func (m *chunkMap) Checked(valid bool) {
+	m.bitmapMu.Lock()
+	defer m.bitmapMu.Unlock()
+	if !valid {
+		m.bitmap = new(big.Int)
+	}
+	m.legacy = false
+	m.modified = time.Now()
+}
+
+// Convert chunk bitmap to another chunk size. New chunks are marked as done
+// only if they are fully covered by chunks that were done before.
+func migrateBitmap(old *big.Int, from, to, size int64) *big.Int {
+	bitmap := new(big.Int)
+	for offset := int64(0); offset < size; offset += to {
+		end := min(offset+to, size)
+		done := true
+		for part := offset / from; part*from < end; part++ {
+			if old.Bit(int(part)) == 0 {
+				done = false
+				break
+			}
+		}
+		if done {
+			bitmap.SetBit(bitmap, int(offset/to), 1)
+		}
+	}
+	return bitmap
+}
+
 func (m *chunkMap) Close() error {
 	return m.Save()
 }
@@ -123,6 +236,7 @@ func (m *chunkMap) Done(c chunk) {
 	m.bitmapMu.Lock()
 	defer m.bitmapMu.Unlock()
 	m.bitmap.SetBit(m.bitmap, int(c), 1)
+	m.unverified.SetBit(m.unverified, int(c), 0)
 
 	m.runningMu.Lock()
 	ch, ok := m.running[c]
@@ -144,6 +258,35 @@ func (m *chunkMap) Lost(c chunk) {
 	m.modified = time.Now()
 }
 
+// Stop trusting chunks that are already done: they are treated as missing
+// until Verified. Unverified chunks are still saved to disk.
+func (m *chunkMap) Distrust() {
+	m.bitmapMu.Lock()
+	defer m.bitmapMu.Unlock()
+	m.unverified.Or(m.unverified, m.bitmap)
+	m.bitmap = new(big.Int)
+}
+
+// Check if chunk data is cached but was not verified yet
+func (m *chunkMap) Unverified(c chunk) bool {
+	m.bitmapMu.RLock()
+	defer m.bitmapMu.RUnlock()
+	return m.unverified.Bit(int(c)) == 1
+}
+
+// Record verification result for a chunk that was distrusted: valid chunk
+// is marked as done, invalid one has to be fetched again
+func (m *chunkMap) Verified(c chunk, valid bool) {
+	if valid {
+		m.Done(c)
+		return
+	}
+	m.bitmapMu.Lock()
+	defer m.bitmapMu.Unlock()
+	m.unverified.SetBit(m.unverified, int(c), 0)
+	m.modified = time.Now()
+}
+
 // Check if chunk is already done
 func (m *chunkMap) Check(c chunk) (wait <-chan struct{}, done bool) {
 	return m.check(c)
@@ -175,6 +318,24 @@ func (m *chunkMap) check(c chunk) (ch chan struct{}, done bool) {
 	return ch, false
 }
 
+// Check if chunk is already done without registering interest in it
+func (m *chunkMap) Has(c chunk) bool {
+	m.bitmapMu.RLock()
+	defer m.bitmapMu.RUnlock()
+	return m.bitmap.Bit(int(c)) == 1
+}
+
+// Number of chunks that are done and total number of chunks
+func (m *chunkMap) Count() (done, total int) {
+	total = int((m.size + uint64(m.chunkSize) - 1) / uint64(m.chunkSize))
+	m.bitmapMu.RLock()
+	defer m.bitmapMu.RUnlock()
+	for _, b := range m.bitmap.Bytes() {
+		done += bits.OnesCount8(b)
+	}
+	return done, total
+}
+
 // Find next available chunk after the given one
 func (m *chunkMap) After(current chunk) (next chunk, found bool) {
 	m.bitmapMu.RLock()
@@ -189,6 +350,15 @@ func (m *chunkMap) After(current chunk) (next chunk, found bool) {
 
 // Save chunkMap to file system for persistence
 func (m *chunkMap) Save() error {
+	if m.path == "" {
+		return nil
+	}
+	m.bitmapMu.RLock()
+	legacy := m.legacy
+	m.bitmapMu.RUnlock()
+	if legacy {
+		return nil // saving would attach unchecked chunks to current revision
+	}
 	temp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*")
 	if err != nil {
 		return err
@@ -200,8 +370,9 @@ func (m *chunkMap) Save() error {
 	defer m.bitmapMu.RUnlock()
 
 	header := chunkMapExportHeader{
-		ChunkSize: uint64(chunkSize),
+		ChunkSize: uint64(m.chunkSize),
 		TotalSize: m.size,
+		Revision:  m.revision,
 	}
 	n := copy(header.Version[:], []byte(chunkVersion))
 	if n < len(chunkVersion) {
@@ -211,7 +382,8 @@ func (m *chunkMap) Save() error {
 	if err != nil {
 		return fmt.Errorf("writing header: %w", err)
 	}
-	_, err = temp.Write(m.bitmap.Bytes())
+	bitmap := new(big.Int).Or(m.bitmap, m.unverified)
+	_, err = temp.Write(bitmap.Bytes())
 	if err != nil {
 		return fmt.Errorf("writing bitmap: %w", err)
 	}
@@ -233,6 +405,9 @@ func (m *chunkMap) Save() error {
 
 func (m *chunkMap) AutoSave(ctx context.Context) {
 	const autoSaveInterval = 9 * time.Minute
+	if m.path == "" {
+		return
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -257,6 +432,7 @@ type chunkMapExportHeader struct {
 	Version   [16]byte
 	ChunkSize uint64
 	TotalSize uint64
+	Revision  [sha256.Size]byte
 }
 
 var closed = func() chan struct{} {
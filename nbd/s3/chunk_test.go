@@ -0,0 +1,223 @@
+package s3
+
+import (
+	"testing"
+
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+func TestChunkCount(t *testing.T) {
+	const size = 5*defaultChunkSize + 1
+	m, err := openChunkMap(filepath.Join(t.TempDir(), "chunk"), size, defaultChunkSize, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(want int) {
+		t.Helper()
+		done, total := m.Count()
+		if done != want || total != 6 {
+			t.Errorf("chunk count: got %d/%d, want %d/6", done, total, want)
+		}
+	}
+	check(0)
+	m.Done(0)
+	m.Done(5)
+	m.Done(5)
+	check(2)
+	m.Lost(0)
+	check(1)
+}
+
+func TestChunkRevision(t *testing.T) {
+	const size = 3 * defaultChunkSize
+	path := filepath.Join(t.TempDir(), "chunk")
+	m, err := openChunkMap(path, size, defaultChunkSize, "etag=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Done(1)
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		revision string
+		done     int
+	}{
+		{"etag=1", 1},
+		{"etag=2", 0},
+	} {
+		m, err = openChunkMap(path, size, defaultChunkSize, tt.revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done, _ := m.Count()
+		if done != tt.done {
+			t.Errorf("revision %s: got %d chunks, want %d", tt.revision, done, tt.done)
+		}
+	}
+}
+
+func TestChunkSizeMigration(t *testing.T) {
+	const size = 10<<20 + 1
+	path := filepath.Join(t.TempDir(), "chunk")
+	m, err := openChunkMap(path, size, 1<<20, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []chunk{0, 1, 2, 3, 5, 6, 8, 9, 10} {
+		m.Done(part)
+	}
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = openChunkMap(path, size, 2<<20, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for part, want := range []bool{true, true, false, false, true, true} {
+		if m.Has(chunk(part)) != want {
+			t.Errorf("chunk %d: got %v, want %v", part, !want, want)
+		}
+	}
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = openChunkMap(path, size, 2<<20, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, total := m.Count()
+	if done != 4 || total != 6 {
+		t.Errorf("migrated chunk map was not saved: %d/%d chunks done", done, total)
+	}
+}
+
+// Write chunk map in the format used before object revisions were recorded
+func writeChunkMapV02(t *testing.T, path string, size, chunkSize int64, parts ...chunk) {
+	t.Helper()
+	header := struct {
+		Version   [16]byte
+		ChunkSize uint64
+		TotalSize uint64
+	}{
+		ChunkSize: uint64(chunkSize),
+		TotalSize: uint64(size),
+	}
+	copy(header.Version[:], chunkVersionV02)
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.BigEndian, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmap := new(big.Int)
+	for _, part := range parts {
+		bitmap.SetBit(bitmap, int(part), 1)
+	}
+	buf.Write(bitmap.Bytes())
+	err = os.WriteFile(path, buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkMapV02(t *testing.T) {
+	const size = 4<<20 + 1
+	path := filepath.Join(t.TempDir(), "chunk")
+	writeChunkMapV02(t, path, size, 1<<20, 0, 1, 3, 4)
+	m, err := openChunkMap(path, size, 2<<20, "etag=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Legacy() {
+		t.Fatalf("chunk map without revision was not marked for checking")
+	}
+	for part, want := range []bool{true, false, true} {
+		if m.Has(chunk(part)) != want {
+			t.Errorf("chunk %d: got %v, want %v", part, !want, want)
+		}
+	}
+
+	// Unchecked chunk map is not saved
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = openChunkMap(path, size, 2<<20, "etag=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Legacy() {
+		t.Fatalf("unchecked chunk map was saved with current revision")
+	}
+
+	// Checked chunk map is saved in current format
+	m.Checked(true)
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = openChunkMap(path, size, 2<<20, "etag=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, _ := m.Count()
+	if m.Legacy() || done != 2 {
+		t.Errorf("checked chunk map: legacy=%v, %d chunks done, want 2", m.Legacy(), done)
+	}
+}
+
+func TestLegacyChunkMapCheck(t *testing.T) {
+	const size = 4 * minChunkSize
+	remote := t.TempDir()
+	err := randomFile(filepath.Join(remote, "disk"), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := os.ReadFile(filepath.Join(remote, "disk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name  string
+		local []byte
+	}{
+		{"unchanged", original},
+		{"changed", make([]byte, size)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			localdir := t.TempDir()
+			err := os.WriteFile(filepath.Join(localdir, "disk"), tt.local, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeChunkMapV02(t, filepath.Join(localdir, "disk"+chunkSuffix), size, minChunkSize, 0, 1, 2, 3)
+			cache, err := OpenWithOptions("file://"+remote, "", "", "", "disk", "", localdir, Options{ChunkSize: minChunkSize})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = cache.Close() }()
+			if cache.chunk.Legacy() {
+				t.Fatalf("legacy chunk map was not checked")
+			}
+			buf := make([]byte, size)
+			_, err = io.ReadFull(io.NewSectionReader(cache, 0, size), buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, original) {
+				t.Errorf("cache served data of another object revision")
+			}
+			if tt.name == "unchanged" && cache.stats.fetched.Load() != 0 {
+				t.Errorf("valid cached data was fetched again: %d bytes", cache.stats.fetched.Load())
+			}
+		})
+	}
+}
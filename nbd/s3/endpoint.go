@@ -0,0 +1,96 @@
+package s3
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Remote storage is selected by endpoint URL scheme:
+//
+//	http://host, https://host       S3 API, bucket is required
+//	range+http://host/path,         any web server that supports HTTP range
+//	range+https://host/path         requests, objects are at /path/BUCKET/KEY
+//	file:///path                    local files or block devices at
+//	                                /path/BUCKET/KEY (e.g. a NAS mount)
+//
+// Bucket is optional for non-S3 endpoints.
+type endpointKind int
+
+const (
+	endpointS3 endpointKind = iota
+	endpointHTTP
+	endpointFile
+)
+
+// Validate endpoint URL and check that bucket is provided if required
+func CheckEndpoint(endpoint, bucket string) error {
+	kind, _, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if kind == endpointS3 && bucket == "" {
+		return fmt.Errorf("bucket is required for S3 endpoint: %s", endpoint)
+	}
+	return nil
+}
+
+// Determine remote storage kind and its base URL (without scheme prefix
+// for non-S3 endpoints)
+func parseEndpoint(endpoint string) (kind endpointKind, base *url.URL, err error) {
+	if endpoint == "" {
+		return 0, nil, fmt.Errorf("empty endpoint URL")
+	}
+	base, err = url.Parse(endpoint)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch base.Scheme {
+	case "http", "https":
+		return endpointS3, base, nil
+	case "range+http", "range+https":
+		if base.Host == "" {
+			return 0, nil, fmt.Errorf("host is required: %s", endpoint)
+		}
+		base.Scheme = strings.TrimPrefix(base.Scheme, "range+")
+		return endpointHTTP, base, nil
+	case "file":
+		if base.Host != "" && base.Host != "localhost" {
+			return 0, nil, fmt.Errorf("remote hosts are not supported: %s", endpoint)
+		}
+		if base.Path == "" || len(base.Query()) != 0 {
+			return 0, nil, fmt.Errorf("absolute path is required: %s", endpoint)
+		}
+		return endpointFile, base, nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported endpoint scheme: %s", endpoint)
+	}
+}
+
+// Open remote object at any supported endpoint.
+// Object versions are supported only by S3.
+func openRemote(endpoint, access, secret, bucket, object, version string) (remoteInterface, error) {
+	kind, base, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if kind == endpointS3 {
+		return openMinioRemote(endpoint, access, secret, bucket, object, version)
+	}
+	if object == "" {
+		return nil, fmt.Errorf("empty object name")
+	}
+	if version != "" {
+		return nil, fmt.Errorf("%s: object versions are supported only by S3 endpoints", endpoint)
+	}
+	location := base.JoinPath(bucket, object)
+	switch kind {
+	case endpointHTTP:
+		return openHTTPRemote(location.String(), access, secret)
+	case endpointFile:
+		return openFileRemote(path.Clean(location.Path))
+	default:
+		panic(fmt.Sprintf("endpoint kind not implemented: %d", kind))
+	}
+}
@@ -0,0 +1,99 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Summary of a remote object
+type Object struct {
+	// Object key relative to the listed prefix
+	Name string
+
+	// Object size in bytes
+	Size int64
+
+	// Human readable description (may be empty)
+	Description string
+}
+
+// List all objects stored under given prefix (recursively).
+// Listing is not supported for HTTP endpoints.
+func List(ctx context.Context, endpoint, access, secret, bucket, prefix string) ([]Object, error) {
+	kind, base, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case endpointHTTP:
+		return nil, fmt.Errorf("%s: listing objects is not supported", endpoint)
+	case endpointFile:
+		return listFiles(ctx, filepath.Join(base.Path, bucket), prefix)
+	}
+	client, err := minioClient(endpoint, access, secret, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var objects []Object
+	for item := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		Prefix:       prefix,
+		Recursive:    true,
+		WithMetadata: true, // only supported by MinIO, ignored by other S3 servers
+	}) {
+		if item.Err != nil {
+			return nil, fmt.Errorf("%s/%s/%s: %w", endpoint, bucket, prefix, item.Err)
+		}
+		if strings.HasSuffix(item.Key, "/") {
+			continue // directory marker
+		}
+		objects = append(objects, Object{
+			Name:        strings.TrimPrefix(item.Key, prefix),
+			Size:        item.Size,
+			Description: description(item.UserMetadata),
+		})
+	}
+	return objects, nil
+}
+
+// List regular files and block devices under local directory
+func listFiles(ctx context.Context, root, prefix string) ([]Object, error) {
+	dir := filepath.Join(root, prefix)
+	var objects []Object
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := context.Cause(ctx); err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() && entry.Type()&fs.ModeDevice == 0 {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		remote, err := openFileRemote(path)
+		if err != nil {
+			return err
+		}
+		_ = remote.Close()
+		objects = append(objects, Object{
+			Name: filepath.ToSlash(name),
+			Size: remote.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
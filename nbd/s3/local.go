@@ -1,11 +1,15 @@
 package s3
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 )
 
 // Local cache backend
@@ -19,15 +23,26 @@ type localInterface interface {
 //
 // Preallocates full file size ahead of time to reduce fragmentation and
 // to avoid running out of disk space unexpectedly.
-func openFileBackend(path string, size int64) (localInterface, error) {
-	err := os.MkdirAll(filepath.Dir(path), 0700)
+func openFileBackend(path string, size int64) (_ localInterface, err error) {
+	err = os.MkdirAll(filepath.Dir(path), 0700)
 	if err != nil {
 		return nil, err
 	}
+	_, err = os.Stat(path)
+	created := errors.Is(err, os.ErrNotExist)
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		_ = file.Close()
+		if created {
+			_ = os.Remove(path)
+		}
+	}()
 	sys, err := file.SyscallConn()
 	if err != nil {
 		return nil, fmt.Errorf("open syscall connection: %s: %w", file.Name(), err)
@@ -46,3 +61,99 @@ func openFileBackend(path string, size int64) (localInterface, error) {
 	}
 	return file, nil
 }
+
+// Cache object stored in local directory.
+//
+// Each object occupies two files: data file at Path and chunk map next to it
+// (Path + ".chunk"). Boot trace (Path + ".trace") may be present too, it is
+// tiny and is not accounted for.
+type LocalObject struct {
+	Path     string
+	Size     int64     // disk space allocated for both files
+	Accessed time.Time // last read, as of the time object was closed
+}
+
+// Find all cache objects stored in local directory.
+// Files that do not belong to cache objects are ignored.
+func ScanLocal(dir string) ([]LocalObject, error) {
+	var objects []LocalObject
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || !strings.HasSuffix(path, chunkSuffix) {
+			return nil
+		}
+		object := LocalObject{Path: strings.TrimSuffix(path, chunkSuffix)}
+		for _, name := range []string{object.Path, path} {
+			stat, err := os.Stat(name)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil // removed concurrently or not a cache object
+			}
+			if err != nil {
+				return err
+			}
+			object.Size += allocated(stat)
+			if name == object.Path {
+				object.Accessed = stat.ModTime()
+			}
+		}
+		objects = append(objects, object)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// Disk space allocated for all files in directory tree.
+// Missing directory occupies no space.
+func DiskUsage(dir string) (int64, error) {
+	var usage int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		stat, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // removed concurrently
+		}
+		if err != nil {
+			return err
+		}
+		usage += allocated(stat)
+		return nil
+	})
+	return usage, err
+}
+
+// Remove cache object from local directory.
+// Cache object must not be open.
+func RemoveLocal(path string) error {
+	var errs []error
+	for _, name := range []string{path, path + chunkSuffix, path + traceSuffix} {
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+const chunkSuffix = ".chunk"
+
+// Disk space occupied by file (sparse files take less than their size)
+func allocated(stat fs.FileInfo) int64 {
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return stat.Size()
+	}
+	return sys.Blocks * 512 // st_blocks is always in 512 byte units
+}
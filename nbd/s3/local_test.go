@@ -0,0 +1,55 @@
+package s3
+
+import (
+	"testing"
+
+	"os"
+	"path/filepath"
+)
+
+func TestLocalObjects(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nested", "object?version=1")
+	local, err := openFileBackend(path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = local.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := ScanLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Fatalf("data file without chunk map is not a cache object: %v", objects)
+	}
+
+	chunks, err := openChunkMap(path+chunkSuffix, 1<<20, defaultChunkSize, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = chunks.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err = ScanLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Path != path || objects[0].Size < 1<<20 {
+		t.Fatalf("unexpected scan result: %+v", objects)
+	}
+
+	err = RemoveLocal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{path, path + chunkSuffix} {
+		_, err = os.Stat(name)
+		if !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package s3
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Where cached data is kept
+type Mode int
+
+const (
+	// Preallocated file in local directory, chunk map is persisted next to it
+	ModeFile Mode = iota
+
+	// Bounded in-memory cache of recently used chunks, nothing is written
+	// to disk. Background fetching and integrity validation are disabled.
+	ModeMemory
+
+	// No caching: reads are served from ranged remote requests, only the
+	// chunks that are being read right now are kept in memory
+	ModePassThrough
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeFile:
+		return "file"
+	case ModeMemory:
+		return "memory"
+	case ModePassThrough:
+		return "pass-through"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
+// Parse cache mode name, empty string selects ModeFile
+func ParseMode(name string) (Mode, error) {
+	if name == "" {
+		return ModeFile, nil
+	}
+	for _, mode := range []Mode{ModeFile, ModeMemory, ModePassThrough} {
+		if mode.String() == name {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported cache mode: %q", name)
+}
+
+const (
+	// Default memory limit for ModeMemory
+	defaultMemoryLimit = 256 << 20
+
+	// Memory limit for ModePassThrough in chunks: enough to serve a few
+	// concurrent reads without fetching the same chunk repeatedly
+	passThroughChunks = 4
+)
+
+// Local backends that receive whole chunks instead of streaming writes
+type chunkStore interface {
+	Store(part chunk, data []byte)
+}
+
+// Chunk was dropped by local backend (see memoryBackend)
+var errEvicted = errors.New("chunk was evicted from local cache")
+
+// In-memory local cache backend.
+//
+// Chunks are stored whole and evicted in least recently used order when
+// memory limit is exceeded. The most recently stored chunk is never evicted,
+// so the limit may be exceeded by a single chunk at most.
+// Evicted chunks are reported via callback to keep chunk map in sync.
+type memoryBackend struct {
+	limit     int64
+	chunkSize int64
+	evict     func(part chunk)
+
+	mu     sync.Mutex
+	used   int64
+	lru    *list.List              // front is the most recently used one
+	chunks map[chunk]*list.Element // values are *memoryChunk
+}
+
+type memoryChunk struct {
+	part chunk
+	data []byte
+}
+
+func newMemoryBackend(limit, chunkSize int64, evict func(part chunk)) *memoryBackend {
+	return &memoryBackend{
+		limit:     limit,
+		chunkSize: chunkSize,
+		evict:     evict,
+		lru:       list.New(),
+		chunks:    make(map[chunk]*list.Element),
+	}
+}
+
+// Read from a single chunk, short reads are possible at chunk boundaries
+func (m *memoryBackend) ReadAt(p []byte, offset int64) (int, error) {
+	part := chunk(offset / m.chunkSize)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	element, found := m.chunks[part]
+	if !found {
+		return 0, errEvicted
+	}
+	m.lru.MoveToFront(element)
+	data := element.Value.(*memoryChunk).data
+	start := offset - int64(part)*m.chunkSize
+	if start >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[start:])
+	if n < len(p) && int64(len(data)) < m.chunkSize {
+		return n, io.EOF // last chunk of the object
+	}
+	return n, nil
+}
+
+func (m *memoryBackend) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, fmt.Errorf("memory backend accepts only whole chunks")
+}
+
+func (m *memoryBackend) Store(part chunk, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, found := m.chunks[part]; found {
+		m.used -= int64(len(element.Value.(*memoryChunk).data))
+		m.lru.Remove(element)
+	}
+	m.chunks[part] = m.lru.PushFront(&memoryChunk{part: part, data: data})
+	m.used += int64(len(data))
+	for m.used > m.limit && m.lru.Len() > 1 {
+		victim := m.lru.Remove(m.lru.Back()).(*memoryChunk)
+		delete(m.chunks, victim.part)
+		m.used -= int64(len(victim.data))
+		m.evict(victim.part)
+	}
+}
+
+func (m *memoryBackend) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.Init()
+	clear(m.chunks)
+	m.used = 0
+	return nil
+}
+
+// Writer into a preallocated buffer
+type sliceWriter struct {
+	buf []byte
+}
+
+func (w *sliceWriter) Write(p []byte) (int, error) {
+	if len(w.buf)+len(p) > cap(w.buf) {
+		return 0, io.ErrShortBuffer
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+var (
+	_ localInterface = new(memoryBackend)
+	_ chunkStore     = new(memoryBackend)
+)
@@ -0,0 +1,91 @@
+package s3
+
+import (
+	"testing"
+
+	"bytes"
+	"errors"
+	"io"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	// Tiny chunks keep this test lightweight
+	const chunkSize = 100
+	const size = 3*chunkSize + 10
+	m := newChunkMap("", size, chunkSize, "")
+	local := newMemoryBackend(200, chunkSize, m.Lost)
+	t.Cleanup(func() { _ = local.Close() })
+
+	data := func(part chunk) []byte {
+		length := 100
+		if part == 3 {
+			length = 10
+		}
+		return bytes.Repeat([]byte{byte(part + 1)}, length)
+	}
+	store := func(part chunk) {
+		local.Store(part, data(part))
+		m.Done(part)
+	}
+	read := func(part chunk) error {
+		t.Helper()
+		offset, _ := m.Offset(part)
+		buf := make([]byte, 50)
+		n, err := local.ReadAt(buf, offset+20)
+		if part == 3 {
+			if n != 0 || !errors.Is(err, io.EOF) {
+				t.Errorf("reading past the end: n=%d, err=%v", n, err)
+			}
+			n, err = local.ReadAt(buf, offset)
+			if n != 10 || !errors.Is(err, io.EOF) {
+				t.Errorf("reading the last chunk: n=%d, err=%v", n, err)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n != 50 || !bytes.Equal(buf[:n], data(part)[:n]) {
+			t.Errorf("chunk %d: read %d bytes: %v", part, n, buf[:n])
+		}
+		return nil
+	}
+
+	store(0)
+	store(1)
+	if err := read(0); err != nil {
+		t.Fatalf("chunk 0: %v", err)
+	}
+	store(2) // chunk 1 is the least recently used one
+	if err := read(1); !errors.Is(err, errEvicted) {
+		t.Errorf("chunk 1 was not evicted: %v", err)
+	}
+	if m.Has(1) || !m.Has(0) || !m.Has(2) {
+		t.Errorf("chunk map is out of sync with memory backend")
+	}
+	store(3)
+	if err := read(3); err != nil {
+		t.Fatalf("chunk 3: %v", err)
+	}
+	if local.used > 200 {
+		t.Errorf("memory limit exceeded: %d bytes", local.used)
+	}
+	if _, err := local.WriteAt([]byte("hello"), 0); err == nil {
+		t.Errorf("partial writes are not supported")
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, mode := range []Mode{ModeFile, ModeMemory, ModePassThrough} {
+		got, err := ParseMode(mode.String())
+		if err != nil || got != mode {
+			t.Errorf("%s: got %v (%v)", mode, got, err)
+		}
+	}
+	if mode, err := ParseMode(""); err != nil || mode != ModeFile {
+		t.Errorf("default mode: got %v (%v)", mode, err)
+	}
+	if _, err := ParseMode("tape"); err == nil {
+		t.Errorf("unsupported mode was accepted")
+	}
+}
@@ -0,0 +1,116 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sio/pond/nbd/logger"
+)
+
+// Other daemons that may have the chunk in their local cache (see package peer)
+type Peers interface {
+	// Fetch byte range of the object from any peer that has it cached.
+	// Returned data is not trusted and is verified by the caller.
+	Fetch(ctx context.Context, id ObjectID, offset int64, size int) ([]byte, error)
+}
+
+// Content identifier of remote object revision: the same for all daemons
+// that cache the same object, regardless of endpoint URL
+type ObjectID [sha256.Size]byte
+
+func (id ObjectID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func ParseObjectID(s string) (id ObjectID, err error) {
+	raw, err := hex.DecodeString(s)
+	if err != nil || len(raw) != len(id) {
+		return id, fmt.Errorf("invalid object id: %q", s)
+	}
+	copy(id[:], raw)
+	return id, nil
+}
+
+// Object identity is unknown if remote storage does not report revisions
+func objectID(object, revision string, size int64) (id ObjectID, ok bool) {
+	if revision == "" {
+		return id, false
+	}
+	return sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", object, revision, size))), true
+}
+
+// Content identifier of cached object revision
+func (c *Cache) ID() ObjectID {
+	return c.id
+}
+
+// Requested byte range is not available in local cache
+var ErrNotCached = errors.New("not available in local cache")
+
+// Read from local cache only, never fetch anything from remote.
+// Short reads are possible at chunk boundaries.
+func (c *Cache) ReadCached(p []byte, offset int64) (int, error) {
+	if err := context.Cause(c.ctx); err != nil {
+		return 0, err
+	}
+	if offset < 0 || offset >= c.Size() {
+		return 0, io.EOF
+	}
+	part := c.chunk.Chunk(offset)
+	if !c.chunk.Has(part) {
+		return 0, ErrNotCached
+	}
+	start, size := c.chunk.Offset(part)
+	p = p[:min(int64(len(p)), start+int64(size)-offset)]
+	n, err := c.local.ReadAt(p, offset)
+	if errors.Is(err, errEvicted) {
+		return n, ErrNotCached
+	}
+	if errors.Is(err, io.EOF) && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+// Try fetching chunk from other daemons, report if it was successful.
+//
+// Chunks are accepted only after verification against verity hash tree.
+// Hash tree itself is always fetched from remote storage, so chunks outside
+// of verity protected data region are never fetched from peers.
+func (c *Cache) fetchPeer(ctx context.Context, part chunk, offset int64, size int) bool {
+	if c.peers == nil {
+		return false
+	}
+	checksum := c.verity.Load()
+	if checksum == nil || offset+int64(size) > checksum.DataSize() {
+		return false
+	}
+	data, err := c.peers.Fetch(ctx, c.id, offset, size)
+	if err != nil || len(data) != size {
+		return false
+	}
+	err = c.verifyChunk(&bufferAt{data: data, offset: offset}, part)
+	if err != nil {
+		log := logger.FromContext(ctx)
+		log.Warn("chunk received from peer failed verification", "chunk", part, "error", err)
+		c.stats.peerRejected.Add(1)
+		return false
+	}
+	if store, whole := c.local.(chunkStore); whole {
+		store.Store(part, data)
+	} else {
+		_, err = c.local.WriteAt(data, offset)
+		if err != nil {
+			log := logger.FromContext(ctx)
+			log.Error("saving chunk received from peer to local cache", "error", err, "offset", offset, "size", size)
+			return false
+		}
+	}
+	c.chunk.Done(part)
+	c.stats.peerFetched.Add(uint64(size))
+	return true
+}
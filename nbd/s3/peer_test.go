@@ -0,0 +1,88 @@
+package s3
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"sync/atomic"
+)
+
+// Peers that serve a copy of remote object, optionally corrupted
+type fakePeers struct {
+	data    []byte
+	corrupt bool
+	calls   atomic.Int32
+}
+
+func (p *fakePeers) Fetch(ctx context.Context, id ObjectID, offset int64, size int) ([]byte, error) {
+	p.calls.Add(1)
+	chunk := bytes.Clone(p.data[offset : offset+int64(size)])
+	if p.corrupt {
+		chunk[size/2] ^= 0xff
+	}
+	return chunk, nil
+}
+
+func TestPeerFetch(t *testing.T) {
+	c, original := verityTestCache(t, nil)
+	peers := &fakePeers{data: original}
+	c.peers = peers
+	c.id, _ = objectID("pseudorandom", c.remote.Revision(), c.Size())
+	checksum, err := c.loadVerity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched := c.stats.fetched.Load() // verity metadata is always fetched from remote
+
+	read := func(part chunk) {
+		t.Helper()
+		err := c.fetch(part, false)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", part, err)
+		}
+		offset, size := c.chunk.Offset(part)
+		got := make([]byte, size)
+		_, err = c.ReadCached(got, offset)
+		if err != nil || !bytes.Equal(got, original[offset:offset+int64(size)]) {
+			t.Fatalf("chunk %d: data mismatch (%v)", part, err)
+		}
+	}
+
+	read(1)
+	stats := c.Stats()
+	if stats.PeerBytes != verityChunkSize || stats.FetchedBytes != fetched {
+		t.Errorf("chunk was not received from peer: %+v", stats)
+	}
+
+	peers.corrupt = true
+	read(2)
+	stats = c.Stats()
+	if stats.PeerRejected != 1 || stats.FetchedBytes != fetched+verityChunkSize {
+		t.Errorf("corrupted chunk was not rejected: %+v", stats)
+	}
+
+	calls := peers.calls.Load()
+	last := c.chunk.Chunk(checksum.DataSize())
+	read(last)
+	if peers.calls.Load() != calls {
+		t.Errorf("chunk outside of verity protected region was requested from peers")
+	}
+}
+
+func TestReadCached(t *testing.T) {
+	cache := openTestCache(t, 3*minChunkSize, t.TempDir(), Options{})
+	buf := make([]byte, 100)
+	_, err := cache.ReadCached(buf, minChunkSize)
+	if err != ErrNotCached {
+		t.Errorf("missing chunk: got %v, want %v", err, ErrNotCached)
+	}
+	_, err = cache.ReadAt(buf, minChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := cache.ReadCached(buf, 2*minChunkSize-10)
+	if n != 10 || err != nil {
+		t.Errorf("read at chunk boundary: n=%d, err=%v", n, err)
+	}
+}
@@ -0,0 +1,71 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Pointer objects are tiny, anything larger is a mistake
+const maxPointerSize = 4 << 10
+
+// Read symlink-like pointer object.
+//
+// Pointer object contains a reference to another object as plain text,
+// surrounding whitespace is ignored.
+func ReadPointer(ctx context.Context, endpoint, access, secret, bucket, object string) (string, error) {
+	remote, err := openPointer(ctx, endpoint, access, secret, bucket, object)
+	if err != nil {
+		return "", fmt.Errorf("%s/%s/%s: %w", endpoint, bucket, object, err)
+	}
+	defer func() { _ = remote.Close() }()
+	raw, err := io.ReadAll(io.LimitReader(remote, maxPointerSize+1))
+	if err != nil {
+		return "", fmt.Errorf("%s/%s/%s: %w", endpoint, bucket, object, err)
+	}
+	if len(raw) > maxPointerSize {
+		return "", fmt.Errorf("%s/%s/%s: pointer object too large", endpoint, bucket, object)
+	}
+	target := strings.TrimSpace(string(raw))
+	if target == "" {
+		return "", fmt.Errorf("%s/%s/%s: empty pointer object", endpoint, bucket, object)
+	}
+	return target, nil
+}
+
+func openPointer(ctx context.Context, endpoint, access, secret, bucket, object string) (io.ReadCloser, error) {
+	kind, _, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if kind == endpointS3 {
+		client, err := minioClient(endpoint, access, secret, bucket)
+		if err != nil {
+			return nil, err
+		}
+		return client.GetObject(ctx, bucket, object, minio.GetObjectOptions{})
+	}
+	remote, err := openRemote(endpoint, access, secret, bucket, object, "")
+	if err != nil {
+		return nil, err
+	}
+	reader, err := remote.Reader(ctx, 0, maxPointerSize+1)
+	if err != nil {
+		_ = remote.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, closeBoth{reader, remote}}, nil
+}
+
+type closeBoth [2]io.Closer
+
+func (c closeBoth) Close() error {
+	return errors.Join(c[0].Close(), c[1].Close())
+}
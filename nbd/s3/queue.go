@@ -43,6 +43,16 @@ func (q *Queue) Close() error {
 	return nil
 }
 
+// Number of acquired slots and total queue capacity
+func (q *Queue) Occupancy() (used, size int) {
+	return len(q.global), cap(q.global)
+}
+
+// Occupancy of the connection queue shared by all S3 objects
+func GlobalQueueOccupancy() (used, size int) {
+	return globalConnectionQueue.Occupancy()
+}
+
 // Calling Release() without previously calling Acquire() or
 // AcquireLowPriority() will result in dead lock.
 func (q *Queue) Release() error {
@@ -0,0 +1,143 @@
+package s3
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// Default upper limit for readahead window of a single stream
+	defaultReadahead = 64 << 20
+
+	// How many sequential streams are tracked per client. Booting OS reads
+	// several files concurrently, each one is mostly sequential.
+	readaheadStreams = 8
+
+	// Reads that start this close to the end of a stream continue it.
+	// NBD clients issue concurrent requests, so reads may arrive slightly
+	// out of order or skip small holes.
+	readaheadSlack = 1 << 20
+
+	// Stream must read at least this much before readahead kicks in
+	readaheadTrigger = 256 << 10
+)
+
+// Sequential access detector for a single client.
+//
+// Readahead tracks a few concurrent sequential streams and fetches the
+// chunks ahead of each of them at normal priority. Readahead window starts
+// with a single chunk and doubles each time the stream reaches a new chunk,
+// up to the limit set by Options.Readahead.
+//
+// Client reads are also recorded in boot trace if it is enabled, reads
+// made directly from Cache are not.
+type Readahead struct {
+	cache *Cache
+	limit int64 // chunks
+
+	mu      sync.Mutex
+	streams [readaheadStreams]stream
+	clock   uint64
+}
+
+type stream struct {
+	start, end int64
+	current    chunk // chunk containing stream end
+	ahead      chunk // first chunk that was not requested yet
+	window     int64 // chunks
+	used       uint64
+}
+
+// Sequential access detector for a new client.
+// Returns a plain wrapper around the cache if readahead is disabled.
+func (c *Cache) Readahead() *Readahead {
+	limit := c.readaheadLimit / c.chunk.chunkSize
+	if c.readaheadLimit > 0 {
+		limit = max(limit, 1)
+	}
+	return &Readahead{cache: c, limit: limit}
+}
+
+func (r *Readahead) ReadAt(p []byte, offset int64) (int, error) {
+	if r.cache.trace != nil && len(p) > 0 && offset >= 0 && offset < r.cache.Size() {
+		end := min(offset+int64(len(p)), r.cache.Size())
+		r.cache.trace.Record(r.cache.chunk.Chunk(offset), r.cache.chunk.Chunk(end-1))
+	}
+	r.observe(offset, int64(len(p)))
+	return r.cache.ReadAt(p, offset)
+}
+
+// Update stream state and schedule readahead if needed
+func (r *Readahead) observe(offset, length int64) {
+	if r.limit <= 0 || length <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clock++
+	var s *stream
+	for i := range r.streams {
+		candidate := &r.streams[i]
+		if candidate.used != 0 && offset >= candidate.start && offset <= candidate.end+readaheadSlack {
+			s = candidate
+			break
+		}
+	}
+	if s == nil {
+		// Replace the least recently used stream
+		s = &r.streams[0]
+		for i := range r.streams {
+			if r.streams[i].used < s.used {
+				s = &r.streams[i]
+			}
+		}
+		*s = stream{start: offset, end: offset + length, used: r.clock}
+		return
+	}
+	s.used = r.clock
+	s.end = max(s.end, offset+length)
+	if s.end-s.start < readaheadTrigger {
+		return
+	}
+	current := r.cache.chunk.Chunk(s.end - 1)
+	switch {
+	case s.window == 0:
+		s.window = 1
+		s.ahead = current + 1
+	case current == s.current:
+		return // window is updated only when stream reaches a new chunk
+	default:
+		s.window = min(2*s.window, r.limit)
+	}
+	s.current = current
+	target := current + chunk(s.window)
+	if target < s.ahead {
+		return
+	}
+	r.cache.fetchAhead(max(s.ahead, current+1), target)
+	s.ahead = target + 1
+}
+
+// Fetch chunks in the given range (inclusive) at normal priority
+func (c *Cache) fetchAhead(first, last chunk) {
+	if c.ctx.Err() != nil {
+		return
+	}
+	for part := first; part <= last; part++ {
+		_, size := c.chunk.Offset(part)
+		if size == 0 {
+			break
+		}
+		if c.chunk.Has(part) {
+			continue
+		}
+		c.stats.readahead.Add(1)
+		c.goro.Add(1)
+		go func(part chunk) {
+			defer c.goro.Done()
+			_ = c.fetch(part, false) // errors are logged by fetch(), reads will retry
+		}(part)
+	}
+}
+
+var _ io.ReaderAt = new(Readahead)
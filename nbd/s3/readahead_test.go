@@ -0,0 +1,104 @@
+package s3
+
+import (
+	"testing"
+
+	"path/filepath"
+	"time"
+)
+
+// Open cache over a local file split into 1MB chunks
+func openTestCache(t *testing.T, size int64, localdir string, opt Options) *Cache {
+	t.Helper()
+	remote := t.TempDir()
+	err := randomFile(filepath.Join(remote, "disk"), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt.ChunkSize = minChunkSize
+	cache, err := OpenWithOptions("file://"+remote, "", "", "", "disk", "", localdir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cache.Close() })
+	return cache
+}
+
+// Wait until all given chunks are available in local cache
+func waitChunks(t *testing.T, cache *Cache, parts ...chunk) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, part := range parts {
+		for !cache.chunk.Has(part) {
+			if time.Now().After(deadline) {
+				t.Fatalf("chunk %d was not fetched", part)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestReadahead(t *testing.T) {
+	cache := openTestCache(t, 8*minChunkSize, t.TempDir(), Options{})
+	reader := cache.Readahead()
+	buf := make([]byte, 64<<10)
+	read := func(offset int64) {
+		t.Helper()
+		_, err := reader.ReadAt(buf, offset)
+		if err != nil {
+			t.Fatalf("read at %d: %v", offset, err)
+		}
+	}
+	check := func(want uint64) {
+		t.Helper()
+		got := cache.Stats().Readahead
+		if got != want {
+			t.Errorf("readahead: got %d chunks, want %d", got, want)
+		}
+	}
+
+	read(5 * minChunkSize) // random read does not trigger readahead
+	for offset := int64(0); offset+int64(len(buf)) < readaheadTrigger; offset += int64(len(buf)) {
+		read(offset)
+	}
+	check(0)
+	read(readaheadTrigger - int64(len(buf)))
+	check(1)
+	waitChunks(t, cache, 1)
+	if cache.chunk.Has(2) {
+		t.Errorf("chunk 2 was fetched too early")
+	}
+
+	read(minChunkSize) // window doubles when stream reaches the next chunk
+	check(3)
+	waitChunks(t, cache, 2, 3)
+	read(minChunkSize + int64(len(buf)))
+	check(3)
+}
+
+func TestPrefetch(t *testing.T) {
+	const size = 8 * minChunkSize
+	cache := openTestCache(t, size, t.TempDir(), Options{})
+	err := cache.Prefetch(minChunkSize, 3*minChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitChunks(t, cache, 1, 2, 3)
+	if cache.chunk.Has(4) {
+		t.Errorf("chunks outside of requested range were prefetched")
+	}
+	err = cache.Prefetch(0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitChunks(t, cache, 0, 4, 5, 6, 7)
+
+	passthrough := openTestCache(t, size, "", Options{Mode: ModePassThrough})
+	err = passthrough.Prefetch(0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passthrough.prefetch != nil || passthrough.Stats().FetchedBytes != 0 {
+		t.Errorf("pass-through cache prefetched data")
+	}
+}
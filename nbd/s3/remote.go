@@ -2,6 +2,7 @@ package s3
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
@@ -18,19 +19,51 @@ type remoteInterface interface {
 	// Full size of remote object
 	Size() int64
 
+	// Human readable description of remote object (may be empty)
+	Description() string
+
+	// Opaque identifier of remote object contents (ETag, version ID,
+	// modification time), empty if unknown. Readers fail with ErrChanged
+	// if remote object no longer matches this revision (when supported by
+	// the remote).
+	Revision() string
+
 	io.Closer
 }
 
-func openMinioRemote(endpoint, access, secret, bucket, object string) (remoteInterface, error) {
+func openMinioRemote(endpoint, access, secret, bucket, object, version string) (remoteInterface, error) {
+	if object == "" {
+		return nil, fmt.Errorf("empty object name")
+	}
+	client, err := minioClient(endpoint, access, secret, bucket)
+	if err != nil {
+		return nil, err
+	}
+	m := &minioRemote{client: client}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
+	defer cancel()
+	stat, err := m.client.StatObject(ctx, bucket, object, minio.StatObjectOptions{VersionID: version})
+	if err != nil {
+		if version != "" {
+			return nil, fmt.Errorf("%s/%s/%s (version %s): %w", endpoint, bucket, object, version, err)
+		}
+		return nil, fmt.Errorf("%s/%s/%s: %w", endpoint, bucket, object, err)
+	}
+	m.size = stat.Size
+	m.etag = stat.ETag
+	m.revision = fmt.Sprintf("etag=%s version=%s modified=%s", stat.ETag, stat.VersionID, stat.LastModified.UTC().Format(time.RFC3339Nano))
+	m.description = description(stat.UserMetadata)
+	m.bucket, m.object, m.version = bucket, object, version
+	return m, nil
+}
+
+func minioClient(endpoint, access, secret, bucket string) (*minio.Client, error) {
 	if endpoint == "" {
 		return nil, fmt.Errorf("empty endpoint URL")
 	}
 	if bucket == "" {
 		return nil, fmt.Errorf("empty bucket name")
 	}
-	if object == "" {
-		return nil, fmt.Errorf("empty object name")
-	}
 	remote, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
@@ -41,35 +74,50 @@ func openMinioRemote(endpoint, access, secret, bucket, object string) (remoteInt
 		useTLS = false
 	default:
 	}
-	m := new(minioRemote)
-	m.client, err = minio.New(remote.Host, &minio.Options{
+	client, err := minio.New(remote.Host, &minio.Options{
 		Creds:  credentials.NewStaticV4(access, secret, ""),
 		Secure: useTLS,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", endpoint, err)
 	}
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
-	defer cancel()
-	stat, err := m.client.StatObject(ctx, bucket, object, minio.StatObjectOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("%s/%s/%s: %w", endpoint, bucket, object, err)
+	return client, nil
+}
+
+// Extract human readable description from S3 user metadata
+// (x-amz-meta-description header)
+func description(meta map[string]string) string {
+	for _, key := range []string{"Description", "X-Amz-Meta-Description"} {
+		value, ok := meta[key]
+		if ok {
+			return value
+		}
 	}
-	m.size = stat.Size
-	m.bucket, m.object = bucket, object
-	return m, nil
+	return ""
 }
 
 type minioRemote struct {
 	client         *minio.Client
 	bucket, object string
+	version        string // empty for the latest version
 	size           int64
+	etag           string
+	revision       string
+	description    string
 }
 
 func (m *minioRemote) Size() int64 {
 	return m.size
 }
 
+func (m *minioRemote) Description() string {
+	return m.description
+}
+
+func (m *minioRemote) Revision() string {
+	return m.revision
+}
+
 func (m *minioRemote) Close() error {
 	return nil // minio.Client does not require any cleanup
 }
@@ -83,18 +131,45 @@ func (m *minioRemote) Reader(ctx context.Context, offset, length int64) (io.Read
 		end = m.size
 	}
 
-	get := minio.GetObjectOptions{}
+	get := minio.GetObjectOptions{VersionID: m.version}
 	err := get.SetRange(offset, end)
 	if err != nil {
 		return nil, fmt.Errorf("set range: %w", err)
 	}
+	if m.etag != "" {
+		err = get.SetMatchETag(m.etag)
+		if err != nil {
+			return nil, fmt.Errorf("set etag: %w", err)
+		}
+	}
 	object, err := m.client.GetObject(ctx, m.bucket, m.object, get)
 	if err != nil {
-		return nil, fmt.Errorf("get object: %w", err)
+		return nil, fmt.Errorf("get object: %w", minioError(err))
+	}
+	return minioReader{object}, nil
+}
+
+// Remote object that reports precondition failures as ErrChanged.
+// minio.Object sends request lazily, so errors are returned by Read().
+type minioReader struct {
+	*minio.Object
+}
+
+func (r minioReader) Read(p []byte) (int, error) {
+	n, err := r.Object.Read(p)
+	return n, minioError(err)
+}
+
+func minioError(err error) error {
+	if err != nil && minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+		return fmt.Errorf("%w: %w", ErrChanged, err)
 	}
-	return object, nil
+	return err
 }
 
+// Remote object was modified after it had been opened
+var ErrChanged = errors.New("remote object has changed")
+
 type nullReader struct{}
 
 func (r nullReader) Read(p []byte) (int, error) {
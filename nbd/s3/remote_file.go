@@ -0,0 +1,77 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Local file or block device used as remote storage.
+//
+// Changes are detected only when opening the file (by size and modification
+// time), reads are not pinned to a revision.
+type fileRemote struct {
+	file     *os.File
+	size     int64
+	revision string
+}
+
+func openFileRemote(path string) (remoteInterface, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// Size of block devices is not reported by stat(2)
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	f := &fileRemote{file: file, size: size}
+	stat, err := file.Stat()
+	if err == nil && stat.Mode().IsRegular() {
+		f.revision = fmt.Sprintf("size=%d modified=%s", size, stat.ModTime().UTC().Format(time.RFC3339Nano))
+	}
+	return f, nil
+}
+
+func (f *fileRemote) Size() int64 {
+	return f.size
+}
+
+func (f *fileRemote) Description() string {
+	return ""
+}
+
+func (f *fileRemote) Revision() string {
+	return f.revision
+}
+
+func (f *fileRemote) Close() error {
+	return f.file.Close()
+}
+
+func (f *fileRemote) Reader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if offset > f.size || length <= 0 || offset < 0 {
+		return nullReader{}, nil
+	}
+	return io.NopCloser(&contextReader{
+		ctx:    ctx,
+		reader: io.NewSectionReader(f.file, offset, min(length, f.size-offset)),
+	}), nil
+}
+
+// Reader that stops when context is cancelled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err // not the cause: callers expect context.Canceled
+	}
+	return r.reader.Read(p)
+}
@@ -0,0 +1,123 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Object served by any web server that supports HTTP range requests.
+//
+// Reads are pinned to the object revision that was seen when the remote was
+// opened: by ETag if the server provides a strong one, by modification time
+// otherwise.
+type httpRemote struct {
+	url            string
+	access, secret string // HTTP basic authentication (optional)
+	size           int64
+	tag            string // ETag header
+	etag           string // strong entity tag (empty if not provided)
+	modified       string // Last-Modified header
+	description    string
+}
+
+var httpClient = &http.Client{}
+
+func openHTTPRemote(location, access, secret string) (remoteInterface, error) {
+	h := &httpRemote{url: location, access: access, secret: secret}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second*10))
+	defer cancel()
+	req, err := h.request(ctx, http.MethodHead)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", location, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("%s: server did not report object size", location)
+	}
+	h.size = resp.ContentLength
+	h.tag = resp.Header.Get("ETag")
+	if !strings.HasPrefix(h.tag, "W/") {
+		h.etag = h.tag // weak tags are not allowed in If-Match
+	}
+	h.modified = resp.Header.Get("Last-Modified")
+	h.description = resp.Header.Get("X-Amz-Meta-Description") // S3 static website hosting
+	return h, nil
+}
+
+func (h *httpRemote) request(ctx context.Context, method string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.access != "" {
+		req.SetBasicAuth(h.access, h.secret)
+	}
+	return req, nil
+}
+
+func (h *httpRemote) Size() int64 {
+	return h.size
+}
+
+func (h *httpRemote) Description() string {
+	return h.description
+}
+
+func (h *httpRemote) Revision() string {
+	return fmt.Sprintf("etag=%s modified=%s", h.tag, h.modified)
+}
+
+func (h *httpRemote) Close() error {
+	return nil
+}
+
+func (h *httpRemote) Reader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if offset >= h.size || length <= 0 || offset < 0 {
+		return nullReader{}, nil
+	}
+	end := min(offset+length, h.size) - 1
+	req, err := h.request(ctx, http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end))
+	if h.etag != "" {
+		req.Header.Set("If-Match", h.etag)
+	} else if h.modified != "" {
+		req.Header.Set("If-Unmodified-Since", h.modified)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", offset, end)) {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("%s: unexpected content range: %q", h.url, resp.Header.Get("Content-Range"))
+		}
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK && offset == 0 && end == h.size-1:
+		return resp.Body, nil // full object was requested
+	case resp.StatusCode == http.StatusOK:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s: server does not support range requests", h.url)
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", h.url, ErrChanged)
+	default:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", h.url, resp.Status)
+	}
+}
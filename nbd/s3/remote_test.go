@@ -0,0 +1,228 @@
+package s3
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func TestHTTPRemote(t *testing.T) {
+	content := []byte("hello world, this is a remote object")
+	etag := `"v1"`
+	var ignoreRange bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pub/images/hello" {
+			http.NotFound(w, r)
+			return
+		}
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "hello", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	endpoint := "range+" + srv.URL + "/pub"
+	remote, err := openRemote(endpoint, "", "", "images", "hello", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = remote.Close() })
+	if remote.Size() != int64(len(content)) {
+		t.Fatalf("size: got %d, want %d", remote.Size(), len(content))
+	}
+	read := func(offset, length int64) ([]byte, error) {
+		reader, err := remote.Reader(context.Background(), offset, length)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = reader.Close() }()
+		return io.ReadAll(reader)
+	}
+	for _, tt := range []struct{ offset, length int64 }{
+		{0, 5},
+		{6, 5},
+		{30, 100},
+		{0, int64(len(content))},
+	} {
+		got, err := read(tt.offset, tt.length)
+		want := content[tt.offset:min(tt.offset+tt.length, int64(len(content)))]
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("read %d bytes at %d: got %q (%v), want %q", tt.length, tt.offset, got, err, want)
+		}
+	}
+
+	ignoreRange = true
+	_, err = read(6, 5)
+	if err == nil || !strings.Contains(err.Error(), "range requests") {
+		t.Errorf("server without range support: %v", err)
+	}
+	ignoreRange = false
+
+	etag = `"v2"`
+	_, err = read(6, 5)
+	if !errors.Is(err, ErrChanged) {
+		t.Errorf("modified object: got %v, want %v", err, ErrChanged)
+	}
+
+	_, err = openRemote(endpoint, "", "", "images", "missing", "")
+	if err == nil {
+		t.Errorf("missing object was opened")
+	}
+	_, err = openRemote(endpoint, "", "", "images", "hello", "3HL4kqtJlcpXroDTDmJ")
+	if err == nil {
+		t.Errorf("object versions are not supported over plain HTTP")
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	for _, tt := range []struct {
+		endpoint string
+		bucket   string
+		fail     bool
+	}{
+		{endpoint: "https://s3.example.com", bucket: "images"},
+		{endpoint: "https://s3.example.com", fail: true},
+		{endpoint: "range+https://example.com/pub"},
+		{endpoint: "range+http:///pub", fail: true},
+		{endpoint: "file:///srv/images"},
+		{endpoint: "file://nas/srv/images", fail: true},
+		{endpoint: "ftp://example.com", fail: true},
+		{endpoint: "", fail: true},
+	} {
+		err := CheckEndpoint(tt.endpoint, tt.bucket)
+		if (err != nil) != tt.fail {
+			t.Errorf("%q (bucket %q): unexpected result: %v", tt.endpoint, tt.bucket, err)
+		}
+	}
+}
+
+func TestFileRemote(t *testing.T) {
+	const size = 2*defaultChunkSize + 123
+	dir := t.TempDir()
+	err := randomFile(filepath.Join(dir, "images", "rootfs"), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "images", "rootfs@latest"), []byte(" rootfs\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := os.ReadFile(filepath.Join(dir, "images", "rootfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := "file://" + dir
+
+	objects, err := List(context.Background(), endpoint, "", "", "", "images")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(objects) != 2 || objects[0].Name != "rootfs" || objects[0].Size != size {
+		t.Errorf("list: unexpected result: %+v", objects)
+	}
+	target, err := ReadPointer(context.Background(), endpoint, "", "", "", "images/rootfs@latest")
+	if err != nil || target != "rootfs" {
+		t.Errorf("read pointer: got %q (%v)", target, err)
+	}
+
+	for _, mode := range []Mode{ModeFile, ModeMemory, ModePassThrough} {
+		t.Run(mode.String(), func(t *testing.T) {
+			cache, err := OpenWithOptions(endpoint, "", "", "images", "rootfs", "", t.TempDir(), Options{
+				Mode:        mode,
+				MemoryLimit: defaultChunkSize,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				err := cache.Close()
+				if err != nil {
+					t.Errorf("close: %v", err)
+				}
+			})
+			if cache.Size() != size {
+				t.Fatalf("size: got %d, want %d", cache.Size(), size)
+			}
+			for _, tt := range []struct{ offset, length int64 }{
+				{0, 100},
+				{defaultChunkSize - 10, 20}, // crosses chunk boundary
+				{2*defaultChunkSize + 100, 1000},
+				{123, 2*defaultChunkSize - 100},
+				{0, size},
+			} {
+				got := make([]byte, tt.length)
+				_, err := io.ReadFull(io.NewSectionReader(cache, tt.offset, tt.length), got)
+				want := original[tt.offset:min(tt.offset+tt.length, size)]
+				if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("%s: %v", span(tt.offset, tt.length), err)
+					continue
+				}
+				if !bytes.Equal(got[:len(want)], want) {
+					t.Errorf("%s: data mismatch", span(tt.offset, tt.length))
+				}
+			}
+		})
+	}
+}
+
+func span(offset, length int64) string {
+	return fmt.Sprintf("@%s+%s", filesize(offset), filesize(length))
+}
+
+func TestRemoteChanged(t *testing.T) {
+	const size = 2 * defaultChunkSize
+	content := make([]byte, size)
+	etag := `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	open := func() *Cache {
+		t.Helper()
+		cache, err := Open("range+"+srv.URL, "", "", "", "object", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	}
+	cache := open()
+	buf := make([]byte, 10)
+	_, err := cache.ReadAt(buf, 0)
+	if err != nil || buf[0] != 0 {
+		t.Fatalf("read: %v (%v)", buf, err)
+	}
+
+	content = bytes.Repeat([]byte{1}, size)
+	etag = `"v2"`
+	_, err = cache.ReadAt(buf, defaultChunkSize)
+	if !errors.Is(err, ErrChanged) || !errors.Is(cache.Err(), ErrChanged) {
+		t.Errorf("remote change was not detected: %v, %v", err, cache.Err())
+	}
+	_, err = cache.ReadAt(buf, 0)
+	if !errors.Is(err, ErrChanged) {
+		t.Errorf("outdated cache was used after remote change: %v", err)
+	}
+	_ = cache.Close()
+
+	cache = open()
+	t.Cleanup(func() { _ = cache.Close() })
+	_, err = cache.ReadAt(buf, 0)
+	if err != nil || buf[0] != 1 {
+		t.Errorf("outdated data after reopening: %v (%v)", buf, err)
+	}
+}
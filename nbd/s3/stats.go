@@ -0,0 +1,51 @@
+package s3
+
+import (
+	"sync/atomic"
+)
+
+// Cache usage statistics
+type Stats struct {
+	Hits   uint64 // reads served from local cache
+	Misses uint64 // reads that had to wait for remote storage
+
+	ChunksCached int    // chunks available in local cache
+	ChunksTotal  int    // chunks in the whole object
+	FetchedBytes uint64 // bytes downloaded from remote storage
+	Readahead    uint64 // chunks requested by sequential readahead
+
+	PeerBytes    uint64 // bytes received from other daemons
+	PeerRejected uint64 // chunks received from other daemons that failed verification
+
+	Verified  uint64 // chunks checked by integrity validation (background or strict mode)
+	Corrupted uint64 // chunks that failed integrity validation
+
+	QueueUsed int // remote connections in use by this object
+	QueueSize int // remote connection limit for this object
+}
+
+type cacheStats struct {
+	hits, misses        atomic.Uint64
+	fetched             atomic.Uint64
+	readahead           atomic.Uint64
+	peerFetched         atomic.Uint64
+	peerRejected        atomic.Uint64
+	verified, corrupted atomic.Uint64
+}
+
+// Snapshot of cache usage statistics
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		Hits:         c.stats.hits.Load(),
+		Misses:       c.stats.misses.Load(),
+		FetchedBytes: c.stats.fetched.Load(),
+		Readahead:    c.stats.readahead.Load(),
+		PeerBytes:    c.stats.peerFetched.Load(),
+		PeerRejected: c.stats.peerRejected.Load(),
+		Verified:     c.stats.verified.Load(),
+		Corrupted:    c.stats.corrupted.Load(),
+	}
+	stats.ChunksCached, stats.ChunksTotal = c.chunk.Count()
+	stats.QueueUsed, stats.QueueSize = c.queue.Occupancy()
+	return stats
+}
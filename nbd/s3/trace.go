@@ -0,0 +1,204 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sio/pond/nbd/logger"
+)
+
+// Boot trace: chunks in the order they were first read by clients during
+// a fixed time window after the first read.
+//
+// Trace is saved next to cached object and replayed the next time cache is
+// opened: listed chunks are fetched before anything else that is not
+// requested by clients. This warms up the chunks required to boot from
+// a freshly evicted or outdated cache in the order they will be needed.
+type bootTrace struct {
+	path     string
+	duration time.Duration
+	started  chan struct{} // closed on the first read
+	once     sync.Once
+
+	mu    sync.Mutex
+	done  bool
+	seen  map[chunk]struct{}
+	order []chunk
+}
+
+const (
+	traceSuffix  = ".trace"
+	traceVersion = "BootTraceV01" // always change this when file format is changed
+
+	// Maximum number of concurrent fetches while replaying boot trace
+	traceReplayConcurrency = 4
+)
+
+func newBootTrace(path string, duration time.Duration) *bootTrace {
+	return &bootTrace{
+		path:     path,
+		duration: duration,
+		started:  make(chan struct{}),
+		seen:     make(map[chunk]struct{}),
+	}
+}
+
+// Record client reads of the given chunks (inclusive)
+func (t *bootTrace) Record(first, last chunk) {
+	t.once.Do(func() { close(t.started) })
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	for part := first; part <= last; part++ {
+		if _, seen := t.seen[part]; seen {
+			continue
+		}
+		t.seen[part] = struct{}{}
+		t.order = append(t.order, part)
+	}
+}
+
+// Record trace until time window is over or context is cancelled,
+// then save it to disk
+func (t *bootTrace) Run(ctx context.Context, m *chunkMap) {
+	select {
+	case <-t.started:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-time.After(t.duration):
+	case <-ctx.Done():
+	}
+	t.mu.Lock()
+	t.done = true
+	order := t.order
+	t.mu.Unlock()
+	if len(order) == 0 {
+		return
+	}
+	log := logger.FromContext(ctx)
+	err := saveTrace(t.path, m, order)
+	if err != nil {
+		log.Error("saving boot trace", "path", t.path, "error", err)
+		return
+	}
+	log.Info("boot trace saved", "path", t.path, "chunks", len(order))
+}
+
+type traceHeader struct {
+	Version   [16]byte
+	TotalSize uint64
+	Revision  [sha256.Size]byte
+}
+
+// Trace entries are byte offsets: they remain valid if chunk size is changed
+func saveTrace(path string, m *chunkMap, order []chunk) error {
+	header := traceHeader{
+		TotalSize: m.size,
+		Revision:  m.revision,
+	}
+	copy(header.Version[:], traceVersion)
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.BigEndian, header)
+	if err != nil {
+		return err
+	}
+	for _, part := range order {
+		offset, _ := m.Offset(part)
+		err = binary.Write(&buf, binary.BigEndian, uint64(offset))
+		if err != nil {
+			return err
+		}
+	}
+	temp := path + ".new"
+	err = os.WriteFile(temp, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Load chunks listed in boot trace. Missing trace is not an error, outdated
+// one is ignored.
+func loadTrace(path string, m *chunkMap) ([]chunk, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(raw)
+	var header traceHeader
+	err = binary.Read(reader, binary.BigEndian, &header)
+	if err != nil {
+		return nil, fmt.Errorf("boot trace header: %w", err)
+	}
+	if string(bytes.TrimRight(header.Version[:], "\x00")) != traceVersion ||
+		header.TotalSize != m.size ||
+		header.Revision != m.revision {
+		return nil, nil
+	}
+	var order []chunk
+	seen := make(map[chunk]struct{})
+	for {
+		var offset uint64
+		err = binary.Read(reader, binary.BigEndian, &offset)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("boot trace: %w", err)
+		}
+		if offset >= m.size {
+			return nil, fmt.Errorf("boot trace: offset out of range: %d", offset)
+		}
+		part := m.Chunk(int64(offset))
+		if _, ok := seen[part]; ok {
+			continue
+		}
+		seen[part] = struct{}{}
+		order = append(order, part)
+	}
+	return order, nil
+}
+
+// Fetch chunks listed in boot trace in background.
+//
+// Client is expected to read these chunks soon, so replay uses normal
+// priority queue like client reads do. This also keeps bgFetchAll waiting
+// until replay is over.
+func (c *Cache) replayTrace(order []chunk) {
+	log := logger.FromContext(c.ctx)
+	log.Info("replaying boot trace", "chunks", len(order))
+	limit := make(chan struct{}, traceReplayConcurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, part := range order {
+		if c.chunk.Has(part) {
+			continue
+		}
+		select {
+		case limit <- struct{}{}:
+		case <-c.ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func(part chunk) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			_ = c.fetch(part, false) // errors are logged by fetch()
+		}(part)
+	}
+}
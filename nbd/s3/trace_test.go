@@ -0,0 +1,75 @@
+package s3
+
+import (
+	"testing"
+
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func TestBootTrace(t *testing.T) {
+	dir := t.TempDir()
+	cache := openTestCache(t, 8*minChunkSize, dir, Options{BootTrace: 50 * time.Millisecond})
+	reader := cache.Readahead()
+	buf := make([]byte, 10)
+	for _, offset := range []int64{3 * minChunkSize, minChunkSize, 3*minChunkSize + 1} {
+		_, err := reader.ReadAt(buf, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := cache.Path() + traceSuffix
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := os.Stat(path)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("boot trace was not saved: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err := reader.ReadAt(buf, 0) // too late to be recorded
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newChunkMap("", cache.Size(), 2*minChunkSize, cache.remote.Revision())
+	order, err := loadTrace(path, m)
+	if err != nil || len(order) != 2 || order[0] != 1 || order[1] != 0 {
+		t.Errorf("loading trace with another chunk size: got %v (%v), want [1 0]", order, err)
+	}
+	m = newChunkMap("", cache.Size(), minChunkSize, "another revision")
+	order, err = loadTrace(path, m)
+	if err != nil || len(order) != 0 {
+		t.Errorf("outdated trace was not ignored: got %v (%v)", order, err)
+	}
+}
+
+func TestBootTraceReplay(t *testing.T) {
+	dir := t.TempDir()
+	cache := openTestCache(t, 8*minChunkSize, dir, Options{})
+	order := []chunk{6, 2}
+	err := saveTrace(cache.Path()+traceSuffix, cache.chunk, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err = OpenWithOptions("file://"+filepath.Dir(cache.remote.(*fileRemote).file.Name()), "", "", "", "disk", "", dir, Options{
+		ChunkSize: minChunkSize,
+		BootTrace: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cache.Close() })
+	waitChunks(t, cache, order...)
+	if cache.chunk.Has(5) {
+		t.Errorf("chunk 5 was fetched but not listed in boot trace")
+	}
+}
@@ -0,0 +1,138 @@
+package s3
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sio/pond/nbd/logger"
+)
+
+// Strict mode state: chunks are verified against verity hash tree before
+// being marked as done (see Options.Strict)
+type strictMode struct {
+	// Cleared if hash tree can not be loaded, chunks are being fetched
+	// by that time already
+	enabled atomic.Bool
+
+	// Chunks fetched before verity hash tree was loaded
+	mu         sync.Mutex
+	unverified []chunk
+}
+
+// Verify freshly fetched chunk in strict mode.
+// Data is nil if chunk was written to local backend directly.
+func (c *Cache) verifyFetched(part chunk, data []byte) error {
+	if !c.strict.enabled.Load() {
+		return nil
+	}
+	if c.verity.Load() == nil {
+		c.strict.mu.Lock()
+		c.strict.unverified = append(c.strict.unverified, part)
+		c.strict.mu.Unlock()
+		return nil
+	}
+	offset, _ := c.chunk.Offset(part)
+	var source io.ReaderAt = c.local
+	if data != nil {
+		source = &bufferAt{data: data, offset: offset}
+	}
+	c.stats.verified.Add(1)
+	err := c.verifyChunk(source, part)
+	if err != nil {
+		c.stats.corrupted.Add(1)
+	}
+	return err
+}
+
+// Verify chunks that were fetched before verity hash tree was loaded
+// (e.g. the ones that contain verity superblock).
+// Corrupted chunks are dropped from local cache.
+func (c *Cache) verifyEarlyChunks() {
+	c.strict.mu.Lock()
+	parts := c.strict.unverified
+	c.strict.unverified = nil
+	c.strict.mu.Unlock()
+	log := logger.FromContext(c.ctx)
+	for _, part := range parts {
+		c.stats.verified.Add(1)
+		err := c.verifyChunk(c, part)
+		if err != nil {
+			log.Error("integrity verification failed", "chunk", part, "error", err)
+			c.chunk.Lost(part)
+			c.stats.corrupted.Add(1)
+		}
+	}
+}
+
+// Verify chunk that was cached before the current root hash was pinned
+// (see chunkMap.Distrust). Returns false if chunk needs to be fetched again.
+func (c *Cache) verifyCached(part chunk) bool {
+	if c.verity.Load() == nil {
+		return false // hash tree is being loaded, fetched chunks are verified later
+	}
+	c.stats.verified.Add(1)
+	err := c.verifyChunk(c.local, part)
+	if err != nil {
+		log := logger.FromContext(c.ctx)
+		log.Error("cached chunk failed verification", "chunk", part, "error", err)
+		c.stats.corrupted.Add(1)
+	}
+	c.chunk.Verified(part, err == nil)
+	return err == nil
+}
+
+// Verify data region of a chunk against verity hash tree.
+// Chunk is read from source (using absolute offsets), the rest of hash tree
+// is read from cache. Chunks outside of data region are not verified.
+func (c *Cache) verifyChunk(source io.ReaderAt, part chunk) error {
+	checksum := c.verity.Load()
+	if checksum == nil {
+		return fmt.Errorf("verity hash tree is not available")
+	}
+	offset, size := c.chunk.Offset(part)
+	if offset >= checksum.DataSize() {
+		return nil
+	}
+	// The last data chunk may also hold verity superblock and hash tree:
+	// those must be read from source too, reading them from cache would
+	// wait for this very chunk to be done
+	pending := &pendingChunk{cache: c, source: source, offset: offset, size: int64(size)}
+	size = int(min(int64(size), checksum.DataSize()-offset))
+	return checksum.Verify(pending, offset, size)
+}
+
+// Chunk that is not marked as done yet: chunk contents are read from source,
+// everything else (verity hash tree) is read from cache
+type pendingChunk struct {
+	cache  *Cache
+	source io.ReaderAt
+	offset int64
+	size   int64
+}
+
+func (r *pendingChunk) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= r.offset && offset < r.offset+r.size {
+		return r.source.ReadAt(p[:min(int64(len(p)), r.offset+r.size-offset)], offset)
+	}
+	return r.cache.ReadAt(p, offset)
+}
+
+// In-memory chunk data addressed by absolute offsets
+type bufferAt struct {
+	data   []byte
+	offset int64
+}
+
+func (b *bufferAt) ReadAt(p []byte, offset int64) (int, error) {
+	start := offset - b.offset
+	if start < 0 || start >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[start:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
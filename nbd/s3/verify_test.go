@@ -0,0 +1,294 @@
+package s3
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Test image is smaller than the smallest supported chunk
+const verityChunkSize = 16 << 10
+
+// Cache over squashfs image with verity hash tree, wrap is applied to remote
+// object (optional). Verity hash tree is not loaded.
+func verityTestCache(t *testing.T, wrap func(remoteInterface) remoteInterface) (c *Cache, original []byte) {
+	t.Helper()
+	const path = "../verity/testdata/pseudorandom.squashfs"
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := openFileRemote(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrap != nil {
+		remote = wrap(remote)
+	}
+	c = &Cache{
+		remote: remote,
+		chunk:  newChunkMap("", remote.Size(), verityChunkSize, remote.Revision()),
+		goro:   new(sync.WaitGroup),
+	}
+	c.ctx, c.cancel = context.WithCancelCause(context.Background())
+	c.queue = NewQueue(c.ctx, connLimitPerObject)
+	c.local = newMemoryBackend(remote.Size(), verityChunkSize, c.chunk.Lost)
+	t.Cleanup(func() { _ = c.Close() })
+	return c, original
+}
+
+// Remote object that returns corrupted data a few times
+type corruptRemote struct {
+	remoteInterface
+	failures atomic.Int32
+}
+
+func (r *corruptRemote) Reader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	reader, err := r.remoteInterface.Reader(ctx, offset, length)
+	if err != nil || r.failures.Add(-1) < 0 {
+		return reader, err
+	}
+	data, err := io.ReadAll(reader)
+	_ = reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	data[len(data)/2] ^= 0xff
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestStrictMode(t *testing.T) {
+	remote := new(corruptRemote)
+	c, original := verityTestCache(t, func(r remoteInterface) remoteInterface {
+		remote.remoteInterface = r
+		return remote
+	})
+	c.strict.enabled.Store(true)
+
+	// Chunk with squashfs superblock is fetched before verity hash tree is available
+	remote.failures.Store(1)
+	_, err := c.loadVerity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.verifyEarlyChunks()
+	if c.chunk.Has(0) || c.Stats().Corrupted != 1 {
+		t.Errorf("corrupted chunk was not dropped after loading verity: %+v", c.Stats())
+	}
+
+	for _, tt := range []struct {
+		part     chunk
+		failures int32
+		ok       bool
+	}{
+		{part: 0, failures: 0, ok: true},
+		{part: 2, failures: strictRetries - 1, ok: true},
+		{part: 3, failures: strictRetries, ok: false},
+	} {
+		remote.failures.Store(tt.failures)
+		err = c.fetch(tt.part, false)
+		if (err == nil) != tt.ok || c.chunk.Has(tt.part) != tt.ok {
+			t.Errorf("chunk %d with %d failures: fetch error %v", tt.part, tt.failures, err)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		offset, size := c.chunk.Offset(tt.part)
+		got := make([]byte, size)
+		_, err = c.ReadCached(got, offset)
+		if err != nil || !bytes.Equal(got, original[offset:offset+int64(size)]) {
+			t.Errorf("chunk %d: data mismatch (%v)", tt.part, err)
+		}
+	}
+	if got := c.Stats().Corrupted; got != 1+strictRetries-1+strictRetries {
+		t.Errorf("unexpected number of corrupted chunks: %d", got)
+	}
+
+	// The last data chunk also holds verity superblock and hash tree
+	last := c.chunk.Chunk(c.verity.Load().DataSize() - 1)
+	if err = refetch(c, last); err != nil {
+		t.Errorf("chunk %d with hash tree: %v", last, err)
+	}
+}
+
+// Evict chunk from local cache and fetch it again.
+// Gives up instead of hanging if fetch never returns.
+func refetch(c *Cache, part chunk) error {
+	c.chunk.Lost(part)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.fetch(part, false)
+	}()
+	select {
+	case err := <-done:
+		if err == nil && !c.chunk.Has(part) {
+			err = fmt.Errorf("chunk was not marked as done")
+		}
+		return err
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("fetch did not return in time")
+	}
+}
+
+func TestRootHash(t *testing.T) {
+	root, _ := hex.DecodeString("7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f4")
+
+	c, _ := verityTestCache(t, nil)
+	c.rootHash = bytes.Clone(root)
+	root[0] ^= 1 // does not affect the cache
+	c.strict.enabled.Store(true)
+	checksum, err := c.loadVerity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checksum.Pinned() {
+		t.Fatal("verity hash tree is not pinned to root hash")
+	}
+	last := c.chunk.Chunk(checksum.DataSize() - 1)
+	for part := chunk(0); part <= last; part++ {
+		err = c.fetch(part, false)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", part, err)
+		}
+	}
+	for _, part := range []chunk{last, 0} {
+		if err = refetch(c, part); err != nil {
+			t.Errorf("chunk %d fetched again: %v", part, err)
+		}
+	}
+
+	c, _ = verityTestCache(t, nil)
+	c.rootHash = root
+	_, err = c.loadVerity()
+	if err == nil {
+		t.Fatal("wrong root hash was accepted")
+	}
+}
+
+func TestHashObject(t *testing.T) {
+	image, err := os.ReadFile("../verity/testdata/pseudorandom.squashfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := hex.DecodeString("7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f4")
+	const dataSize = 49 * 4096 // see verity/testdata/pseudorandom.verity
+	remote := t.TempDir()
+	err = os.WriteFile(filepath.Join(remote, "disk"), image[:dataSize], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(remote, "disk.verity"), image[dataSize:], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(hashes string) (*Cache, error) {
+		return OpenWithOptions("file://"+remote, "", "", "", "disk", "", "", Options{
+			Mode:       ModeMemory,
+			ChunkSize:  minChunkSize,
+			RootHash:   root,
+			HashObject: hashes,
+		})
+	}
+
+	c, err := open("disk.verity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if !c.strict.enabled.Load() || c.verity.Load() == nil {
+		t.Fatal("hash tree was not loaded from hash object")
+	}
+	got := make([]byte, dataSize)
+	_, err = c.ReadAt(got, 0)
+	if err != nil || !bytes.Equal(got, image[:dataSize]) {
+		t.Fatalf("data mismatch (%v)", err)
+	}
+
+	_, err = open("missing.verity")
+	if err == nil {
+		t.Fatal("data object without hash tree was accepted")
+	}
+}
+
+func TestRootHashCached(t *testing.T) {
+	image, err := os.ReadFile("../verity/testdata/pseudorandom.squashfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := hex.DecodeString("7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f4")
+	const dataSize = 49 * 4096 // see verity/testdata/pseudorandom.verity
+	remote := t.TempDir()
+	err = os.WriteFile(filepath.Join(remote, "disk"), image[:dataSize], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(remote, "disk.verity"), image[dataSize:], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, corrupt := range []bool{false, true} {
+		t.Run(fmt.Sprintf("corrupt=%v", corrupt), func(t *testing.T) {
+			localdir := t.TempDir()
+			read := func(c *Cache) {
+				t.Helper()
+				got := make([]byte, dataSize)
+				_, err := c.ReadAt(got, 0)
+				if err != nil || !bytes.Equal(got, image[:dataSize]) {
+					t.Fatalf("data mismatch (%v)", err)
+				}
+			}
+
+			// Chunks cached without root hash are not verified
+			c, err := OpenWithOptions("file://"+remote, "", "", "", "disk", "", localdir, Options{ChunkSize: minChunkSize})
+			if err != nil {
+				t.Fatal(err)
+			}
+			read(c)
+			err = c.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if corrupt {
+				file, err := os.OpenFile(filepath.Join(localdir, "disk"), os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = file.WriteAt([]byte("corrupted"), 5*4096)
+				_ = file.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Pinned root hash requires verifying them before use
+			c, err = OpenWithOptions("file://"+remote, "", "", "", "disk", "", localdir, Options{
+				ChunkSize:  minChunkSize,
+				RootHash:   root,
+				HashObject: "disk.verity",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = c.Close() }()
+			read(c)
+			stats := c.Stats()
+			if stats.Verified == 0 {
+				t.Errorf("cached chunk was not verified")
+			}
+			fetched := c.stats.fetched.Load() != 0
+			if fetched != corrupt {
+				t.Errorf("cached chunk fetched again: %v, want %v", fetched, corrupt)
+			}
+		})
+	}
+}
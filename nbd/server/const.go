@@ -6,10 +6,13 @@ import "fmt"
 //	https://github.com/NetworkBlockDevice/nbd/blob/f8d7d3dbf1ef2ef84c92fe375ebc8674a79e25c2/doc/proto.md
 
 const (
-	NBDMAGIC               uint64 = 0x4e42444d41474943
-	IHAVEOPT               uint64 = 0x49484156454F5054
-	NBD_REQUEST_MAGIC      uint32 = 0x25609513
-	NBD_SIMPLE_REPLY_MAGIC uint32 = 0x67446698
+	NBDMAGIC                   uint64 = 0x4e42444d41474943
+	IHAVEOPT                   uint64 = 0x49484156454F5054
+	NBD_REQUEST_MAGIC          uint32 = 0x25609513
+	NBD_SIMPLE_REPLY_MAGIC     uint32 = 0x67446698
+	NBD_STRUCTURED_REPLY_MAGIC uint32 = 0x668e33ef
+	NBD_EXTENDED_REQUEST_MAGIC uint32 = 0x21e41c71
+	NBD_EXTENDED_REPLY_MAGIC   uint32 = 0x6e8a278c
 )
 
 type handshakeFlag uint16
@@ -30,10 +33,14 @@ func (f transmissionFlag) String() string {
 }
 
 const (
-	NBD_FLAG_HAS_FLAGS      transmissionFlag = 1 << 0
-	NBD_FLAG_READ_ONLY      transmissionFlag = 1 << 1
-	NBD_FLAG_CAN_MULTI_CONN transmissionFlag = 1 << 8
-	NBD_FLAG_SEND_CACHE     transmissionFlag = 1 << 10
+	NBD_FLAG_HAS_FLAGS         transmissionFlag = 1 << 0
+	NBD_FLAG_READ_ONLY         transmissionFlag = 1 << 1
+	NBD_FLAG_SEND_FLUSH        transmissionFlag = 1 << 2
+	NBD_FLAG_SEND_FUA          transmissionFlag = 1 << 3
+	NBD_FLAG_SEND_TRIM         transmissionFlag = 1 << 5
+	NBD_FLAG_SEND_WRITE_ZEROES transmissionFlag = 1 << 6
+	NBD_FLAG_CAN_MULTI_CONN    transmissionFlag = 1 << 8
+	NBD_FLAG_SEND_CACHE        transmissionFlag = 1 << 10
 )
 
 type optionType uint32
@@ -43,13 +50,16 @@ func (o optionType) String() string {
 }
 
 const (
-	NBD_OPT_EXPORT_NAME      optionType = 1
-	NBD_OPT_ABORT            optionType = 2
-	NBD_OPT_LIST             optionType = 3
-	NBD_OPT_STARTTLS         optionType = 5
-	NBD_OPT_INFO             optionType = 6
-	NBD_OPT_GO               optionType = 7
-	NBD_OPT_STRUCTURED_REPLY optionType = 8
+	NBD_OPT_EXPORT_NAME       optionType = 1
+	NBD_OPT_ABORT             optionType = 2
+	NBD_OPT_LIST              optionType = 3
+	NBD_OPT_STARTTLS          optionType = 5
+	NBD_OPT_INFO              optionType = 6
+	NBD_OPT_GO                optionType = 7
+	NBD_OPT_STRUCTURED_REPLY  optionType = 8
+	NBD_OPT_LIST_META_CONTEXT optionType = 9
+	NBD_OPT_SET_META_CONTEXT  optionType = 10
+	NBD_OPT_EXTENDED_HEADERS  optionType = 11
 )
 
 type optionReply uint32
@@ -66,6 +76,7 @@ const (
 	NBD_REP_ACK                 optionReply = 1
 	NBD_REP_SERVER              optionReply = 2
 	NBD_REP_INFO                optionReply = 3
+	NBD_REP_META_CONTEXT        optionReply = 4
 	nbd_rep_error               optionReply = (1 << 31)
 	NBD_REP_ERR_UNSUP           optionReply = nbd_rep_error + 1
 	NBD_REP_ERR_POLICY          optionReply = nbd_rep_error + 2
@@ -109,11 +120,13 @@ func (r replyType) String() string {
 }
 
 const (
-	NBD_REPLY_TYPE_NONE         replyType = 0
-	NBD_REPLY_TYPE_OFFSET_DATA  replyType = 1
-	NBD_REPLY_TYPE_OFFSET_HOLE  replyType = 2
-	NBD_REPLY_TYPE_ERROR        replyType = (1 << 15) + 1
-	NBD_REPLY_TYPE_ERROR_OFFSET replyType = (1 << 15) + 2
+	NBD_REPLY_TYPE_NONE             replyType = 0
+	NBD_REPLY_TYPE_OFFSET_DATA      replyType = 1
+	NBD_REPLY_TYPE_OFFSET_HOLE      replyType = 2
+	NBD_REPLY_TYPE_BLOCK_STATUS     replyType = 5
+	NBD_REPLY_TYPE_BLOCK_STATUS_EXT replyType = 6
+	NBD_REPLY_TYPE_ERROR            replyType = (1 << 15) + 1
+	NBD_REPLY_TYPE_ERROR_OFFSET     replyType = (1 << 15) + 2
 )
 
 type requestType uint16
@@ -123,10 +136,30 @@ func (r requestType) String() string {
 }
 
 const (
-	NBD_CMD_READ  requestType = 0
-	NBD_CMD_WRITE requestType = 1
-	NBD_CMD_DISC  requestType = 2
-	NBD_CMD_CACHE requestType = 5
+	NBD_CMD_READ         requestType = 0
+	NBD_CMD_WRITE        requestType = 1
+	NBD_CMD_DISC         requestType = 2
+	NBD_CMD_FLUSH        requestType = 3
+	NBD_CMD_TRIM         requestType = 4
+	NBD_CMD_CACHE        requestType = 5
+	NBD_CMD_WRITE_ZEROES requestType = 6
+	NBD_CMD_BLOCK_STATUS requestType = 7
+)
+
+func (f requestFlag) String() string {
+	return fmt.Sprintf("NBD command flag: %016b", f)
+}
+
+const (
+	NBD_CMD_FLAG_FUA     requestFlag = 1 << 0
+	NBD_CMD_FLAG_NO_HOLE requestFlag = 1 << 1
+	NBD_CMD_FLAG_REQ_ONE requestFlag = 1 << 3
+)
+
+// Status flags for base:allocation metadata context
+const (
+	NBD_STATE_HOLE uint32 = 1 << 0
+	NBD_STATE_ZERO uint32 = 1 << 1
 )
 
 type nbdError uint32
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resource limits for NBD clients. Zero values mean no limit.
+type Limits struct {
+	// Maximum number of simultaneous client connections (for all listeners).
+	// Connections above the limit are closed right after being accepted.
+	Connections int
+
+	// Maximum number of commands processed concurrently for a single
+	// connection. Server stops receiving new commands from the client until
+	// some of the in-flight ones are complete.
+	InFlight int
+
+	// Maximum number of backend operations processed concurrently for all
+	// clients. When the limit is reached, pending operations are admitted
+	// in round-robin order between clients.
+	Backend int
+
+	// Disconnect clients that have not sent any commands for this long.
+	// Also limits the time spent in handshake and negotiation phases.
+	IdleTimeout time.Duration
+}
+
+// Apply resource limits to client connections.
+// Must be called before starting any listeners.
+func (s *Server) SetLimits(limits Limits) {
+	s.limits = limits
+	s.connSlots = nil
+	if limits.Connections > 0 {
+		s.connSlots = make(chan struct{}, limits.Connections)
+	}
+	s.sched = nil
+	if limits.Backend > 0 {
+		s.sched = newScheduler(limits.Backend)
+	}
+}
+
+// Fair share scheduler for backend operations.
+//
+// Operations are admitted immediately while there is spare capacity. After
+// that pending operations are queued per client and clients take turns:
+// a greedy client with hundreds of pending reads gets the same share of
+// capacity as another one with a single pending read.
+type scheduler struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	pending map[string][]*ticket // FIFO queue for each client
+	turn    []string             // clients with pending operations, in order of service
+}
+
+type ticket struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newScheduler(limit int) *scheduler {
+	return &scheduler{
+		limit:   limit,
+		pending: make(map[string][]*ticket),
+	}
+}
+
+// Wait for the turn of the given client. Nil scheduler admits everything.
+// Release() must be called after each successful Acquire().
+func (s *scheduler) Acquire(ctx context.Context, client string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if s.running < s.limit && len(s.turn) == 0 {
+		s.running++
+		s.mu.Unlock()
+		return nil
+	}
+	t := &ticket{ready: make(chan struct{})}
+	if len(s.pending[client]) == 0 {
+		s.turn = append(s.turn, client)
+	}
+	s.pending[client] = append(s.pending[client], t)
+	s.mu.Unlock()
+
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.granted {
+		// Lost the race with dispatch, give our slot to someone else
+		s.running--
+		s.dispatch()
+		return context.Cause(ctx)
+	}
+	queue := s.pending[client]
+	for i := range queue {
+		if queue[i] == t {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	s.pending[client] = queue
+	if len(queue) == 0 {
+		delete(s.pending, client)
+		for i := range s.turn {
+			if s.turn[i] == client {
+				s.turn = append(s.turn[:i], s.turn[i+1:]...)
+				break
+			}
+		}
+	}
+	return context.Cause(ctx)
+}
+
+// Free the slot taken by Acquire()
+func (s *scheduler) Release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.dispatch()
+}
+
+// Admit pending operations round-robin. Must be called with mutex held.
+func (s *scheduler) dispatch() {
+	for s.running < s.limit && len(s.turn) > 0 {
+		client := s.turn[0]
+		s.turn = s.turn[1:]
+		queue := s.pending[client]
+		t := queue[0]
+		queue = queue[1:]
+		if len(queue) > 0 {
+			s.pending[client] = queue
+			s.turn = append(s.turn, client) // back of the line
+		} else {
+			delete(s.pending, client)
+		}
+		t.granted = true
+		close(t.ready)
+		s.running++
+	}
+}
+
+// Scheduling key: clients are identified by their keys if available,
+// otherwise by network address without port number (multiple connections
+// from the same host share the same turn). Connections without such address
+// (e.g. over unix sockets) get a turn each.
+func (c Client) schedulingKey() string {
+	if c.Fingerprint != "" {
+		return c.Fingerprint
+	}
+	if c.Addr != nil && c.Addr.Network() != "unix" {
+		host, _, err := net.SplitHostPort(c.Addr.String())
+		if err == nil {
+			return host
+		}
+	}
+	return fmt.Sprintf("#%d", c.conn)
+}
+
+// Connection counter, see Client.conn
+var connections atomic.Uint64
+
+// Backend calls made on behalf of a single client connection.
+//
+// Each call is admitted by fair scheduler. Scheduler slots are not held while
+// replies are being sent: clients that do not read their replies must not be
+// able to starve others.
+type scheduledBackend struct {
+	Backend
+	sched *scheduler
+	ctx   context.Context
+	turn  string
+}
+
+func (b *scheduledBackend) ReadAt(p []byte, offset int64) (int, error) {
+	err := b.sched.Acquire(b.ctx, b.turn)
+	if err != nil {
+		return 0, err
+	}
+	defer b.sched.Release()
+	return b.Backend.ReadAt(p, offset)
+}
+
+// Backends that do not implement BlockStatuser report no metadata contexts
+func (b *scheduledBackend) MetaContexts() []string {
+	status, ok := b.Backend.(BlockStatuser)
+	if !ok {
+		return nil
+	}
+	return status.MetaContexts()
+}
+
+func (b *scheduledBackend) BlockStatus(context string, offset, length int64) ([]Extent, error) {
+	err := b.sched.Acquire(b.ctx, b.turn)
+	if err != nil {
+		return nil, err
+	}
+	defer b.sched.Release()
+	return b.Backend.(BlockStatuser).BlockStatus(context, offset, length)
+}
+
+var _ BlockStatuser = new(scheduledBackend)
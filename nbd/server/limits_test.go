@@ -0,0 +1,168 @@
+package server
+
+import (
+	"testing"
+
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+func TestSchedulerFairness(t *testing.T) {
+	ctx := context.Background()
+	sched := newScheduler(1)
+	err := sched.Acquire(ctx, "greedy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		order []string
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+	)
+	enqueue := func(client string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := sched.Acquire(ctx, client)
+			if err != nil {
+				t.Errorf("acquire: %v", err)
+				return
+			}
+			mu.Lock()
+			order = append(order, client)
+			mu.Unlock()
+			sched.Release()
+		}()
+		// Wait until the ticket is queued
+		for {
+			sched.mu.Lock()
+			queued := len(sched.pending[client])
+			sched.mu.Unlock()
+			if queued > 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		enqueue("greedy")
+	}
+	enqueue("modest")
+
+	// Cancelled tickets do not occupy the queue
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = sched.Acquire(cancelled, "impatient")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquire with cancelled context: %v", err)
+	}
+
+	sched.Release()
+	wg.Wait()
+	got := strings.Join(order, ",")
+	if got != "greedy,modest,greedy,greedy" {
+		t.Errorf("unfair scheduling order: %s", got)
+	}
+	if sched.running != 0 || len(sched.turn) != 0 || len(sched.pending) != 0 {
+		t.Errorf("scheduler state not clean: running=%d, turn=%v, pending=%v", sched.running, sched.turn, sched.pending)
+	}
+}
+
+func TestSchedulingKey(t *testing.T) {
+	tcp := func(port int) net.Addr {
+		return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}
+	}
+	unix := &net.UnixAddr{Net: "unix"}
+	for _, tt := range []struct {
+		a, b Client
+		same bool
+	}{
+		{a: Client{Addr: tcp(1000), conn: 1}, b: Client{Addr: tcp(2000), conn: 2}, same: true},
+		{a: Client{Addr: tcp(1000), conn: 1}, b: Client{Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1000}, conn: 2}},
+		{a: Client{Addr: tcp(1000), Fingerprint: "SHA256:a", conn: 1}, b: Client{Addr: tcp(1000), Fingerprint: "SHA256:b", conn: 2}},
+		{a: Client{Addr: tcp(1000), Fingerprint: "SHA256:a", conn: 1}, b: Client{Addr: unix, Fingerprint: "SHA256:a", conn: 2}, same: true},
+		{a: Client{Addr: unix, conn: 1}, b: Client{Addr: unix, conn: 2}},
+		{a: Client{conn: 1}, b: Client{conn: 2}},
+	} {
+		a, b := tt.a.schedulingKey(), tt.b.schedulingKey()
+		if (a == b) != tt.same {
+			t.Errorf("%s and %s: scheduling keys %q and %q, want same=%v", tt.a, tt.b, a, b, tt.same)
+		}
+	}
+}
+
+func TestBackendLimitSlowReader(t *testing.T) {
+	srv := New(context.Background(), func(Client, string) (Backend, error) {
+		return &flakyBackend{size: 1 << 20, fail: -1}, nil
+	})
+	srv.SetLimits(Limits{Backend: 1})
+
+	// Client that never reads its replies
+	stuck := connectServer(t, srv)
+	stuck.option(NBD_OPT_GO, exportName("stuck"))
+	stuck.request(NBD_CMD_READ, 1, 0, 1<<20)
+	time.Sleep(100 * time.Millisecond) // let it get stuck sending the reply
+
+	client := connectServer(t, srv)
+	client.option(NBD_OPT_GO, exportName("client"))
+	_ = client.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	client.request(NBD_CMD_READ, 1, 0, 4096)
+	var reply replyHeader
+	client.receive(&reply, make([]byte, 4096))
+	if reply.Error != 0 {
+		t.Fatalf("read failed: %v", reply.Error)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := New(context.Background(), func(Client, string) (Backend, error) {
+		return &flakyBackend{size: 1 << 20, fail: -1}, nil
+	})
+	srv.SetLimits(Limits{IdleTimeout: 100 * time.Millisecond})
+	client := connectServer(t, srv)
+	client.option(NBD_OPT_GO, exportName("idle"))
+	client.request(NBD_CMD_READ, 1, 0, 10)
+	var reply replyHeader
+	client.receive(&reply, make([]byte, 10))
+
+	start := time.Now()
+	_, err := client.conn.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("idle connection was not closed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("idle connection closed too late: %s", elapsed)
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	srv := New(context.Background(), nil)
+	srv.SetLimits(Limits{Connections: 1})
+
+	first, firstServer := net.Pipe()
+	t.Cleanup(func() { _ = first.Close() })
+	srv.conn.Add(1)
+	go srv.handleConnection(firstServer)
+	_ = first.SetDeadline(time.Now().Add(10 * time.Second))
+	hello := make([]byte, 18)
+	_, err := io.ReadFull(first, hello)
+	if err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+
+	second, secondServer := net.Pipe()
+	t.Cleanup(func() { _ = second.Close() })
+	srv.conn.Add(1)
+	go srv.handleConnection(secondServer)
+	_ = second.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(second, hello)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("connection above the limit was not refused: %v", err)
+	}
+}
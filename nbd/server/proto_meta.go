@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Metadata context that is supported for all exports. Backends that do not
+// implement it via BlockStatuser are reported as fully allocated.
+const metaContextAllocation = "base:allocation"
+
+// Optional Backend interface for NBD_CMD_BLOCK_STATUS
+type BlockStatuser interface {
+	// Names of supported metadata contexts ("namespace:leaf")
+	MetaContexts() []string
+
+	// Describe a byte range in terms of the given metadata context.
+	// Extents must be contiguous, start at offset and cover no more than
+	// length bytes.
+	BlockStatus(context string, offset, length int64) ([]Extent, error)
+}
+
+// Contiguous byte range with the same status flags
+type Extent struct {
+	Length int64
+	Flags  uint32
+}
+
+// Metadata contexts available for the export
+func metaContexts(backend Backend) []string {
+	contexts := []string{metaContextAllocation}
+	if b, ok := backend.(BlockStatuser); ok {
+		for _, name := range b.MetaContexts() {
+			if !slices.Contains(contexts, name) {
+				contexts = append(contexts, name)
+			}
+		}
+	}
+	return contexts
+}
+
+// Select metadata contexts matching client queries.
+//
+// NBD_OPT_LIST_META_CONTEXT may use an empty list of queries to request all
+// contexts, or a namespace followed by colon to request all contexts from that
+// namespace.
+func matchMetaContexts(available []string, queries []string, list bool) []string {
+	if list && len(queries) == 0 {
+		return available
+	}
+	var matched []string
+	for _, query := range queries {
+		for _, name := range available {
+			if slices.Contains(matched, name) {
+				continue
+			}
+			if name == query || (list && strings.HasSuffix(query, ":") && strings.HasPrefix(name, query)) {
+				matched = append(matched, name)
+			}
+		}
+	}
+	return matched
+}
+
+// Payload of NBD_OPT_LIST_META_CONTEXT and NBD_OPT_SET_META_CONTEXT
+type metaContextRequest struct {
+	export  string
+	queries []string
+}
+
+func parseMetaContextRequest(buf []byte) (request metaContextRequest, err error) {
+	payload := bytes.NewReader(buf)
+	readString := func() (string, error) {
+		var length uint32
+		err := receive(payload, &length)
+		if err != nil {
+			return "", err
+		}
+		if int64(length) > int64(payload.Len()) {
+			return "", fmt.Errorf("string length exceeds payload size: %d", length)
+		}
+		str := make([]byte, length)
+		err = receive(payload, str)
+		return string(str), err
+	}
+	request.export, err = readString()
+	if err != nil {
+		return request, fmt.Errorf("export name: %w", err)
+	}
+	var count uint32
+	err = receive(payload, &count)
+	if err != nil {
+		return request, fmt.Errorf("number of queries: %w", err)
+	}
+	for i := uint32(0); i < count; i++ {
+		query, err := readString()
+		if err != nil {
+			return request, fmt.Errorf("query #%d: %w", i+1, err)
+		}
+		request.queries = append(request.queries, query)
+	}
+	if payload.Len() != 0 {
+		return request, fmt.Errorf("unexpected trailing data: %d bytes", payload.Len())
+	}
+	return request, nil
+}
+
+// Describe a byte range in terms of a single metadata context
+func blockStatus(backend Backend, context string, offset, length int64) ([]Extent, error) {
+	b, ok := backend.(BlockStatuser)
+	if !ok || !slices.Contains(b.MetaContexts(), context) {
+		if context == metaContextAllocation {
+			return []Extent{{Length: length}}, nil
+		}
+		return nil, fmt.Errorf("unsupported metadata context: %s", context)
+	}
+	extents, err := b.BlockStatus(context, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	// Protect the client from misbehaving backends
+	var total int64
+	for i, extent := range extents {
+		if extent.Length <= 0 {
+			return nil, fmt.Errorf("%s: invalid extent length: %d", context, extent.Length)
+		}
+		total += extent.Length
+		if total >= length {
+			extents = extents[:i+1]
+			extents[i].Length -= total - length
+			break
+		}
+	}
+	if len(extents) == 0 {
+		return nil, fmt.Errorf("%s: no extents returned", context)
+	}
+	return extents, nil
+}
+
+// NBD_REPLY_TYPE_BLOCK_STATUS payload
+type blockDescriptor struct {
+	Length uint32
+	Flags  uint32
+}
+
+// NBD_REPLY_TYPE_BLOCK_STATUS_EXT payload
+type extendedBlockDescriptor struct {
+	Length uint64
+	Flags  uint64
+}
@@ -3,12 +3,17 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"slices"
 
 	"github.com/sio/pond/nbd/buffer"
+	"github.com/sio/pond/nbd/certs"
+	"github.com/sio/pond/nbd/logger"
 )
 
 // Send arbitrary objects over given connection
@@ -69,7 +74,7 @@ func handshake(conn io.ReadWriter) error {
 }
 
 // NBD Negotiation Phase
-func negotiate(ctx context.Context, conn io.ReadWriter, export func(name string) (Backend, error)) (Backend, error) {
+func (s *Server) negotiate(ctx context.Context, conn net.Conn) (*session, error) {
 	reply := func(t optionType, r optionReply, data ...any) error {
 		var d []byte
 		if len(data) != 0 {
@@ -99,6 +104,21 @@ func negotiate(ctx context.Context, conn io.ReadWriter, export func(name string)
 		)
 	}
 
+	var state = &session{
+		conn:   conn,
+		client: Client{Addr: conn.RemoteAddr(), conn: connections.Add(1)},
+		size:   -1,
+	}
+
+	// Backend that was obtained for NBD_OPT_GO/NBD_OPT_INFO but was not
+	// passed to transmission phase yet
+	var pending Backend
+	defer func() {
+		if pending != nil {
+			release(pending)
+		}
+	}()
+
 	for {
 		var option struct {
 			Magic uint64
@@ -122,6 +142,23 @@ func negotiate(ctx context.Context, conn io.ReadWriter, export func(name string)
 		default:
 		}
 
+		if s.tlsRequired && !state.tls {
+			switch option.Type {
+			case NBD_OPT_STARTTLS, NBD_OPT_ABORT, NBD_OPT_EXPORT_NAME:
+				// these options are allowed before TLS handshake
+			default:
+				err = discard(conn, int(option.Len))
+				if err != nil {
+					return nil, err
+				}
+				err = reply(option.Type, NBD_REP_ERR_TLS_REQD, []byte("this server requires TLS\x00"))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
 		switch option.Type {
 
 		case NBD_OPT_GO, NBD_OPT_INFO:
@@ -136,7 +173,16 @@ func negotiate(ctx context.Context, conn io.ReadWriter, export func(name string)
 				}
 				continue
 			}
-			backend, err := negotiateBackend(conn, export, option.Len)
+			backend, name, requested, err := negotiateBackend(conn, s.export, state.client, option.Len)
+			if errors.Is(err, ErrForbidden) {
+				log := logger.FromContext(ctx)
+				log.Warn("export access denied", "error", err)
+				err = reply(option.Type, NBD_REP_ERR_POLICY, []byte("access to requested export is denied\x00"))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
 			if err != nil {
 				ereply := reply(option.Type, NBD_REP_ERR_UNKNOWN, []byte("requested export is not available\x00"))
 				if ereply != nil {
@@ -144,37 +190,318 @@ func negotiate(ctx context.Context, conn io.ReadWriter, export func(name string)
 				}
 				return nil, err
 			}
+			pending = backend
+
+			// Use an obviously bogus number for export size to make sure
+			// no one confuses it for a real one.
+			// Value of one exabyte also shows up nicely as 1E in lsblk
+			// hinting that it might be an (E)rror.
+			var size int64 = 1 << 60
+			if sizer, ok := backend.(Sizer); ok {
+				size = sizer.Size()
+			}
+
+			flag := NBD_FLAG_HAS_FLAGS |
+				NBD_FLAG_READ_ONLY |
+				NBD_FLAG_CAN_MULTI_CONN
+			if _, ok := backend.(Writable); ok {
+				flag &^= NBD_FLAG_READ_ONLY
+				flag |= NBD_FLAG_SEND_FLUSH |
+					NBD_FLAG_SEND_FUA |
+					NBD_FLAG_SEND_TRIM |
+					NBD_FLAG_SEND_WRITE_ZEROES
+			}
+			if _, ok := backend.(Prefetcher); ok {
+				flag |= NBD_FLAG_SEND_CACHE
+			}
 
-			// Ignore all information requests sent by client,
-			// always send the same set of information replies.
+			// Always send the same set of information replies,
+			// only check client requests to see if it supports
+			// block size constraints.
 			err = reply(option.Type, NBD_REP_INFO, struct {
 				info infoType
 				size uint64
 				flag transmissionFlag
 			}{
 				info: NBD_INFO_EXPORT,
-				flag: NBD_FLAG_HAS_FLAGS |
-					NBD_FLAG_READ_ONLY |
-					NBD_FLAG_CAN_MULTI_CONN |
-					NBD_FLAG_SEND_CACHE,
-				// Use an obviously bogus number for export size to make sure
-				// no one confuses it for a real one.
-				// Value of one exabyte also shows up nicely as 1E in lsblk
-				// hinting that it might be an (E)rror.
-				size: 1 << 60, // TODO: pass real export size here somehow?
+				flag: flag,
+				size: uint64(size),
 			})
 			if err != nil {
 				return nil, fmt.Errorf("NBD_INFO_EXPORT: %w", err)
 			}
-			// TODO: send NBD_INFO_BLOCK_SIZE with prefered block size = BufferSize
+			if bs, ok := backend.(BlockSizer); ok {
+				minimum, preferred, maximum := bs.BlockSize()
+				if minimum > 1 && option.Type == NBD_OPT_GO && !slices.Contains(requested, NBD_INFO_BLOCK_SIZE) {
+					release(backend)
+					pending = nil
+					err = reply(option.Type, NBD_REP_ERR_BLOCK_SIZE_REQD, []byte("client must obey block size constraints\x00"))
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+				err = reply(option.Type, NBD_REP_INFO, struct {
+					info      infoType
+					minimum   uint32
+					preferred uint32
+					maximum   uint32
+				}{
+					info:      NBD_INFO_BLOCK_SIZE,
+					minimum:   minimum,
+					preferred: preferred,
+					maximum:   maximum,
+				})
+				if err != nil {
+					return nil, fmt.Errorf("NBD_INFO_BLOCK_SIZE: %w", err)
+				}
+			}
+
+			if d, ok := backend.(Describer); ok && slices.Contains(requested, NBD_INFO_DESCRIPTION) {
+				description := d.Description()
+				if len(description) > 0 {
+					err = reply(option.Type, NBD_REP_INFO, NBD_INFO_DESCRIPTION, []byte(description))
+					if err != nil {
+						return nil, fmt.Errorf("NBD_INFO_DESCRIPTION: %w", err)
+					}
+				}
+			}
 
 			// Finish successfully
 			err = reply(option.Type, NBD_REP_ACK, nil)
 			if err != nil {
 				return nil, err
 			}
-			if option.Type == NBD_OPT_GO {
-				return backend, nil
+			pending = nil
+			if option.Type != NBD_OPT_GO {
+				release(backend)
+				continue
+			}
+			state.backend = backend
+			if name != state.metaExport {
+				state.metaContexts = nil // negotiated for another export
+			}
+			if _, ok := backend.(Sizer); ok {
+				state.size = size
+			}
+			return state, nil
+
+		case NBD_OPT_LIST:
+			if option.Len != 0 {
+				err = discard(conn, int(option.Len))
+				if err != nil {
+					return nil, err
+				}
+				err = reply(option.Type, NBD_REP_ERR_INVALID, nil)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if s.list == nil {
+				err = reply(option.Type, NBD_REP_ERR_UNSUP, nil)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			exports, err := s.list(state.client)
+			if err != nil {
+				log := logger.FromContext(ctx)
+				log.Warn("listing exports failed", "error", err)
+				err = reply(option.Type, NBD_REP_ERR_UNKNOWN, []byte("export list is not available\x00"))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			for _, e := range exports {
+				err = reply(option.Type, NBD_REP_SERVER, uint32(len(e.Name)), []byte(e.Name), []byte(e.Description))
+				if err != nil {
+					return nil, fmt.Errorf("NBD_REP_SERVER: %w", err)
+				}
+			}
+			err = reply(option.Type, NBD_REP_ACK, nil)
+			if err != nil {
+				return nil, err
+			}
+
+		case NBD_OPT_STARTTLS:
+			if option.Len != 0 {
+				err = discard(conn, int(option.Len))
+				if err != nil {
+					return nil, err
+				}
+				err = reply(option.Type, NBD_REP_ERR_INVALID, nil)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if s.tls == nil {
+				err = reply(option.Type, NBD_REP_ERR_UNSUP, nil)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if state.tls {
+				err = reply(option.Type, NBD_REP_ERR_INVALID, []byte("TLS is already active\x00"))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			err = reply(option.Type, NBD_REP_ACK, nil)
+			if err != nil {
+				return nil, err
+			}
+			secure := tls.Server(conn, s.tls)
+			err = secure.HandshakeContext(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("TLS handshake: %w", err)
+			}
+
+			// Forget everything negotiated over plain text connection
+			conn = secure
+			state = &session{
+				conn:   conn,
+				client: Client{Addr: conn.RemoteAddr(), conn: state.client.conn},
+				size:   -1,
+				tls:    true,
+			}
+			key, err := certs.PeerKey(secure.ConnectionState())
+			if err == nil { // clients are not identified if TLS config does not verify them
+				state.client.Fingerprint, err = certs.Fingerprint(key)
+				if err != nil {
+					return nil, fmt.Errorf("TLS client fingerprint: %w", err)
+				}
+				log := logger.FromContext(ctx)
+				log.Info("TLS client authenticated", "fingerprint", state.client.Fingerprint)
+			}
+
+		case NBD_OPT_STRUCTURED_REPLY:
+			if option.Len != 0 {
+				err = discard(conn, int(option.Len))
+				if err != nil {
+					return nil, err
+				}
+				err = reply(option.Type, NBD_REP_ERR_INVALID, nil)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if state.extended {
+				err = reply(option.Type, NBD_REP_ERR_EXT_HEADER_REQD, []byte("extended headers were already negotiated\x00"))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			state.structured = true
+			err = reply(option.Type, NBD_REP_ACK, nil)
+			if err != nil {
+				return nil, err
+			}
+
+		case NBD_OPT_LIST_META_CONTEXT, NBD_OPT_SET_META_CONTEXT:
+			if option.Len > buffer.Size {
+				err = discard(conn, int(option.Len))
+				if err != nil {
+					return nil, err
+				}
+				err = reply(option.Type, NBD_REP_ERR_TOO_BIG, nil)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			buf := make([]byte, option.Len)
+			err = receive(conn, buf)
+			if err != nil {
+				return nil, fmt.Errorf("%v: reading payload: %w", option.Type, err)
+			}
+			request, err := parseMetaContextRequest(buf)
+			if err != nil {
+				err = reply(option.Type, NBD_REP_ERR_INVALID, []byte("malformed metadata context request\x00"))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if option.Type == NBD_OPT_SET_META_CONTEXT && !state.structured {
+				err = reply(option.Type, NBD_REP_ERR_INVALID, []byte("structured replies are required for metadata contexts\x00"))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if s.export == nil {
+				err = reply(option.Type, NBD_REP_ERR_UNKNOWN, []byte("no exports defined for this server\x00"))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			backend, err := s.export(state.client, request.export)
+			if errors.Is(err, ErrForbidden) {
+				log := logger.FromContext(ctx)
+				log.Warn("export access denied", "error", err)
+				err = reply(option.Type, NBD_REP_ERR_POLICY, []byte("access to requested export is denied\x00"))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err != nil {
+				log := logger.FromContext(ctx)
+				log.Warn("export not available", "export", request.export, "error", err)
+				err = reply(option.Type, NBD_REP_ERR_UNKNOWN, []byte("requested export is not available\x00"))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			list := option.Type == NBD_OPT_LIST_META_CONTEXT
+			contexts := matchMetaContexts(metaContexts(backend), request.queries, list)
+			release(backend)
+			if !list {
+				state.metaExport = request.export
+				state.metaContexts = contexts
+			}
+			for index, name := range contexts {
+				var id uint32 // meaningless for NBD_OPT_LIST_META_CONTEXT
+				if !list {
+					id = uint32(index + 1)
+				}
+				err = reply(option.Type, NBD_REP_META_CONTEXT, id, []byte(name))
+				if err != nil {
+					return nil, err
+				}
+			}
+			err = reply(option.Type, NBD_REP_ACK, nil)
+			if err != nil {
+				return nil, err
+			}
+
+		case NBD_OPT_EXTENDED_HEADERS:
+			if option.Len != 0 {
+				err = discard(conn, int(option.Len))
+				if err != nil {
+					return nil, err
+				}
+				err = reply(option.Type, NBD_REP_ERR_INVALID, nil)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			state.extended = true
+			state.structured = true // extended headers imply structured replies
+			err = reply(option.Type, NBD_REP_ACK, nil)
+			if err != nil {
+				return nil, err
 			}
 
 		case NBD_OPT_EXPORT_NAME: // not supported; drop connection (violates NBD protocol spec)
@@ -198,41 +525,89 @@ func negotiate(ctx context.Context, conn io.ReadWriter, export func(name string)
 	}
 }
 
-// Negotiate NBD export with client
-func negotiateBackend(conn io.ReadWriter, export func(name string) (Backend, error), size uint32) (Backend, error) {
+// Negotiate NBD export with client.
+// Also returns the list of information types requested by client.
+func negotiateBackend(conn io.ReadWriter, export func(client Client, name string) (Backend, error), client Client, size uint32) (backend Backend, name string, requested []infoType, err error) {
 	buf := buffer.Get()
 	defer buffer.Put(buf)
 
 	payloadLen := int(size)
 	if payloadLen > cap(buf) {
 		_ = discard(conn, payloadLen)
-		return nil, fmt.Errorf("payload too large: %db > %db", size, cap(buf))
+		return nil, "", nil, fmt.Errorf("payload too large: %db > %db", size, cap(buf))
 	}
 	if payloadLen < 4+2 {
 		_ = discard(conn, payloadLen)
-		return nil, fmt.Errorf("payload too small: %db", size)
+		return nil, "", nil, fmt.Errorf("payload too small: %db", size)
 	}
 	buf = buf[:payloadLen]
-	err := receive(conn, buf)
+	err = receive(conn, buf)
 	if err != nil {
-		return nil, fmt.Errorf("reading payload: %w", err)
+		return nil, "", nil, fmt.Errorf("reading payload: %w", err)
 	}
 	payload := bytes.NewReader(buf)
 	var nameLen uint32
 	err = receive(payload, &nameLen)
 	if err != nil {
-		return nil, fmt.Errorf("reading export name length: %w", err)
+		return nil, "", nil, fmt.Errorf("reading export name length: %w", err)
 	}
 	_, err = payload.Seek(int64(nameLen), io.SeekCurrent)
 	if err != nil {
-		return nil, fmt.Errorf("can not parse export name, payload too short")
+		return nil, "", nil, fmt.Errorf("can not parse export name, payload too short")
+	}
+	var infoCount uint16
+	err = receive(payload, &infoCount)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("reading number of information requests: %w", err)
+	}
+	requested = make([]infoType, infoCount)
+	err = receive(payload, requested)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("reading information requests: %w", err)
 	}
 	if export == nil {
-		return nil, fmt.Errorf("no exports defined for this server")
+		return nil, "", nil, fmt.Errorf("no exports defined for this server")
 	}
-	backend, err := export(string(buf[4 : 4+int(nameLen)]))
+	name = string(buf[4 : 4+int(nameLen)])
+	backend, err = export(client, name)
 	if err != nil {
-		return nil, fmt.Errorf("export not available: %w", err)
+		return nil, "", nil, fmt.Errorf("export not available: %w", err)
+	}
+	return backend, name, requested, err
+}
+
+// Protocol features negotiated with client
+type session struct {
+	// Connection to be used for transmission phase
+	// (may differ from the one negotiation has started with)
+	conn net.Conn
+
+	// NBD_OPT_STARTTLS
+	tls bool
+
+	// Client identity
+	client Client
+
+	// Export selected for transmission phase
+	backend Backend
+
+	// Export size in bytes (negative if unknown)
+	size int64
+
+	// NBD_OPT_STRUCTURED_REPLY
+	structured bool
+
+	// NBD_OPT_EXTENDED_HEADERS
+	extended bool
+
+	// NBD_OPT_SET_META_CONTEXT (context ID is the index in this slice plus one)
+	metaExport   string
+	metaContexts []string
+}
+
+// Release backend that will not be used for transmission
+func release(backend Backend) {
+	if b, ok := backend.(io.Closer); ok {
+		_ = b.Close()
 	}
-	return backend, err
 }
@@ -0,0 +1,958 @@
+package server
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sio/pond/nbd/certs"
+)
+
+func TestStructuredRead(t *testing.T) {
+	const size = 1 << 20
+	backend := &flakyBackend{size: size, fail: size / 2}
+	client := connect(t, func(Client, string) (Backend, error) { return backend, nil })
+	client.option(NBD_OPT_STRUCTURED_REPLY, nil)
+	client.option(NBD_OPT_GO, exportName("flaky"))
+
+	// Successful read
+	client.request(NBD_CMD_READ, 1, 100, 200<<10)
+	data, errOffset, err := client.readStructured(1)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if errOffset >= 0 {
+		t.Fatalf("unexpected error chunk at offset %d", errOffset)
+	}
+	if !bytes.Equal(data, backend.expect(100, 200<<10)) {
+		t.Fatalf("data mismatch")
+	}
+
+	// Backend fails in the middle of the read
+	client.request(NBD_CMD_READ, 2, size/2-1000, 10<<10)
+	data, errOffset, err = client.readStructured(2)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if errOffset != size/2 {
+		t.Fatalf("error reported at wrong offset: got %d, want %d", errOffset, size/2)
+	}
+	if !bytes.Equal(data, backend.expect(size/2-1000, 1000)) {
+		t.Fatalf("data mismatch before the failure point")
+	}
+
+	client.request(NBD_CMD_DISC, 3, 0, 0)
+}
+
+func TestSimpleRead(t *testing.T) {
+	backend := &flakyBackend{size: 1 << 20, fail: -1}
+	client := connect(t, func(Client, string) (Backend, error) { return backend, nil })
+	client.option(NBD_OPT_GO, exportName("simple"))
+
+	const offset, length = 12345, 100 << 10
+	client.request(NBD_CMD_READ, 42, offset, length)
+	var reply replyHeader
+	client.receive(&reply)
+	if reply.Magic != NBD_SIMPLE_REPLY_MAGIC || reply.Cookie != 42 || reply.Error != 0 {
+		t.Fatalf("unexpected reply header: %+v", reply)
+	}
+	data := make([]byte, length)
+	client.receive(data)
+	if !bytes.Equal(data, backend.expect(offset, length)) {
+		t.Fatalf("data mismatch")
+	}
+	client.request(NBD_CMD_DISC, 43, 0, 0)
+}
+
+func TestExportSize(t *testing.T) {
+	const size = 3<<20 + 1
+	backend := &sizedBackend{flakyBackend{size: size, fail: -1}}
+	client := connect(t, func(Client, string) (Backend, error) { return backend, nil })
+	reply := client.option(NBD_OPT_GO, exportName("sized", NBD_INFO_BLOCK_SIZE))
+	if reply.Type != NBD_REP_ACK {
+		t.Fatalf("NBD_OPT_GO failed: %v", reply.Type)
+	}
+	var seen int
+	for _, info := range reply.Infos {
+		if info.Type != NBD_REP_INFO {
+			t.Fatalf("unexpected reply: %v", info.Type)
+		}
+		switch infoType(binary.BigEndian.Uint16(info.Data)) {
+		case NBD_INFO_EXPORT:
+			seen++
+			got := binary.BigEndian.Uint64(info.Data[2:])
+			if got != size {
+				t.Errorf("NBD_INFO_EXPORT: size=%d, want %d", got, size)
+			}
+		case NBD_INFO_BLOCK_SIZE:
+			seen++
+			var got [3]uint32
+			for i := range got {
+				got[i] = binary.BigEndian.Uint32(info.Data[2+4*i:])
+			}
+			if got != [...]uint32{1, 4096, 1 << 20} {
+				t.Errorf("NBD_INFO_BLOCK_SIZE: %v", got)
+			}
+		}
+	}
+	if seen != 2 {
+		t.Fatalf("not all information replies were received: %d", seen)
+	}
+
+	// Out of bounds reads are rejected
+	for cookie, tt := range []struct {
+		offset uint64
+		length uint32
+		err    nbdError
+	}{
+		{size - 10, 10, 0},
+		{size - 10, 11, NBD_EINVAL},
+		{size + 1, 0, NBD_EINVAL},
+		{1 << 63, 1 << 31, NBD_EINVAL},
+	} {
+		client.request(NBD_CMD_READ, clientCookie(cookie), tt.offset, tt.length)
+		var reply replyHeader
+		client.receive(&reply)
+		if reply.Error != tt.err {
+			t.Errorf("read %d bytes at %d: got %v, want %v", tt.length, tt.offset, reply.Error, tt.err)
+		}
+		if reply.Error == 0 {
+			client.receive(make([]byte, tt.length))
+		}
+	}
+	client.request(NBD_CMD_DISC, 100, 0, 0)
+}
+
+func TestCache(t *testing.T) {
+	exportFlags := func(reply testOptionReply) transmissionFlag {
+		for _, info := range reply.Infos {
+			if info.Type == NBD_REP_INFO && infoType(binary.BigEndian.Uint16(info.Data)) == NBD_INFO_EXPORT {
+				return transmissionFlag(binary.BigEndian.Uint16(info.Data[10:]))
+			}
+		}
+		t.Fatalf("NBD_INFO_EXPORT not received")
+		return 0
+	}
+
+	t.Run("supported", func(t *testing.T) {
+		const size = 10 << 20
+		backend := &prefetchBackend{sizedBackend: sizedBackend{flakyBackend{size: size, fail: -1}}}
+		client := connect(t, func(Client, string) (Backend, error) { return backend, nil })
+		reply := client.option(NBD_OPT_GO, exportName("cached"))
+		if reply.Type != NBD_REP_ACK {
+			t.Fatalf("NBD_OPT_GO failed: %v", reply.Type)
+		}
+		if exportFlags(reply)&NBD_FLAG_SEND_CACHE == 0 {
+			t.Fatalf("NBD_FLAG_SEND_CACHE not advertised")
+		}
+		for cookie, tt := range []struct {
+			offset uint64
+			length uint32
+			err    nbdError
+		}{
+			{0, 1 << 20, 0},
+			{size - 10, 10, 0},
+			{size - 10, 11, NBD_EINVAL},
+		} {
+			client.request(NBD_CMD_CACHE, clientCookie(cookie), tt.offset, tt.length)
+			var reply replyHeader
+			client.receive(&reply)
+			if reply.Error != tt.err {
+				t.Errorf("cache %d bytes at %d: got %v, want %v", tt.length, tt.offset, reply.Error, tt.err)
+			}
+		}
+		client.request(NBD_CMD_DISC, 100, 0, 0)
+		want := [][2]int64{{0, 1 << 20}, {size - 10, 10}}
+		if fmt.Sprint(backend.prefetched) != fmt.Sprint(want) {
+			t.Errorf("prefetched %v, want %v", backend.prefetched, want)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		backend := &sizedBackend{flakyBackend{size: 1 << 20, fail: -1}}
+		client := connect(t, func(Client, string) (Backend, error) { return backend, nil })
+		reply := client.option(NBD_OPT_GO, exportName("uncached"))
+		if reply.Type != NBD_REP_ACK {
+			t.Fatalf("NBD_OPT_GO failed: %v", reply.Type)
+		}
+		if exportFlags(reply)&NBD_FLAG_SEND_CACHE != 0 {
+			t.Fatalf("NBD_FLAG_SEND_CACHE advertised for backend without Prefetch()")
+		}
+		client.request(NBD_CMD_CACHE, 1, 0, 4096)
+		var header replyHeader
+		client.receive(&header)
+		if header.Error != NBD_ENOTSUP {
+			t.Errorf("got %v, want %v", header.Error, NBD_ENOTSUP)
+		}
+		client.request(NBD_CMD_DISC, 100, 0, 0)
+	})
+}
+
+func TestWritable(t *testing.T) {
+	const size = 1 << 20
+	backend := &memoryBackend{data: make([]byte, size)}
+	client := connect(t, func(Client, string) (Backend, error) { return backend, nil })
+	reply := client.option(NBD_OPT_GO, exportName("scratch"))
+	if reply.Type != NBD_REP_ACK {
+		t.Fatalf("NBD_OPT_GO failed: %v", reply.Type)
+	}
+	var flags transmissionFlag
+	for _, info := range reply.Infos {
+		if info.Type == NBD_REP_INFO && infoType(binary.BigEndian.Uint16(info.Data)) == NBD_INFO_EXPORT {
+			flags = transmissionFlag(binary.BigEndian.Uint16(info.Data[10:]))
+		}
+	}
+	if flags&NBD_FLAG_READ_ONLY != 0 {
+		t.Errorf("writable export advertised as read-only: %v", flags)
+	}
+	want := NBD_FLAG_SEND_FLUSH | NBD_FLAG_SEND_FUA | NBD_FLAG_SEND_TRIM | NBD_FLAG_SEND_WRITE_ZEROES
+	if flags&want != want {
+		t.Errorf("missing transmission flags: got %v, want %v", flags, want)
+	}
+
+	expect := func(cookie clientCookie, err nbdError) {
+		t.Helper()
+		var reply replyHeader
+		client.receive(&reply)
+		if reply.Cookie != cookie || reply.Error != err {
+			t.Fatalf("cookie %d: got %v, want %v", reply.Cookie, reply.Error, err)
+		}
+	}
+	payload := bytes.Repeat([]byte("pond"), 1000)
+
+	client.send(requestHeader{
+		Magic:  NBD_REQUEST_MAGIC,
+		Flag:   NBD_CMD_FLAG_FUA,
+		Type:   NBD_CMD_WRITE,
+		Cookie: 1,
+		Offset: 100,
+		Len:    uint32(len(payload)),
+	}, payload)
+	expect(1, 0)
+	if backend.flushed != 1 {
+		t.Errorf("FUA write did not flush the backend")
+	}
+
+	client.request(NBD_CMD_WRITE_ZEROES, 2, 200, 50)
+	expect(2, 0)
+	client.request(NBD_CMD_TRIM, 3, 1000, 100)
+	expect(3, 0)
+	client.request(NBD_CMD_FLUSH, 4, 0, 0)
+	expect(4, 0)
+
+	// Out of bounds write is rejected and its payload is skipped
+	client.request(NBD_CMD_WRITE, 5, size-10, 20)
+	client.send(make([]byte, 20))
+	expect(5, NBD_ENOSPC)
+
+	client.request(NBD_CMD_READ, 6, 0, 5000)
+	expect(6, 0)
+	got := make([]byte, 5000)
+	client.receive(got)
+	model := make([]byte, 5000)
+	copy(model[100:], payload)
+	clear(model[200:250])
+	clear(model[1000:1100])
+	if !bytes.Equal(got, model) {
+		t.Errorf("unexpected data after modifications")
+	}
+	client.request(NBD_CMD_DISC, 100, 0, 0)
+
+	t.Run("read-only", func(t *testing.T) {
+		backend := &sizedBackend{flakyBackend{size: size, fail: -1}}
+		client := connect(t, func(Client, string) (Backend, error) { return backend, nil })
+		reply := client.option(NBD_OPT_GO, exportName("readonly"))
+		if reply.Type != NBD_REP_ACK {
+			t.Fatalf("NBD_OPT_GO failed: %v", reply.Type)
+		}
+		client.request(NBD_CMD_WRITE, 1, 0, uint32(len(payload)))
+		client.send(payload)
+		var header replyHeader
+		client.receive(&header)
+		if header.Error != NBD_EPERM {
+			t.Fatalf("write to read-only export: got %v, want %v", header.Error, NBD_EPERM)
+		}
+		client.request(NBD_CMD_READ, 2, 0, 10)
+		client.receive(&header)
+		if header.Cookie != 2 || header.Error != 0 {
+			t.Fatalf("read after rejected write: %+v", header)
+		}
+		client.receive(make([]byte, 10))
+		client.request(NBD_CMD_DISC, 100, 0, 0)
+	})
+}
+
+func TestExtendedHeaders(t *testing.T) {
+	const size = 1 << 20
+	backend := &sizedBackend{flakyBackend{size: size, fail: -1}}
+	client := connect(t, func(Client, string) (Backend, error) { return backend, nil })
+	reply := client.option(NBD_OPT_EXTENDED_HEADERS, nil)
+	if reply.Type != NBD_REP_ACK {
+		t.Fatalf("NBD_OPT_EXTENDED_HEADERS: %v", reply.Type)
+	}
+	reply = client.option(NBD_OPT_STRUCTURED_REPLY, nil)
+	if reply.Type != NBD_REP_ERR_EXT_HEADER_REQD {
+		t.Fatalf("NBD_OPT_STRUCTURED_REPLY after extended headers: %v", reply.Type)
+	}
+	reply = client.option(NBD_OPT_GO, exportName("extended"))
+	if reply.Type != NBD_REP_ACK {
+		t.Fatalf("NBD_OPT_GO failed: %v", reply.Type)
+	}
+	client.extended = true
+
+	client.request(NBD_CMD_READ, 1, 0, size)
+	data, errOffset, err := client.readStructured(1)
+	if err != nil || errOffset >= 0 {
+		t.Fatalf("read: err=%v, errOffset=%d", err, errOffset)
+	}
+	if !bytes.Equal(data, backend.expect(0, size)) {
+		t.Fatalf("data mismatch")
+	}
+
+	// 64-bit length must not get truncated
+	client.send(extendedRequestHeader{
+		Magic:  NBD_EXTENDED_REQUEST_MAGIC,
+		Type:   NBD_CMD_READ,
+		Cookie: 2,
+		Len:    1<<32 + 1,
+	})
+	_, _, err = client.readStructured(2)
+	if err != NBD_EINVAL {
+		t.Fatalf("out of bounds 64-bit read: got %v, want %v", err, NBD_EINVAL)
+	}
+
+	// Replies without payload use extended headers too
+	client.request(NBD_CMD_CACHE, 3, 0, 4096)
+	_, _, err = client.readStructured(3)
+	if err != NBD_ENOTSUP {
+		t.Fatalf("NBD_CMD_CACHE: got %v, want %v", err, NBD_ENOTSUP)
+	}
+
+	// Oversized write payload is not consumed, connection gets closed
+	client.send(extendedRequestHeader{
+		Magic:  NBD_EXTENDED_REQUEST_MAGIC,
+		Type:   NBD_CMD_WRITE,
+		Cookie: 4,
+		Len:    1<<63 + 1,
+	})
+	_, _, err = client.readStructured(4)
+	if err != NBD_EOVERFLOW {
+		t.Fatalf("oversized write: got %v, want %v", err, NBD_EOVERFLOW)
+	}
+	_, err = client.conn.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("connection was not closed after oversized write: %v", err)
+	}
+}
+
+func TestBlockStatus(t *testing.T) {
+	const size = 10000
+	backend := &statusBackend{sizedBackend{flakyBackend{size: size, fail: -1}}}
+	client := connect(t, func(Client, string) (Backend, error) { return backend, nil })
+
+	contexts := func(reply testOptionReply) map[string]uint32 {
+		t.Helper()
+		if reply.Type != NBD_REP_ACK {
+			t.Fatalf("metadata context negotiation failed: %v", reply.Type)
+		}
+		found := make(map[string]uint32)
+		for _, r := range reply.Infos {
+			if r.Type != NBD_REP_META_CONTEXT {
+				t.Fatalf("unexpected reply: %v", r.Type)
+			}
+			found[string(r.Data[4:])] = binary.BigEndian.Uint32(r.Data)
+		}
+		return found
+	}
+
+	got := contexts(client.option(NBD_OPT_LIST_META_CONTEXT, metaContextQuery("status")))
+	if fmt.Sprint(got) != "map[base:allocation:0 test:even:0]" {
+		t.Errorf("list all contexts: %v", got)
+	}
+	got = contexts(client.option(NBD_OPT_LIST_META_CONTEXT, metaContextQuery("status", "test:")))
+	if fmt.Sprint(got) != "map[test:even:0]" {
+		t.Errorf("list namespace: %v", got)
+	}
+	reply := client.option(NBD_OPT_SET_META_CONTEXT, metaContextQuery("status", "base:allocation"))
+	if reply.Type != NBD_REP_ERR_INVALID {
+		t.Errorf("selecting contexts without structured replies: %v", reply.Type)
+	}
+
+	client.option(NBD_OPT_STRUCTURED_REPLY, nil)
+	got = contexts(client.option(NBD_OPT_SET_META_CONTEXT, metaContextQuery("status", "base:allocation", "test:even", "test:")))
+	if fmt.Sprint(got) != "map[base:allocation:1 test:even:2]" {
+		t.Errorf("set contexts: %v", got)
+	}
+	reply = client.option(NBD_OPT_GO, exportName("status"))
+	if reply.Type != NBD_REP_ACK {
+		t.Fatalf("NBD_OPT_GO failed: %v", reply.Type)
+	}
+
+	status := func(cookie clientCookie, flag requestFlag, offset uint64, length uint32) map[uint32][]blockDescriptor {
+		t.Helper()
+		client.send(requestHeader{
+			Magic:  NBD_REQUEST_MAGIC,
+			Flag:   flag,
+			Type:   NBD_CMD_BLOCK_STATUS,
+			Cookie: cookie,
+			Offset: offset,
+			Len:    length,
+		})
+		result := make(map[uint32][]blockDescriptor)
+		for {
+			header := client.replyChunk()
+			if header.Type != NBD_REPLY_TYPE_BLOCK_STATUS {
+				t.Fatalf("unexpected reply type: %v", header.Type)
+			}
+			var id uint32
+			client.receive(&id)
+			descriptors := make([]blockDescriptor, (header.Len-4)/8)
+			client.receive(descriptors)
+			result[id] = descriptors
+			if header.Flag&NBD_REPLY_FLAG_DONE != 0 {
+				return result
+			}
+		}
+	}
+	result := status(1, 0, 1000, 5000)
+	if fmt.Sprint(result) != "map[1:[{5000 0}] 2:[{1000 1} {2000 0} {2000 1}]]" {
+		t.Errorf("block status: %v", result)
+	}
+	result = status(2, NBD_CMD_FLAG_REQ_ONE, 1000, 5000)
+	if fmt.Sprint(result) != "map[1:[{5000 0}] 2:[{1000 1}]]" {
+		t.Errorf("block status (single extent): %v", result)
+	}
+	client.request(NBD_CMD_DISC, 100, 0, 0)
+
+	t.Run("not negotiated", func(t *testing.T) {
+		client := connect(t, func(Client, string) (Backend, error) { return backend, nil })
+		client.option(NBD_OPT_STRUCTURED_REPLY, nil)
+		client.option(NBD_OPT_GO, exportName("status"))
+		client.request(NBD_CMD_BLOCK_STATUS, 1, 0, 100)
+		var header replyHeader
+		client.receive(&header)
+		if header.Error != NBD_EINVAL {
+			t.Errorf("got %v, want %v", header.Error, NBD_EINVAL)
+		}
+		client.request(NBD_CMD_DISC, 100, 0, 0)
+	})
+}
+
+func TestListExports(t *testing.T) {
+	exports := []Export{
+		{Name: "rootfs/2026-10-01.squashfs", Description: "nightly build"},
+		{Name: "scratch"},
+	}
+	srv := New(context.Background(), func(Client, string) (Backend, error) {
+		return &describedBackend{description: "hello"}, nil
+	})
+	srv.SetExportList(func(client Client) ([]Export, error) {
+		if client.Addr == nil {
+			t.Errorf("export list requested on behalf of unknown client")
+		}
+		return exports, nil
+	})
+	client := connectServer(t, srv)
+
+	reply := client.option(NBD_OPT_LIST, nil)
+	if reply.Type != NBD_REP_ACK {
+		t.Fatalf("NBD_OPT_LIST failed: %v", reply.Type)
+	}
+	if len(reply.Infos) != len(exports) {
+		t.Fatalf("got %d exports, want %d", len(reply.Infos), len(exports))
+	}
+	for i, server := range reply.Infos {
+		if server.Type != NBD_REP_SERVER {
+			t.Fatalf("unexpected reply: %v", server.Type)
+		}
+		nameLen := binary.BigEndian.Uint32(server.Data)
+		got := Export{
+			Name:        string(server.Data[4 : 4+nameLen]),
+			Description: string(server.Data[4+nameLen:]),
+		}
+		if got != exports[i] {
+			t.Errorf("export #%d: got %+v, want %+v", i, got, exports[i])
+		}
+	}
+
+	reply = client.option(NBD_OPT_INFO, exportName("scratch", NBD_INFO_DESCRIPTION))
+	if reply.Type != NBD_REP_ACK {
+		t.Fatalf("NBD_OPT_INFO failed: %v", reply.Type)
+	}
+	var description string
+	for _, info := range reply.Infos {
+		if infoType(binary.BigEndian.Uint16(info.Data)) == NBD_INFO_DESCRIPTION {
+			description = string(info.Data[2:])
+		}
+	}
+	if description != "hello" {
+		t.Errorf("NBD_INFO_DESCRIPTION: got %q, want %q", description, "hello")
+	}
+
+	reply = client.option(NBD_OPT_LIST, []byte("unexpected"))
+	if reply.Type != NBD_REP_ERR_INVALID {
+		t.Errorf("NBD_OPT_LIST with payload: got %v, want %v", reply.Type, NBD_REP_ERR_INVALID)
+	}
+}
+
+func TestReleaseBackend(t *testing.T) {
+	var opened, closed atomic.Int32
+	client := connect(t, func(Client, string) (Backend, error) {
+		opened.Add(1)
+		return &closingBackend{closed: &closed}, nil
+	})
+	reply := client.option(NBD_OPT_INFO, exportName("info"))
+	if reply.Type != NBD_REP_ACK {
+		t.Fatalf("NBD_OPT_INFO failed: %v", reply.Type)
+	}
+	reply = client.option(NBD_OPT_GO, exportName("go"))
+	if reply.Type != NBD_REP_ACK {
+		t.Fatalf("NBD_OPT_GO failed: %v", reply.Type)
+	}
+	if opened.Load() != 2 || closed.Load() != 1 {
+		t.Errorf("backend obtained for NBD_OPT_INFO was not released: opened=%d, closed=%d", opened.Load(), closed.Load())
+	}
+	client.request(NBD_CMD_DISC, 1, 0, 0)
+}
+
+func TestStartTLS(t *testing.T) {
+	serverKey, err := certs.PrivateKey("../certs/testkeys/bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := certs.PrivateKey("../certs/testkeys/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTrusts, err := certs.AuthorizedKeys("../certs/testkeys/alice.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTrusts, err := certs.AuthorizedKeys("../certs/testkeys/bob.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint, err := certs.Fingerprint(clientKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &flakyBackend{size: 1 << 20, fail: -1}
+	srv := New(context.Background(), func(client Client, name string) (Backend, error) {
+		if client.Fingerprint != fingerprint || name != "encrypted" {
+			return nil, fmt.Errorf("%s may not access %s: %w", client, name, ErrForbidden)
+		}
+		return backend, nil
+	})
+	srv.SetTLS(certs.NewPKI(serverKey, serverTrusts...).ServerConfig(), true)
+	client := connectServer(t, srv)
+
+	reply := client.option(NBD_OPT_GO, exportName("plaintext"))
+	if reply.Type != NBD_REP_ERR_TLS_REQD {
+		t.Fatalf("NBD_OPT_GO without TLS: got %v, want %v", reply.Type, NBD_REP_ERR_TLS_REQD)
+	}
+	reply = client.option(NBD_OPT_STARTTLS, nil)
+	if reply.Type != NBD_REP_ACK {
+		t.Fatalf("NBD_OPT_STARTTLS: %v", reply.Type)
+	}
+	secure := tls.Client(client.conn, certs.NewPKI(clientKey, clientTrusts...).ClientConfig())
+	err = secure.Handshake()
+	if err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+	client.conn = secure
+
+	reply = client.option(NBD_OPT_STARTTLS, nil)
+	if reply.Type != NBD_REP_ERR_INVALID {
+		t.Fatalf("repeated NBD_OPT_STARTTLS: got %v, want %v", reply.Type, NBD_REP_ERR_INVALID)
+	}
+	client.option(NBD_OPT_STRUCTURED_REPLY, nil)
+	reply = client.option(NBD_OPT_GO, exportName("forbidden"))
+	if reply.Type != NBD_REP_ERR_POLICY {
+		t.Fatalf("NBD_OPT_GO for forbidden export: got %v, want %v", reply.Type, NBD_REP_ERR_POLICY)
+	}
+	reply = client.option(NBD_OPT_GO, exportName("encrypted"))
+	if reply.Type != NBD_REP_ACK {
+		t.Fatalf("NBD_OPT_GO over TLS: %v", reply.Type)
+	}
+	client.request(NBD_CMD_READ, 1, 1000, 1000)
+	data, _, err := client.readStructured(1)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(data, backend.expect(1000, 1000)) {
+		t.Fatalf("data mismatch")
+	}
+	client.request(NBD_CMD_DISC, 2, 0, 0)
+}
+
+// Minimal NBD client for testing our server
+type testClient struct {
+	t        *testing.T
+	conn     net.Conn
+	extended bool // NBD_OPT_EXTENDED_HEADERS was negotiated
+}
+
+// Start a server and connect to it via in-memory pipe
+func connect(t *testing.T, export func(client Client, name string) (Backend, error)) *testClient {
+	return connectServer(t, New(context.Background(), export))
+}
+
+func connectServer(t *testing.T, srv *Server) *testClient {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() { _ = serverConn.Close() }()
+		err := srv.serveNBD(ctx, skipEmptyWrites{serverConn})
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+			t.Logf("server: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel(NBD_ESHUTDOWN)
+		_ = clientConn.Close()
+		<-done
+	})
+	_ = clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := &testClient{t: t, conn: clientConn}
+	c.handshake()
+	return c
+}
+
+// Zero length writes block on net.Pipe until the other side reads.
+// That never happens when reading into a zero length buffer.
+type skipEmptyWrites struct {
+	net.Conn
+}
+
+func (c skipEmptyWrites) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *testClient) send(data ...any) {
+	c.t.Helper()
+	for _, d := range data {
+		if b, ok := d.([]byte); ok && len(b) == 0 {
+			continue // see skipEmptyWrites
+		}
+		err := send(c.conn, d)
+		if err != nil {
+			c.t.Fatalf("client send: %v", err)
+		}
+	}
+}
+
+func (c *testClient) receive(data ...any) {
+	c.t.Helper()
+	err := receive(c.conn, data...)
+	if err != nil {
+		c.t.Fatalf("client receive: %v", err)
+	}
+}
+
+func (c *testClient) handshake() {
+	c.t.Helper()
+	var hello struct {
+		Magic  uint64
+		Option uint64
+		Flag   handshakeFlag
+	}
+	c.receive(&hello)
+	if hello.Magic != NBDMAGIC || hello.Option != IHAVEOPT {
+		c.t.Fatalf("unexpected server greeting: %+v", hello)
+	}
+	c.send(uint16(0), NBD_FLAG_FIXED_NEWSTYLE)
+}
+
+type testOptionReply struct {
+	Type  optionReply
+	Data  []byte
+	Infos []testOptionReply
+}
+
+// Send option to server and collect replies until a final one
+func (c *testClient) option(option optionType, payload []byte) (final testOptionReply) {
+	c.t.Helper()
+	c.send(IHAVEOPT, option, uint32(len(payload)), payload)
+	for {
+		var header struct {
+			Magic  uint64
+			Option optionType
+			Reply  optionReply
+			Len    uint32
+		}
+		c.receive(&header)
+		if header.Option != option {
+			c.t.Fatalf("reply to a wrong option: got %d, want %d", header.Option, option)
+		}
+		data := make([]byte, header.Len)
+		c.receive(data)
+		r := testOptionReply{Type: header.Reply, Data: data}
+		if r.Type == NBD_REP_ACK || r.Type >= nbd_rep_error {
+			r.Infos = final.Infos
+			return r
+		}
+		final.Infos = append(final.Infos, r)
+	}
+}
+
+// Build NBD_OPT_GO/NBD_OPT_INFO payload
+func exportName(name string, info ...infoType) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(name)))
+	buf.WriteString(name)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(info)))
+	for _, i := range info {
+		_ = binary.Write(&buf, binary.BigEndian, i)
+	}
+	return buf.Bytes()
+}
+
+// Payload for NBD_OPT_LIST_META_CONTEXT and NBD_OPT_SET_META_CONTEXT
+func metaContextQuery(export string, queries ...string) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(export)))
+	buf.WriteString(export)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(queries)))
+	for _, query := range queries {
+		_ = binary.Write(&buf, binary.BigEndian, uint32(len(query)))
+		buf.WriteString(query)
+	}
+	return buf.Bytes()
+}
+
+func (c *testClient) request(kind requestType, cookie clientCookie, offset uint64, length uint32) {
+	c.t.Helper()
+	if c.extended {
+		c.send(extendedRequestHeader{
+			Magic:  NBD_EXTENDED_REQUEST_MAGIC,
+			Type:   kind,
+			Cookie: cookie,
+			Offset: offset,
+			Len:    uint64(length),
+		})
+		return
+	}
+	c.send(requestHeader{
+		Magic:  NBD_REQUEST_MAGIC,
+		Type:   kind,
+		Cookie: cookie,
+		Offset: offset,
+		Len:    length,
+	})
+}
+
+// Read structured reply chunks for a single NBD_CMD_READ.
+// Negative errOffset means no error chunks were received.
+// Receive reply chunk header in negotiated format
+func (c *testClient) replyChunk() (header extendedReplyHeader) {
+	c.t.Helper()
+	if c.extended {
+		c.receive(&header)
+		if header.Magic != NBD_EXTENDED_REPLY_MAGIC {
+			c.t.Fatalf("invalid magic: %#x", header.Magic)
+		}
+		return header
+	}
+	var short structuredReplyHeader
+	c.receive(&short)
+	if short.Magic != NBD_STRUCTURED_REPLY_MAGIC {
+		c.t.Fatalf("invalid magic: %#x", short.Magic)
+	}
+	return extendedReplyHeader{
+		Magic:  short.Magic,
+		Flag:   short.Flag,
+		Type:   short.Type,
+		Cookie: short.Cookie,
+		Len:    uint64(short.Len),
+	}
+}
+
+func (c *testClient) readStructured(cookie clientCookie) (data []byte, errOffset int64, err error) {
+	errOffset = -1
+	var start int64 = -1
+	for {
+		header := c.replyChunk()
+		if header.Cookie != cookie {
+			return nil, 0, fmt.Errorf("unexpected cookie: %d", header.Cookie)
+		}
+		payload := make([]byte, header.Len)
+		c.receive(payload)
+		switch header.Type {
+		case NBD_REPLY_TYPE_NONE:
+		case NBD_REPLY_TYPE_ERROR:
+			return nil, 0, nbdError(binary.BigEndian.Uint32(payload))
+		case NBD_REPLY_TYPE_OFFSET_DATA:
+			offset := int64(binary.BigEndian.Uint64(payload))
+			if start < 0 {
+				start = offset
+			}
+			if offset != start+int64(len(data)) {
+				return nil, 0, fmt.Errorf("out of order chunk at %d", offset)
+			}
+			data = append(data, payload[8:]...)
+		case NBD_REPLY_TYPE_ERROR_OFFSET:
+			msgLen := int(binary.BigEndian.Uint16(payload[4:]))
+			errOffset = int64(binary.BigEndian.Uint64(payload[6+msgLen:]))
+		default:
+			return nil, 0, fmt.Errorf("unexpected reply type: %v", header.Type)
+		}
+		if header.Flag&NBD_REPLY_FLAG_DONE != 0 {
+			return data, errOffset, nil
+		}
+	}
+}
+
+// Predictable backend that fails all reads after given offset
+type flakyBackend struct {
+	size int64
+	fail int64
+}
+
+func (b *flakyBackend) ReadAt(p []byte, offset int64) (n int, err error) {
+	for n = range p {
+		pos := offset + int64(n)
+		if b.fail >= 0 && pos >= b.fail {
+			return n, fmt.Errorf("flaky backend: offset %d is not available", pos)
+		}
+		if pos >= b.size {
+			return n, io.EOF
+		}
+		p[n] = b.byteAt(pos)
+	}
+	return len(p), nil
+}
+
+func (b *flakyBackend) byteAt(offset int64) byte {
+	return byte(offset*7 + offset>>8)
+}
+
+func (b *flakyBackend) expect(offset, length int64) []byte {
+	out := make([]byte, length)
+	for i := range out {
+		out[i] = b.byteAt(offset + int64(i))
+	}
+	return out
+}
+
+// Backend that knows its own geometry
+type closingBackend struct {
+	flakyBackend
+	closed *atomic.Int32
+}
+
+func (b *closingBackend) Close() error {
+	b.closed.Add(1)
+	return nil
+}
+
+type sizedBackend struct {
+	flakyBackend
+}
+
+func (b *sizedBackend) Size() int64 {
+	return b.size
+}
+
+func (b *sizedBackend) BlockSize() (minimum, preferred, maximum uint32) {
+	return 1, 4096, 1 << 20
+}
+
+type describedBackend struct {
+	flakyBackend
+	description string
+}
+
+func (b *describedBackend) Description() string {
+	return b.description
+}
+
+// Backend that records cache hints
+type prefetchBackend struct {
+	sizedBackend
+	prefetched [][2]int64
+}
+
+func (b *prefetchBackend) Prefetch(offset, length int64) error {
+	b.prefetched = append(b.prefetched, [2]int64{offset, length})
+	return nil
+}
+
+// Writable in-memory backend
+type memoryBackend struct {
+	mu      sync.Mutex
+	data    []byte
+	flushed int
+}
+
+func (b *memoryBackend) ReadAt(p []byte, offset int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return copy(p, b.data[offset:]), nil
+}
+
+func (b *memoryBackend) WriteAt(p []byte, offset int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return copy(b.data[offset:], p), nil
+}
+
+func (b *memoryBackend) Size() int64 {
+	return int64(len(b.data))
+}
+
+func (b *memoryBackend) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushed++
+	return nil
+}
+
+func (b *memoryBackend) Trim(offset, length int64) error {
+	return b.WriteZeroes(offset, length, false)
+}
+
+func (b *memoryBackend) WriteZeroes(offset, length int64, noHole bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clear(b.data[offset : offset+length])
+	return nil
+}
+
+// Backend with a custom metadata context: even 2000 byte extents are flagged
+type statusBackend struct {
+	sizedBackend
+}
+
+func (b *statusBackend) MetaContexts() []string {
+	return []string{"test:even"}
+}
+
+func (b *statusBackend) BlockStatus(context string, offset, length int64) (extents []Extent, err error) {
+	const step = 2000
+	for cur := offset; cur < offset+length; {
+		stop := (cur/step + 1) * step
+		var flags uint32
+		if (cur/step)%2 == 0 {
+			flags = 1
+		}
+		extents = append(extents, Extent{Length: stop - cur, Flags: flags})
+		cur = stop
+	}
+	return extents, nil
+}
@@ -2,15 +2,21 @@ package server
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sio/pond/nbd/buffer"
+	"github.com/sio/pond/nbd/logger"
 )
 
 // NBD Transmission Phase
-func transmission(ctx context.Context, conn io.ReadWriter, backend Backend) error {
+func (s *Server) transmission(ctx context.Context, conn io.ReadWriter, state *session) error {
 	var request sync.WaitGroup
 	defer request.Wait()
 
@@ -19,25 +25,93 @@ func transmission(ctx context.Context, conn io.ReadWriter, backend Backend) erro
 
 	var write sync.Mutex
 
-	sendError := func(cookie clientCookie, err nbdError) error {
+	// Structured reply chunks may be interleaved with chunks and replies
+	// for other requests, we only hold the lock while sending a single chunk
+	sendChunk := func(cmd command, flag replyFlag, kind replyType, payload ...any) error {
+		var length int
+		for _, p := range payload {
+			length += binary.Size(p)
+		}
+		var header any = structuredReplyHeader{
+			Magic:  NBD_STRUCTURED_REPLY_MAGIC,
+			Flag:   flag,
+			Type:   kind,
+			Cookie: cmd.Cookie,
+			Len:    uint32(length),
+		}
+		if state.extended {
+			header = extendedReplyHeader{
+				Magic:  NBD_EXTENDED_REPLY_MAGIC,
+				Flag:   flag,
+				Type:   kind,
+				Cookie: cmd.Cookie,
+				Offset: cmd.Offset,
+				Len:    uint64(length),
+			}
+		}
+		write.Lock()
+		defer write.Unlock()
+		err := send(conn, header)
+		if err != nil {
+			return err
+		}
+		return send(conn, payload...)
+	}
+
+	// Reply without payload (err may be zero to indicate success).
+	// Simple replies are not allowed after extended headers were negotiated.
+	sendError := func(cmd command, err nbdError) error {
+		if state.extended {
+			if err == 0 {
+				return sendChunk(cmd, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_NONE)
+			}
+			return sendChunk(cmd, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_ERROR, err, uint16(0))
+		}
 		write.Lock()
 		defer write.Unlock()
 		return send(conn, replyHeader{ // TODO: look for short TCP writes (Nagle algorithm is disabled in Go by default) and batch them where it makes sense
 			Magic:  NBD_SIMPLE_REPLY_MAGIC,
 			Error:  err,
-			Cookie: cookie,
+			Cookie: cmd.Cookie,
 		})
 	}
 
-	commands := make(chan requestHeader)
+	backend := state.backend
+	writable, _ := backend.(Writable)
+	turn := state.client.schedulingKey()
+	scheduled := &scheduledBackend{Backend: backend, sched: s.sched, ctx: ctx, turn: turn}
+
+	// Command payload is consumed here to ensure that the next header is
+	// received only after the current command was read in full
+	commands := make(chan command)
 	go func() {
-		var cmd requestHeader
 		for {
-			err := receive(conn, &cmd)
+			cmd, err := receiveCommand(conn, state.extended)
 			if err != nil {
 				cancel(fmt.Errorf("receive command: %w", err))
 				return
 			}
+			if cmd.Type == NBD_CMD_WRITE && cmd.Len > maxWritePayload {
+				// Payload is not consumed: nothing can be received after
+				// this command, connection gets closed after the reply
+				select {
+				case commands <- cmd:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if cmd.Type == NBD_CMD_WRITE {
+				if writable != nil {
+					cmd.payload = make([]byte, cmd.Len)
+					_, err = io.ReadFull(conn, cmd.payload)
+				} else {
+					err = discard(conn, int(cmd.Len))
+				}
+				if err != nil {
+					cancel(fmt.Errorf("receive %v payload: %w", cmd.Type, err))
+					return
+				}
+			}
 			select {
 			case commands <- cmd:
 				// continue to receive next command
@@ -47,33 +121,125 @@ func transmission(ctx context.Context, conn io.ReadWriter, backend Backend) erro
 		}
 	}()
 
+	// Commands are served in background, with limited concurrency.
+	// Spawning blocks until there is a free slot.
+	var inFlight chan struct{}
+	if s.limits.InFlight > 0 {
+		inFlight = make(chan struct{}, s.limits.InFlight)
+	}
+	var active atomic.Int32
+	spawn := func(cmd command, serve func(command)) error {
+		if inFlight != nil {
+			select {
+			case inFlight <- struct{}{}:
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+		}
+		active.Add(1)
+		request.Add(1)
+		go func() {
+			defer request.Done()
+			defer active.Add(-1)
+			if inFlight != nil {
+				defer func() { <-inFlight }()
+			}
+			serve(cmd)
+		}()
+		return nil
+	}
+
+	// Clients are considered idle only when there are no commands in flight
+	var idle *time.Timer
+	var idleTimeout <-chan time.Time
+	if s.limits.IdleTimeout > 0 {
+		idle = time.NewTimer(s.limits.IdleTimeout)
+		defer idle.Stop()
+		idleTimeout = idle.C
+	}
+
 	var err error
 	for {
-		var cmd requestHeader
+		var cmd command
 		select {
 		case <-ctx.Done():
 			return context.Cause(ctx)
+		case <-idleTimeout:
+			if active.Load() > 0 {
+				idle.Reset(s.limits.IdleTimeout)
+				continue
+			}
+			return fmt.Errorf("%w: no commands received for %s", errIdle, s.limits.IdleTimeout)
 		case cmd = <-commands:
 		}
-		if cmd.Magic != NBD_REQUEST_MAGIC {
-			return fmt.Errorf("invalid NBD_REQUEST_MAGIC: got %x, want %x", cmd.Magic, NBD_REQUEST_MAGIC)
+		if idle != nil {
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(s.limits.IdleTimeout)
+		}
+		if cmd.Type == NBD_CMD_WRITE && cmd.Len > maxWritePayload {
+			err = sendError(cmd, NBD_EOVERFLOW)
+			if err != nil {
+				return fmt.Errorf("rejecting oversized write (%d bytes): %w", cmd.Len, err)
+			}
+			return fmt.Errorf("%v payload too large: %d bytes", cmd.Type, cmd.Len)
+		}
+		var flags requestFlag // supported NBD_CMD_FLAG_* values
+		switch cmd.Type {
+		case NBD_CMD_WRITE, NBD_CMD_TRIM:
+			flags = NBD_CMD_FLAG_FUA
+		case NBD_CMD_WRITE_ZEROES:
+			flags = NBD_CMD_FLAG_FUA | NBD_CMD_FLAG_NO_HOLE
+		case NBD_CMD_BLOCK_STATUS:
+			flags = NBD_CMD_FLAG_REQ_ONE
 		}
-		if cmd.Flag != 0 {
-			// Our server does not support any NBD_CMD_FLAG_*
-			err = sendError(cmd.Cookie, NBD_EINVAL)
+		if cmd.Flag&^flags != 0 {
+			err = sendError(cmd, NBD_EINVAL)
 			if err != nil {
 				return fmt.Errorf("error while rejecting unsupported command flags (%d): %w", cmd.Flag, err)
 			}
 			continue
 		}
 
+		var outOfBounds nbdError
 		switch cmd.Type {
+		case NBD_CMD_READ, NBD_CMD_CACHE, NBD_CMD_TRIM, NBD_CMD_BLOCK_STATUS:
+			outOfBounds = NBD_EINVAL
+		case NBD_CMD_WRITE, NBD_CMD_WRITE_ZEROES:
+			outOfBounds = NBD_ENOSPC
+		}
+		limit := uint64(math.MaxInt64)
+		if state.size >= 0 {
+			limit = uint64(state.size)
+		}
+		if outOfBounds != 0 && (cmd.Offset > limit || cmd.Len > limit-cmd.Offset) {
+			err = sendError(cmd, outOfBounds)
+			if err != nil {
+				return fmt.Errorf("error while rejecting out of bounds request (%v): %w", cmd.Type, err)
+			}
+			continue
+		}
 
-		case NBD_CMD_READ:
-			request.Add(1)
-			go func(cmd requestHeader) {
-				defer request.Done()
+		switch cmd.Type {
 
+		case NBD_CMD_READ:
+			if state.structured {
+				err = spawn(cmd, func(cmd command) {
+					err := readStructured(scheduled, cmd, sendChunk)
+					if err != nil {
+						cancel(fmt.Errorf("NBD_CMD_READ: %w", err))
+					}
+				})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			err = spawn(cmd, func(cmd command) {
 				buf := buffer.Get()
 				defer buffer.Put(buf)
 				buf = buf[:cap(buf)]
@@ -87,7 +253,7 @@ func transmission(ctx context.Context, conn io.ReadWriter, backend Backend) erro
 					if (end - cur) < int64(len(buf)) {
 						buf = buf[:int(end-cur)]
 					}
-					n, ioerr := backend.ReadAt(buf, cur)
+					n, ioerr := scheduled.ReadAt(buf, cur)
 					/**
 
 					TRUTH TABLE FOR WHAT HAPPENS NEXT
@@ -118,7 +284,7 @@ func transmission(ctx context.Context, conn io.ReadWriter, backend Backend) erro
 
 					// (1) NBD_EIO
 					if ioerr != nil && !inTransaction && n == 0 {
-						err := sendError(cmd.Cookie, NBD_EIO)
+						err := sendError(cmd, NBD_EIO)
 						if err != nil {
 							cancel(fmt.Errorf("backend error (%w) followed by connection error (%w)", ioerr, err))
 						}
@@ -136,9 +302,9 @@ func transmission(ctx context.Context, conn io.ReadWriter, backend Backend) erro
 							// error out of NBD_CMD_READ (we have sent reply header with
 							// error=0).
 							//
-							// Structured replies were created to help in such scenario,
-							// but unfortunately they are still not supported by reference
-							// client implementation and by Linux kernel.
+							// Structured replies were created to help in such scenario
+							// (see readStructured), but this client has not
+							// negotiated them.
 							//
 							// We rely on data integrity verification being implemented on
 							// top of our block device (dm-verity, zfs, btrfs)
@@ -166,27 +332,93 @@ func transmission(ctx context.Context, conn io.ReadWriter, backend Backend) erro
 
 					// (4) Send data
 					cur += int64(n)
-					err = send(conn, buf[:n])
+					err := send(conn, buf[:n])
 					if err != nil {
 						cancel(fmt.Errorf("NBD_CMD_READ: send data: %w", err))
 						return
 					}
 				}
-			}(cmd)
+			})
+			if err != nil {
+				return err
+			}
 
-		// case NBD_CMD_CACHE: // TODO: handle cache requests
+		case NBD_CMD_WRITE, NBD_CMD_TRIM, NBD_CMD_WRITE_ZEROES, NBD_CMD_FLUSH:
+			if writable == nil {
+				reply := NBD_EPERM
+				if cmd.Type == NBD_CMD_FLUSH {
+					reply = NBD_ENOTSUP
+				}
+				err = sendError(cmd, reply)
+				if err != nil {
+					return fmt.Errorf("rejecting %v for read-only export: %w", cmd.Type, err)
+				}
+				continue
+			}
+			err = spawn(cmd, func(cmd command) {
+				var reply nbdError
+				ioerr := s.sched.Acquire(ctx, turn)
+				if ioerr != nil {
+					return // connection is being closed, no need to reply
+				}
+				ioerr = modify(writable, cmd)
+				s.sched.Release()
+				if ioerr != nil {
+					log := logger.FromContext(ctx)
+					log.Error("modifying export failed", "command", cmd.Type, "offset", cmd.Offset, "length", cmd.Len, "error", ioerr)
+					reply = NBD_EIO
+				}
+				err := sendError(cmd, reply)
+				if err != nil {
+					cancel(fmt.Errorf("%v: %w", cmd.Type, err))
+				}
+			})
+			if err != nil {
+				return err
+			}
 
-		case NBD_CMD_DISC: // Disconnect
-			return nil
+		case NBD_CMD_BLOCK_STATUS:
+			if len(state.metaContexts) == 0 || cmd.Len == 0 {
+				err = sendError(cmd, NBD_EINVAL)
+				if err != nil {
+					return fmt.Errorf("rejecting %v: %w", cmd.Type, err)
+				}
+				continue
+			}
+			err = spawn(cmd, func(cmd command) {
+				err := sendBlockStatus(scheduled, cmd, state, sendChunk, sendError)
+				if err != nil {
+					cancel(fmt.Errorf("NBD_CMD_BLOCK_STATUS: %w", err))
+				}
+			})
+			if err != nil {
+				return err
+			}
 
-		default: // Other commands are not supported
-			if cmd.Type == NBD_CMD_WRITE {
-				err = discard(conn, int(cmd.Len))
+		case NBD_CMD_CACHE:
+			prefetcher, ok := backend.(Prefetcher)
+			if !ok {
+				err = sendError(cmd, NBD_ENOTSUP)
 				if err != nil {
-					return fmt.Errorf("discarding command (%v) payload: %w", cmd.Type, err)
+					return fmt.Errorf("rejecting unsupported command (%v): %w", cmd.Type, err)
 				}
+				continue
 			}
-			err = sendError(cmd.Cookie, NBD_ENOTSUP)
+			var reply nbdError
+			ioerr := prefetcher.Prefetch(int64(cmd.Offset), int64(cmd.Len))
+			if ioerr != nil {
+				reply = NBD_EIO
+			}
+			err = sendError(cmd, reply)
+			if err != nil {
+				return fmt.Errorf("NBD_CMD_CACHE: %w", err)
+			}
+
+		case NBD_CMD_DISC: // Disconnect
+			return nil
+
+		default: // Other commands are not supported
+			err = sendError(cmd, NBD_ENOTSUP)
 			if err != nil {
 				return fmt.Errorf("rejecting unsupported command (%v): %w", cmd.Type, err)
 			}
@@ -194,6 +426,143 @@ func transmission(ctx context.Context, conn io.ReadWriter, backend Backend) erro
 	}
 }
 
+// Apply a modifying command to writable backend
+func modify(backend Writable, cmd command) (err error) {
+	offset, length := int64(cmd.Offset), int64(cmd.Len)
+	switch cmd.Type {
+	case NBD_CMD_WRITE:
+		_, err = backend.WriteAt(cmd.payload, offset)
+	case NBD_CMD_TRIM:
+		err = backend.Trim(offset, length)
+	case NBD_CMD_WRITE_ZEROES:
+		err = backend.WriteZeroes(offset, length, cmd.Flag&NBD_CMD_FLAG_NO_HOLE != 0)
+	case NBD_CMD_FLUSH:
+		return backend.Flush()
+	default:
+		return fmt.Errorf("not a modifying command: %v", cmd.Type)
+	}
+	if err == nil && cmd.Flag&NBD_CMD_FLAG_FUA != 0 {
+		err = backend.Flush()
+	}
+	return err
+}
+
+// Serve NBD_CMD_BLOCK_STATUS: one reply chunk per negotiated metadata context.
+// Returned error means that connection is broken.
+func sendBlockStatus(
+	backend Backend,
+	cmd command,
+	state *session,
+	sendChunk func(command, replyFlag, replyType, ...any) error,
+	sendError func(command, nbdError) error,
+) error {
+	// Query all contexts before sending anything to be able to fail cleanly
+	status := make([][]Extent, len(state.metaContexts))
+	for index, context := range state.metaContexts {
+		extents, err := blockStatus(backend, context, int64(cmd.Offset), int64(cmd.Len))
+		if err != nil {
+			ereply := sendError(cmd, NBD_EIO)
+			if ereply != nil {
+				return fmt.Errorf("backend error (%w) followed by connection error (%w)", err, ereply)
+			}
+			return nil
+		}
+		if cmd.Flag&NBD_CMD_FLAG_REQ_ONE != 0 {
+			extents = extents[:1]
+		}
+		status[index] = extents
+	}
+	for index, extents := range status {
+		var flag replyFlag
+		if index == len(status)-1 {
+			flag = NBD_REPLY_FLAG_DONE
+		}
+		id := uint32(index + 1)
+		var err error
+		if state.extended {
+			descriptors := make([]extendedBlockDescriptor, len(extents))
+			for i, extent := range extents {
+				descriptors[i] = extendedBlockDescriptor{Length: uint64(extent.Length), Flags: uint64(extent.Flags)}
+			}
+			err = sendChunk(cmd, flag, NBD_REPLY_TYPE_BLOCK_STATUS_EXT, id, uint32(len(descriptors)), descriptors)
+		} else {
+			descriptors := make([]blockDescriptor, len(extents))
+			for i, extent := range extents {
+				descriptors[i] = blockDescriptor{Length: uint32(extent.Length), Flags: extent.Flags}
+			}
+			err = sendChunk(cmd, flag, NBD_REPLY_TYPE_BLOCK_STATUS, id, descriptors)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serve NBD_CMD_READ using structured replies.
+//
+// Data is sent to client in NBD_REPLY_TYPE_OFFSET_DATA chunks as soon as it
+// becomes available. If backend fails midway, the client receives
+// NBD_REPLY_TYPE_ERROR_OFFSET pointing at the first byte we could not read
+// instead of bogus data. Returned error means that connection is broken.
+func readStructured(backend io.ReaderAt, cmd command, sendChunk func(command, replyFlag, replyType, ...any) error) error {
+	buf := buffer.Get()
+	defer buffer.Put(buf)
+	buf = buf[:cap(buf)]
+
+	cur := int64(cmd.Offset)
+	end := cur + int64(cmd.Len)
+	if cur == end {
+		return sendChunk(cmd, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_NONE)
+	}
+	for cur < end {
+		if (end - cur) < int64(len(buf)) {
+			buf = buf[:int(end-cur)]
+		}
+		n, ioerr := backend.ReadAt(buf, cur)
+		if n > 0 {
+			var flag replyFlag
+			if cur+int64(n) == end {
+				flag = NBD_REPLY_FLAG_DONE
+			}
+			err := sendChunk(cmd, flag, NBD_REPLY_TYPE_OFFSET_DATA, uint64(cur), buf[:n])
+			if err != nil {
+				return fmt.Errorf("send data: %w", err)
+			}
+			cur += int64(n)
+			continue
+		}
+		if ioerr == nil {
+			ioerr = io.ErrNoProgress
+		}
+		msg := []byte(ioerr.Error())
+		if len(msg) > maxErrorMessage {
+			msg = msg[:maxErrorMessage]
+		}
+		err := sendChunk(
+			cmd,
+			NBD_REPLY_FLAG_DONE,
+			NBD_REPLY_TYPE_ERROR_OFFSET,
+			NBD_EIO,
+			uint16(len(msg)),
+			msg,
+			uint64(cur),
+		)
+		if err != nil {
+			return fmt.Errorf("backend error (%w) followed by connection error (%w)", ioerr, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Client has not sent any commands for too long
+var errIdle = errors.New("idle timeout")
+
+// Human readable error messages in structured replies are informational only,
+// there is no need to send long ones
+const maxErrorMessage = 1 << 10
+
 type clientCookie uint64
 
 type requestHeader struct {
@@ -207,6 +576,84 @@ type requestHeader struct {
 
 type requestFlag uint16
 
+type extendedRequestHeader struct {
+	Magic  uint32
+	Flag   requestFlag
+	Type   requestType
+	Cookie clientCookie
+	Offset uint64
+	Len    uint64
+}
+
+// Transport independent representation of NBD request
+// followed by its payload (if any)
+type command struct {
+	Flag    requestFlag
+	Type    requestType
+	Cookie  clientCookie
+	Offset  uint64
+	Len     uint64
+	payload []byte
+}
+
+// Receive command header in the format that was agreed upon during negotiation
+func receiveCommand(conn io.Reader, extended bool) (cmd command, err error) {
+	if extended {
+		var header extendedRequestHeader
+		err = receive(conn, &header)
+		if err != nil {
+			return cmd, err
+		}
+		if header.Magic != NBD_EXTENDED_REQUEST_MAGIC {
+			return cmd, fmt.Errorf("invalid NBD_EXTENDED_REQUEST_MAGIC: got %x, want %x", header.Magic, NBD_EXTENDED_REQUEST_MAGIC)
+		}
+		return command{
+			Flag:   header.Flag,
+			Type:   header.Type,
+			Cookie: header.Cookie,
+			Offset: header.Offset,
+			Len:    header.Len,
+		}, nil
+	}
+	var header requestHeader
+	err = receive(conn, &header)
+	if err != nil {
+		return cmd, err
+	}
+	if header.Magic != NBD_REQUEST_MAGIC {
+		return cmd, fmt.Errorf("invalid NBD_REQUEST_MAGIC: got %x, want %x", header.Magic, NBD_REQUEST_MAGIC)
+	}
+	return command{
+		Flag:   header.Flag,
+		Type:   header.Type,
+		Cookie: header.Cookie,
+		Offset: header.Offset,
+		Len:    uint64(header.Len),
+	}, nil
+}
+
+// Larger writes are rejected to avoid allocating unbounded amounts of memory,
+// connection is closed right after that since the payload is not received.
+// This is also the default maximum block size in NBD protocol spec.
+const maxWritePayload = 32 << 20
+
+type structuredReplyHeader struct {
+	Magic  uint32
+	Flag   replyFlag
+	Type   replyType
+	Cookie clientCookie
+	Len    uint32
+}
+
+type extendedReplyHeader struct {
+	Magic  uint32
+	Flag   replyFlag
+	Type   replyType
+	Cookie clientCookie
+	Offset uint64
+	Len    uint64
+}
+
 type replyHeader struct {
 	Magic  uint32
 	Error  nbdError
@@ -1,4 +1,4 @@
-// Read-only NBD server
+// NBD server for (mostly) read-only exports
 //
 // This server was implemented for a very narrow usage scenario.
 // Be careful when attempting to use it outside of pond/nbd project: this
@@ -11,12 +11,15 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -27,7 +30,82 @@ import (
 // Actual storage interaction happens through this object
 type Backend = io.ReaderAt
 
-func New(ctx context.Context, export func(name string) (Backend, error)) *Server {
+// Optional Backend interface for reporting real export size to clients.
+//
+// Exports that do not implement it are advertised with an obviously bogus size
+// and are expected to handle out-of-bounds reads on their own.
+type Sizer interface {
+	Size() int64
+}
+
+// Optional Backend interface for reporting block size constraints to clients
+// (NBD_INFO_BLOCK_SIZE)
+type BlockSizer interface {
+	BlockSize() (minimum, preferred, maximum uint32)
+}
+
+// Optional Backend interface for human readable export description
+// (NBD_INFO_DESCRIPTION)
+type Describer interface {
+	Description() string
+}
+
+// Optional Backend interface for servicing NBD_CMD_CACHE.
+//
+// Prefetch is a hint that the byte range will be read soon. It should
+// schedule the data to be cached and return without waiting for it.
+// Exports that do not implement this interface are advertised without
+// NBD_FLAG_SEND_CACHE.
+type Prefetcher interface {
+	Prefetch(offset, length int64) error
+}
+
+// Optional Backend interface for writable exports.
+//
+// Exports that do not implement it are advertised as read-only.
+type Writable interface {
+	io.WriterAt
+	Flush() error
+	Trim(offset, length int64) error
+	WriteZeroes(offset, length int64, noHole bool) error
+}
+
+// Identity of connected client
+type Client struct {
+	// Remote network address
+	Addr net.Addr
+
+	// SHA256 fingerprint of client SSH key in OpenSSH format.
+	// Empty if client has not authenticated via TLS.
+	Fingerprint string
+
+	// Unique connection number, identifies clients without meaningful
+	// network address
+	conn uint64
+}
+
+func (c Client) String() string {
+	var addr string
+	if c.Addr != nil {
+		addr = fmt.Sprintf("%s://%s", c.Addr.Network(), c.Addr.String())
+	}
+	if c.Fingerprint == "" {
+		return addr
+	}
+	return fmt.Sprintf("%s (%s)", addr, c.Fingerprint)
+}
+
+// Export callback returns this error (possibly wrapped) to refuse serving
+// the requested export to the client
+var ErrForbidden = errors.New("access denied")
+
+// Export summary for NBD_OPT_LIST
+type Export struct {
+	Name        string
+	Description string
+}
+
+func New(ctx context.Context, export func(client Client, name string) (Backend, error)) *Server {
 	s := &Server{export: export}
 	s.ctxStrict, s.cancelStrict = context.WithCancelCause(ctx)
 	s.ctxSoft, s.cancelSoft = context.WithCancelCause(s.ctxStrict)
@@ -40,24 +118,68 @@ const (
 )
 
 type Server struct {
-	export                   func(name string) (Backend, error)
+	export                   func(client Client, name string) (Backend, error)
+	list                     func(client Client) ([]Export, error)
+	tls                      *tls.Config
+	tlsRequired              bool
+	limits                   Limits
+	connSlots                chan struct{}
+	sched                    *scheduler
 	ctxSoft, ctxStrict       context.Context
 	cancelSoft, cancelStrict context.CancelCauseFunc
 	conn                     sync.WaitGroup
 }
 
+// Allow clients to enumerate available exports (NBD_OPT_LIST).
+// The list should only include exports the client may access.
+// Must be called before starting any listeners.
+func (s *Server) SetExportList(list func(client Client) ([]Export, error)) {
+	s.list = list
+}
+
+// Allow clients to upgrade connection to TLS (NBD_OPT_STARTTLS).
+// When TLS is required, clients are not allowed to select any exports
+// over plain text connection.
+// Must be called before starting any listeners.
+func (s *Server) SetTLS(config *tls.Config, required bool) {
+	s.tls = config
+	s.tlsRequired = required
+}
+
 // Listen for incoming NBD connections indefinitely
 func (s *Server) Listen(network, address string) error {
-	tcp := &net.ListenConfig{}
-	l, err := tcp.Listen(s.ctxStrict, network, address)
+	l, err := NewListener(network, address)
 	if err != nil {
 		return err
 	}
+	return s.Serve(l)
+}
+
+// Open a listener suitable for Serve()
+func NewListener(network, address string) (net.Listener, error) {
+	if network == "unix" {
+		err := removeStaleSocket(address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// Accept incoming NBD connections on a pre-opened listener indefinitely
+// (for example, the one inherited via systemd socket activation).
+//
+// Closing the listener stops Serve without affecting established
+// connections. Listener is also closed when Serve returns.
+func (s *Server) Serve(l net.Listener) error {
 	defer func() { _ = l.Close() }()
 	listener, ok := l.(deadlineListener)
 	if !ok {
 		return fmt.Errorf("%T does not support deadline", l)
 	}
+	log := logger.FromContext(s.ctxSoft)
+	log.Info("accepting NBD connections", "uri", URI(l.Addr()))
+	var err error
 	for {
 		select {
 		case <-s.ctxSoft.Done():
@@ -73,6 +195,9 @@ func (s *Server) Listen(network, address string) error {
 			return err
 		}
 		err = listener.SetDeadline(time.Now().Add(connAcceptTimeout))
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -80,15 +205,58 @@ func (s *Server) Listen(network, address string) error {
 		if os.IsTimeout(err) {
 			continue
 		}
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
-			log := logger.FromContext(s.ctxSoft)
 			log.Warn("accepting connection failed", "error", err)
 			continue
 		}
+		s.conn.Add(1) // before Shutdown() may start waiting for connections
 		go s.handleConnection(conn)
 	}
 }
 
+// Unix sockets are left behind on file system if the previous server process
+// has crashed. Remove such socket if nobody is listening on it.
+func removeStaleSocket(path string) error {
+	stat, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stat.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("not a socket: %s", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("socket is in use: %s", path)
+	}
+	return os.Remove(path)
+}
+
+// NBD URI for clients connecting to the given address (without export name)
+//
+//	nbd://host:port
+//	nbd+unix:///?socket=/path/to/socket
+func URI(addr net.Addr) string {
+	switch addr.Network() {
+	case "unix":
+		return "nbd+unix:///?socket=" + socketEscaper.Replace(addr.String())
+	case "tcp", "tcp4", "tcp6":
+		return "nbd://" + addr.String()
+	default:
+		return fmt.Sprintf("%s://%s", addr.Network(), addr.String())
+	}
+}
+
+// Socket paths are mostly left readable, only the characters that would
+// break URI parsing are escaped
+var socketEscaper = strings.NewReplacer("%", "%25", "&", "%26", "#", "%23", "+", "%2B", " ", "%20")
+
 // Listen for OS signals to initiate graceful shutdown
 func (s *Server) ListenShutdown(sig ...os.Signal) {
 	if len(sig) == 0 {
@@ -134,9 +302,8 @@ type deadlineListener interface {
 // Service a single client connection.
 //
 // Unlike with other common layer 7 protocols (like HTTP) these connections are
-// very long lived.
+// very long lived. Connection must be registered via s.conn.Add() by the caller.
 func (s *Server) handleConnection(conn net.Conn) {
-	s.conn.Add(1)
 	defer s.conn.Done()
 	defer func() { _ = conn.Close() }()
 
@@ -144,7 +311,21 @@ func (s *Server) handleConnection(conn net.Conn) {
 	client := fmt.Sprintf("%s://%s", addr.Network(), addr.String())
 	ctx, log := logger.With(s.ctxSoft, "client", client)
 
+	if s.connSlots != nil {
+		select {
+		case s.connSlots <- struct{}{}:
+			defer func() { <-s.connSlots }()
+		default:
+			log.Warn("connection limit reached, refusing client", "limit", s.limits.Connections)
+			return
+		}
+	}
+
 	err := s.serveNBD(ctx, conn)
+	if errors.Is(err, errIdle) {
+		log.Info("disconnected idle client", "error", err)
+		return
+	}
 	if err != nil {
 		log.Error("disconnected on failure", "error", err)
 		return
@@ -154,20 +335,30 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 // Speak NBD protocol over a single TCP/TLS connection
 func (s *Server) serveNBD(ctx context.Context, conn net.Conn) error {
+	if s.limits.IdleTimeout > 0 {
+		err := conn.SetDeadline(time.Now().Add(s.limits.IdleTimeout))
+		if err != nil {
+			return fmt.Errorf("negotiation deadline: %w", err)
+		}
+	}
 	err := handshake(conn)
 	if err != nil {
 		return fmt.Errorf("handshake: %w", err)
 	}
-	backend, err := negotiate(ctx, conn, s.export)
+	state, err := s.negotiate(ctx, conn)
 	if err != nil {
 		return fmt.Errorf("negotiation: %w", err)
 	}
-	if b, ok := backend.(io.Closer); ok {
+	if b, ok := state.backend.(io.Closer); ok {
 		defer func() { _ = b.Close() }()
 	}
+	err = state.conn.SetDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("reset negotiation deadline: %w", err)
+	}
 	log := logger.FromContext(ctx)
-	log.Info("new client connected")
-	err = transmission(ctx, conn, backend)
+	log.Info("new client connected", "structured_replies", state.structured, "extended_headers", state.extended, "tls", state.tls)
+	err = s.transmission(ctx, state.conn, state)
 	if err != nil {
 		return fmt.Errorf("transmission: %w", err)
 	}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"testing"
+
+	"context"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nbd.sock")
+
+	// Socket left behind by a crashed process
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	srv := New(context.Background(), nil)
+	done := make(chan error, 1)
+	go func() { done <- srv.Listen("unix", path) }()
+
+	var conn net.Conn
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		conn, err = net.Dial("unix", path)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("connecting to unix socket: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var hello struct {
+		Magic  uint64
+		Option uint64
+		Flags  uint16
+	}
+	err = receive(conn, &hello)
+	if err != nil {
+		t.Fatalf("receiving handshake: %v", err)
+	}
+	if hello.Magic != NBDMAGIC || hello.Option != IHAVEOPT {
+		t.Fatalf("unexpected handshake: %+v", hello)
+	}
+	_ = conn.Close()
+
+	// Second server must not steal the socket from the first one
+	err = New(context.Background(), nil).Listen("unix", path)
+	if err == nil {
+		t.Fatalf("listening on a socket that is in use did not fail")
+	}
+
+	srv.Shutdown()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("listener: %v", err)
+		}
+	case <-time.After(2 * connAcceptTimeout):
+		t.Fatalf("listener did not stop after shutdown")
+	}
+	_, err = net.Dial("unix", path)
+	if err == nil {
+		t.Fatalf("socket still accepts connections after shutdown")
+	}
+}
+
+func TestURI(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		uri  string
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10809}, "nbd://127.0.0.1:10809"},
+		{&net.TCPAddr{IP: net.IPv6loopback, Port: 10809}, "nbd://[::1]:10809"},
+		{&net.UnixAddr{Name: "/run/pond/nbd.sock", Net: "unix"}, "nbd+unix:///?socket=/run/pond/nbd.sock"},
+		{&net.UnixAddr{Name: "/tmp/a&b #1.sock", Net: "unix"}, "nbd+unix:///?socket=/tmp/a%26b%20%231.sock"},
+	}
+	for _, tt := range tests {
+		if got := URI(tt.addr); got != tt.uri {
+			t.Errorf("URI(%v): got %q, want %q", tt.addr, got, tt.uri)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package verity
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Data filesystems that are recognized when looking for verity hash tree
+var filesystems = []struct {
+	name string
+	size func(partition io.ReaderAt) (int64, error)
+}{
+	{"squashfs", squashfsSize},
+	{"erofs", erofsSize},
+	{"ext4", ext4Size},
+}
+
+// Find verity superblock and hash tree after data filesystem
+func verityAfterFilesystem(partition io.ReaderAt) (v Verity, err error) {
+	var errs []string
+	for _, fs := range filesystems {
+		size, err := fs.size(partition)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", fs.name, err))
+			continue
+		}
+		return verityAfter(partition, size)
+	}
+	return v, fmt.Errorf("unsupported data partition (%s)", strings.Join(errs, "; "))
+}
+
+// Find verity superblock after data filesystem of the given size. Verity
+// superblock immediately follows filesystem or its 4k aligned padding
+// (default in mksquashfs).
+func verityAfter(partition io.ReaderAt, size int64) (v Verity, err error) {
+	const align = 4096
+	candidates := []int64{size}
+	if size%align != 0 {
+		candidates = append(candidates, (size/align+1)*align)
+	}
+	for _, offset := range candidates {
+		v, err = verityAt(partition, offset)
+		if err == nil {
+			return v, nil
+		}
+	}
+	return v, err
+}
+
+// Superblocks of erofs and ext4 are stored at the same offset
+const superblockOffset = 1024
+
+// Erofs superblock (only the fields we need)
+// <https://docs.kernel.org/filesystems/erofs.html>
+type erofsSuperblock struct {
+	Magic         uint32
+	Checksum      uint32
+	FeatureCompat uint32
+	BlockSizeBits uint8
+	ExtSlots      uint8
+	RootNid       uint16
+	Inodes        uint64
+	BuildTime     uint64
+	BuildTimeNsec uint32
+	Blocks        uint32
+}
+
+func (sb *erofsSuperblock) Validate() error {
+	if sb.Magic != 0xe0f5e1e2 {
+		return fmt.Errorf("invalid superblock magic: %#x", sb.Magic)
+	}
+	if sb.BlockSizeBits < 9 || sb.BlockSizeBits > 16 {
+		return fmt.Errorf("invalid block size: 2^%d", sb.BlockSizeBits)
+	}
+	return nil
+}
+
+// Size of erofs filesystem in bytes
+func erofsSize(partition io.ReaderAt) (int64, error) {
+	var erofs erofsSuperblock
+	err := binary.Read(&offsetReader{Reader: partition, Offset: superblockOffset}, binary.LittleEndian, &erofs)
+	if err != nil {
+		return 0, fmt.Errorf("reading superblock: %w", err)
+	}
+	err = erofs.Validate()
+	if err != nil {
+		return 0, err
+	}
+	return int64(erofs.Blocks) << erofs.BlockSizeBits, nil
+}
+
+// Ext4 superblock (only the fields we need), also matches ext2 and ext3
+// <https://docs.kernel.org/filesystems/ext4/globals.html#super-block>
+type ext4Superblock struct {
+	InodesCount     uint32 // 0x0
+	BlocksCountLo   uint32 // 0x4
+	_               [0x10]byte
+	LogBlockSize    uint32 // 0x18
+	_               [0x1c]byte
+	Magic           uint16 // 0x38
+	_               [0x26]byte
+	FeatureIncompat uint32 // 0x60
+	_               [0xec]byte
+	BlocksCountHi   uint32 // 0x150
+}
+
+const ext4Incompat64Bit = 0x80
+
+func (sb *ext4Superblock) Validate() error {
+	if sb.Magic != 0xef53 {
+		return fmt.Errorf("invalid superblock magic: %#x", sb.Magic)
+	}
+	if sb.LogBlockSize > 6 {
+		return fmt.Errorf("invalid block size: 2^%d", 10+sb.LogBlockSize)
+	}
+	return nil
+}
+
+// Size of ext4 filesystem in bytes
+func ext4Size(partition io.ReaderAt) (int64, error) {
+	var ext4 ext4Superblock
+	err := binary.Read(&offsetReader{Reader: partition, Offset: superblockOffset}, binary.LittleEndian, &ext4)
+	if err != nil {
+		return 0, fmt.Errorf("reading superblock: %w", err)
+	}
+	err = ext4.Validate()
+	if err != nil {
+		return 0, err
+	}
+	blocks := int64(ext4.BlocksCountLo)
+	if ext4.FeatureIncompat&ext4Incompat64Bit != 0 {
+		blocks |= int64(ext4.BlocksCountHi) << 32
+	}
+	return blocks << (10 + ext4.LogBlockSize), nil
+}
@@ -6,38 +6,18 @@ import (
 	"io"
 )
 
-func verityAfterSquashfs(partition io.ReaderAt) (v Verity, err error) {
-	reader := &offsetReader{Reader: partition, Offset: 0}
-
-	// Parse squashfs superblock
+// Size of squashfs filesystem in bytes (without padding)
+func squashfsSize(partition io.ReaderAt) (int64, error) {
 	var squashfs squashfsSuperblock
-	err = binary.Read(reader, binary.LittleEndian, &squashfs)
+	err := binary.Read(&offsetReader{Reader: partition}, binary.LittleEndian, &squashfs)
 	if err != nil {
-		return v, fmt.Errorf("reading squashfs superblock: %w", err)
+		return 0, fmt.Errorf("reading superblock: %w", err)
 	}
 	err = squashfs.Validate()
 	if err != nil {
-		return v, fmt.Errorf("squashfs: %w", err)
-	}
-
-	// Assume 4k alignment (default in mksquashfs)
-	const align = 4096
-	v.superblockOffset = int64(squashfs.BytesUsed) / align * align
-	if squashfs.BytesUsed%align != 0 {
-		v.superblockOffset += align
-	}
-
-	// Assume that verity superblock and hash tree immediately follow squashfs partition
-	reader.Offset = v.superblockOffset
-	err = binary.Read(reader, binary.LittleEndian, &v.veritySuperblock)
-	if err != nil {
-		return v, fmt.Errorf("reading verity superblock: %w", err)
-	}
-	err = v.validate()
-	if err != nil {
-		return v, fmt.Errorf("verity: %w", err)
+		return 0, err
 	}
-	return v, nil
+	return int64(squashfs.BytesUsed), nil
 }
 
 // Squashfs superblock
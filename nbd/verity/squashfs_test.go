@@ -21,7 +21,7 @@ func TestQuickAndDirty(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	verity, err := verityAfterSquashfs(file)
+	verity, err := verityAfterFilesystem(file)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,7 +57,7 @@ func BenchmarkVerifySingleBlock(b *testing.B) {
 	if err != nil {
 		b.Fatal(err)
 	}
-	verity, err := verityAfterSquashfs(file)
+	verity, err := verityAfterFilesystem(file)
 	if err != nil {
 		b.Fatal(err)
 	}
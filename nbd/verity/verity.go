@@ -1,41 +1,216 @@
-// Quick data integrity verification using dm-verity hash tree.
-// This is not intended to be a full verity implementation.
+// Data integrity verification using dm-verity hash tree.
+//
+// By default only leaf hashes are checked, which guards against accidental
+// data corruption. When root hash is provided by the caller (see OpenWithRoot)
+// the whole hash tree is verified up to the root, which guards against
+// tampering with both data and hash tree.
 package verity
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
 	"fmt"
 	"hash"
 	"io"
+	"math/bits"
+	"sync"
 )
 
 // Parse verity hash tree appended to data partition.
-// Currently only squashfs partitions are supported.
+// Supported data filesystems: squashfs, erofs, ext4.
 //
 // Does not capture the provided reader.
 func Open(r io.ReaderAt) (Verity, error) {
-	return verityAfterSquashfs(r)
+	return OpenLayout(r, nil, Layout{}, nil)
+}
+
+// Parse verity hash tree and pin it to the root hash provided by caller
+// (e.g. the one printed by `veritysetup format`). Top level of hash tree is
+// checked against root hash right away.
+func OpenWithRoot(r io.ReaderAt, root []byte) (Verity, error) {
+	return OpenLayout(r, nil, Layout{}, root)
+}
+
+// Location of verity hash tree and its parameters. Zero value means that
+// hash tree with verity superblock is appended to data filesystem.
+type Layout struct {
+	// Offset of verity superblock on hash device. If hash tree is stored on
+	// data device, zero offset means that it follows data filesystem.
+	HashOffset int64
+
+	// Hash tree parameters for verity without superblock (veritysetup
+	// --no-superblock), nil if superblock is present. HashOffset points to
+	// the first hash block in this case.
+	Params *Params
+}
+
+// Hash tree parameters, zero values mean veritysetup defaults
+type Params struct {
+	Algorithm     string // "sha256" (default), "sha512" or "sha1"
+	DataBlockSize uint32 // 4096 if zero
+	HashBlockSize uint32 // 4096 if zero
+	DataBlocks    uint64 // HashOffset/DataBlockSize if zero, only if hash tree is stored on data device
+	Salt          []byte
+}
+
+// Parse verity hash tree at any supported location.
+//
+// Hash tree is read from a separate hash device if it is not nil, and from
+// data device otherwise. Root hash is optional, see OpenWithRoot.
+//
+// Does not capture data reader. Hash device is captured and must stay
+// readable for as long as Verity is used.
+func OpenLayout(data, hashes io.ReaderAt, layout Layout, root []byte) (v Verity, err error) {
+	device := data
+	if hashes != nil {
+		device = hashes
+	}
+	switch {
+	case layout.Params != nil:
+		v.veritySuperblock, err = layout.Params.superblock(hashes == nil, layout.HashOffset)
+		if err != nil {
+			return v, err
+		}
+		v.hashOffset = layout.HashOffset
+		v.layout(layout.HashOffset)
+	case hashes == nil && layout.HashOffset == 0:
+		v, err = verityAfterFilesystem(data)
+		if err != nil {
+			return v, err
+		}
+	default:
+		v, err = verityAt(device, layout.HashOffset)
+		if err != nil {
+			return v, err
+		}
+	}
+	v.hashes = hashes
+	if root == nil {
+		return v, nil
+	}
+	if len(root) != v.hash().Size() {
+		return v, fmt.Errorf("invalid root hash length: %d bytes", len(root))
+	}
+	if hashes == nil && v.DataSize() < v.hashOffset {
+		// Everything before hash tree must be covered by it, otherwise
+		// tampered superblock could exclude some data from verification
+		return v, fmt.Errorf("hash tree does not cover the whole data partition: %d < %d bytes", v.DataSize(), v.hashOffset)
+	}
+	v.root = bytes.Clone(root)
+	v.verified = &blockCache{blocks: make(map[blockID][]byte)}
+	_, err = v.hashBlock(data, v.hash(), len(v.levels)-1, 0)
+	if err != nil {
+		return v, err
+	}
+	return v, nil
 }
 
+// Parse verity superblock at given offset, hash tree follows it
+func verityAt(r io.ReaderAt, offset int64) (v Verity, err error) {
+	reader := &offsetReader{Reader: r, Offset: offset}
+	err = binary.Read(reader, binary.LittleEndian, &v.veritySuperblock)
+	if err != nil {
+		return v, fmt.Errorf("reading verity superblock: %w", err)
+	}
+	err = v.validate()
+	if err != nil {
+		return v, fmt.Errorf("verity: %w", err)
+	}
+	v.hashOffset = offset
+	tree := offset + superblockSize + int64(v.HashBlockSize) - 1
+	v.layout(tree / int64(v.HashBlockSize) * int64(v.HashBlockSize))
+	return v, nil
+}
+
+// Verity hash tree. Safe for concurrent use.
 type Verity struct {
 	veritySuperblock
-	superblockOffset int64
-	leafHashOffset   int64
+	hashes         io.ReaderAt // separate hash device, nil if hash tree is stored on data device
+	hashOffset     int64       // verity superblock or the first hash block if there is none
+	leafHashOffset int64
+	levels         []hashLevel // from leaves to root
+
+	root     []byte      // nil if only leaf hashes are checked
+	verified *blockCache // interior hash blocks verified against root hash
+}
+
+// Single level of hash tree
+type hashLevel struct {
+	offset int64 // first hash block
+	blocks int64
+}
+
+// Hash blocks that were verified up to the root hash
+type blockCache struct {
+	mu     sync.RWMutex
+	blocks map[blockID][]byte
+}
+
+type blockID struct {
+	level int
+	index int64
+}
+
+func (c *blockCache) get(id blockID) ([]byte, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	block, found := c.blocks[id]
+	return block, found
+}
+
+func (c *blockCache) put(id blockID, block []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocks[id] = block
+}
+
+// Size of data region protected by hash tree. Verity superblock and hash tree
+// are stored after that.
+func (t *Verity) DataSize() int64 {
+	return int64(t.DataBlockCount) * int64(t.DataBlockSize)
+}
+
+// Check if hash tree is pinned to root hash
+func (t *Verity) Pinned() bool {
+	return t.root != nil
 }
 
 // Verify integrity of data region described by provided offset and size.
 //
-// This check guards only against accidental data corruption:
-// only leaf hashes of verity tree are being calculated and compared.
-// Use cryptsetup tools to get full integrity guarantees provided by dm-verity.
+// Without root hash only leaf hashes of verity tree are being calculated and
+// compared: this check guards only against accidental data corruption.
 func (t *Verity) Verify(r io.ReaderAt, offset int64, size int) error {
 	hash := t.hash()
-	if t.leafHashOffset < t.superblockOffset {
-		t.findFirstLeafHash(hash)
-	}
-	for block := int(offset / int64(t.DataBlockSize)); size > 0 && uint64(block) < t.DataBlockCount; block++ {
-		err := t.verifyBlock(r, hash, block)
+	var leaf []byte
+	leafIndex := int64(-1)
+	perBlock := t.hashesPerBlock()
+	for block := offset / int64(t.DataBlockSize); size > 0 && uint64(block) < t.DataBlockCount; block++ {
+		var want []byte
+		if t.root != nil {
+			// Consecutive data blocks share leaf hash block
+			if block/perBlock != leafIndex {
+				var err error
+				leafIndex = block / perBlock
+				leaf, err = t.hashBlock(r, hash, 0, leafIndex)
+				if err != nil {
+					return err
+				}
+			}
+			want = t.entry(leaf, block%perBlock, hash.Size())
+		} else {
+			want = make([]byte, hash.Size())
+			n, err := t.hashDevice(r).ReadAt(want, t.leafHashOffset+block*t.digestStride())
+			if err != nil && !(err == io.EOF && n == len(want)) {
+				return fmt.Errorf("reading verity hash: %w", err)
+			}
+			if n != len(want) {
+				return fmt.Errorf("reading verity hash: short read")
+			}
+		}
+		err := t.verifyBlock(r, hash, block, want)
 		if err != nil {
 			return err
 		}
@@ -45,55 +220,120 @@ func (t *Verity) Verify(r io.ReaderAt, offset int64, size int) error {
 }
 
 // Verify integrity of data block with given index
-func (t *Verity) verifyBlock(r io.ReaderAt, hash hash.Hash, index int) error {
-	// Expected data block hash
-	want := make([]byte, hash.Size())
-	n, err := r.ReadAt(want, t.leafHashOffset+int64(index)*int64(hash.Size()))
+func (t *Verity) verifyBlock(r io.ReaderAt, hash hash.Hash, index int64, want []byte) error {
+	reader := &offsetReader{Reader: r, Offset: index * int64(t.DataBlockSize)}
+	got, err := t.digest(hash, io.LimitReader(reader, int64(t.DataBlockSize)), int64(t.DataBlockSize))
 	if err != nil {
-		return fmt.Errorf("reading verity hash: %w", err)
+		return err
 	}
-	if n != len(want) {
-		return fmt.Errorf("reading verity hash: short read")
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("hash mismatch for block %d: want %x, got %x", index, want, got)
 	}
+	return nil
+}
+
+// Read hash block and verify it up to the root hash
+func (t *Verity) hashBlock(r io.ReaderAt, hash hash.Hash, level int, index int64) ([]byte, error) {
+	id := blockID{level: level, index: index}
+	if level > 0 {
+		if block, found := t.verified.get(id); found {
+			return block, nil
+		}
+	}
+	if index >= t.levels[level].blocks {
+		return nil, fmt.Errorf("hash block %d is out of range at level %d", index, level)
+	}
+	block := make([]byte, t.HashBlockSize)
+	n, err := t.hashDevice(r).ReadAt(block, t.levels[level].offset+index*int64(t.HashBlockSize))
+	if n != len(block) {
+		return nil, fmt.Errorf("reading hash block %d at level %d: %w", index, level, err)
+	}
+	got, err := t.digest(hash, bytes.NewReader(block), int64(len(block)))
+	if err != nil {
+		return nil, err
+	}
+	var want []byte
+	if level == len(t.levels)-1 {
+		want = t.root
+	} else {
+		parent, err := t.hashBlock(r, hash, level+1, index/t.hashesPerBlock())
+		if err != nil {
+			return nil, err
+		}
+		want = t.entry(parent, index%t.hashesPerBlock(), hash.Size())
+	}
+	if !bytes.Equal(got, want) {
+		return nil, fmt.Errorf("hash mismatch for hash block %d at level %d: want %x, got %x", index, level, want, got)
+	}
+	if level > 0 {
+		t.verified.put(id, block)
+	}
+	return block, nil
+}
 
-	// Actual data block hash
+// Hash blocks are read from separate hash device if there is one
+func (t *Verity) hashDevice(data io.ReaderAt) io.ReaderAt {
+	if t.hashes != nil {
+		return t.hashes
+	}
+	return data
+}
+
+// Salted hash of a data or hash block
+func (t *Verity) digest(hash hash.Hash, block io.Reader, size int64) ([]byte, error) {
 	hash.Reset()
-	_, err = hash.Write(t.Salt[:int(t.SaltSize)])
+	_, err := hash.Write(t.Salt[:int(t.SaltSize)])
 	if err != nil {
-		return err
+		return nil, err
 	}
-	reader := &offsetReader{Reader: r, Offset: int64(index) * int64(t.DataBlockSize)}
-	_, err = io.CopyN(hash, reader, int64(t.DataBlockSize))
+	n, err := io.Copy(hash, block)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	got := hash.Sum(nil)
-	if !bytes.Equal(got, want) {
-		return fmt.Errorf("hash mismatch for block %d: want %x, got %x", index, want, got)
+	if n != size {
+		return nil, fmt.Errorf("reading block: %w", io.ErrUnexpectedEOF)
 	}
-	return nil
+	return hash.Sum(nil), nil
+}
+
+// Hash of the child block with given index within parent hash block
+func (t *Verity) entry(parent []byte, index int64, size int) []byte {
+	start := index * t.digestStride()
+	return parent[start : start+int64(size)]
 }
 
-func (t *Verity) findFirstLeafHash(hash hash.Hash) {
-	hashesPerBlock := int64(t.HashBlockSize) / int64(hash.Size())
-	var layer []int64
-	var i int
+// Hashes are padded to the power of two within hash blocks
+func (t *Verity) digestStride() int64 {
+	return 1 << bits.Len(uint(t.hash().Size()-1))
+}
+
+func (t *Verity) hashesPerBlock() int64 {
+	return int64(t.HashBlockSize) / t.digestStride()
+}
+
+// Calculate hash tree layout. Tree levels are stored starting from the root.
+func (t *Verity) layout(offset int64) {
+	perBlock := t.hashesPerBlock()
+	var counts []int64
 	blocks := int64(t.DataBlockCount)
-	for blocks > 1 {
-		layer = append(layer, blocks/hashesPerBlock)
-		if blocks%hashesPerBlock != 0 {
-			layer[i]++
+	for {
+		blocks = (blocks + perBlock - 1) / perBlock
+		counts = append(counts, blocks)
+		if blocks <= 1 {
+			break
 		}
-		blocks = layer[i]
-		i++
 	}
-	var offset int64
-	for i = 1; i < len(layer); i++ {
-		offset += layer[i] * int64(t.HashBlockSize)
+	t.levels = make([]hashLevel, len(counts))
+	for i := len(counts) - 1; i >= 0; i-- {
+		t.levels[i] = hashLevel{offset: offset, blocks: counts[i]}
+		offset += counts[i] * int64(t.HashBlockSize)
 	}
-	t.leafHashOffset = t.superblockOffset + int64(t.HashBlockSize) + offset
+	t.leafHashOffset = t.levels[0].offset
 }
 
+// Space reserved for verity superblock on disk
+const superblockSize = 512
+
 // Verity superblock
 // <https://gitlab.com/cryptsetup/cryptsetup/-/wikis/DMVerity#verity-superblock-format>
 type veritySuperblock struct {
@@ -122,31 +362,87 @@ func (sb *veritySuperblock) validate() error {
 	if sb.Type != 1 {
 		return fmt.Errorf("unsupported superblock type: %d (%#x)", sb.Type, sb.Type)
 	}
-	var hashSize uint16
-	switch string(sb.Algorithm[:bytes.IndexByte(sb.Algorithm[:], 0)]) {
-	case "sha256":
-		hashSize = sha256.Size
-	default:
-		return fmt.Errorf("unsupported hash algorithm: %s (%#x)", string(sb.Algorithm[:]), sb.Algorithm)
+	newHash, found := algorithms[sb.algorithm()]
+	if !found {
+		return fmt.Errorf("unsupported hash algorithm: %s (%#x)", sb.algorithm(), sb.Algorithm)
 	}
-	if sb.SaltSize < hashSize {
-		return fmt.Errorf("salt too short: %d bit", int(sb.SaltSize)*8)
+	// Salt as long as the hash, but no longer than veritysetup default one
+	if int(sb.SaltSize) < min(newHash().Size(), 32) || int(sb.SaltSize) > len(sb.Salt) {
+		return fmt.Errorf("invalid salt size: %d bit", int(sb.SaltSize)*8)
 	}
 	var zero [256]byte
 	if sb.Salt == zero {
 		return fmt.Errorf("empty salt in superblock: %#x", sb.Salt)
 	}
+	for _, size := range []uint32{sb.DataBlockSize, sb.HashBlockSize} {
+		if size < 512 || size > 1<<20 || size&(size-1) != 0 {
+			return fmt.Errorf("invalid block size: %d", size)
+		}
+	}
+	if sb.DataBlockCount == 0 {
+		return fmt.Errorf("empty data partition")
+	}
 	return nil
 }
 
+// Supported hash algorithms
+var algorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func (sb *veritySuperblock) algorithm() string {
+	name, _, _ := bytes.Cut(sb.Algorithm[:], []byte{0})
+	return string(name)
+}
+
 func (sb *veritySuperblock) hash() hash.Hash {
-	const prefix = 6 // number of bytes that uniquely identify each supported algorithm
-	switch string(sb.Algorithm[:prefix]) {
-	case "sha256":
-		return sha256.New()
-	default:
+	newHash, found := algorithms[sb.algorithm()]
+	if !found {
 		panic("attempting to initialize hash function before superblock validation")
 	}
+	return newHash()
+}
+
+// Build superblock for verity without one
+func (p *Params) superblock(sameDevice bool, hashOffset int64) (sb veritySuperblock, err error) {
+	copy(sb.Magic[:], "verity")
+	sb.Version = 1
+	sb.Type = 1
+	algorithm := p.Algorithm
+	if algorithm == "" {
+		algorithm = "sha256"
+	}
+	if len(algorithm) >= len(sb.Algorithm) {
+		return sb, fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+	}
+	copy(sb.Algorithm[:], algorithm)
+	sb.DataBlockSize = p.DataBlockSize
+	if sb.DataBlockSize == 0 {
+		sb.DataBlockSize = 4096
+	}
+	sb.HashBlockSize = p.HashBlockSize
+	if sb.HashBlockSize == 0 {
+		sb.HashBlockSize = 4096
+	}
+	sb.DataBlockCount = p.DataBlocks
+	if sb.DataBlockCount == 0 && sameDevice {
+		sb.DataBlockCount = uint64(hashOffset) / uint64(sb.DataBlockSize)
+	}
+	if len(p.Salt) > len(sb.Salt) {
+		return sb, fmt.Errorf("salt too long: %d bytes", len(p.Salt))
+	}
+	sb.SaltSize = uint16(len(p.Salt))
+	copy(sb.Salt[:], p.Salt)
+	err = sb.validate()
+	if err != nil {
+		return sb, fmt.Errorf("verity parameters: %w", err)
+	}
+	if hashOffset < 0 || hashOffset%int64(sb.HashBlockSize) != 0 {
+		return sb, fmt.Errorf("verity parameters: hash offset is not aligned to hash block size: %d", hashOffset)
+	}
+	return sb, nil
 }
 
 type offsetReader struct {
@@ -0,0 +1,393 @@
+package verity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+)
+
+const testdataRoot = "7b26410ba9cd392d5e95c2f373cdfbd894fa406b351ed54ac5b6416e5514f5f4"
+
+func TestRootHash(t *testing.T) {
+	image, err := os.ReadFile("testdata/pseudorandom.squashfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := hex.DecodeString(testdataRoot)
+
+	v, err := OpenWithRoot(bytes.NewReader(image), root)
+	if err != nil {
+		t.Fatalf("valid root hash: %v", err)
+	}
+	if !v.Pinned() {
+		t.Fatal("verity is not pinned to root hash")
+	}
+	err = v.Verify(bytes.NewReader(image), 0, int(v.DataSize()))
+	if err != nil {
+		t.Fatalf("verify whole image: %v", err)
+	}
+
+	wrong := bytes.Clone(root)
+	wrong[0] ^= 1
+	_, err = OpenWithRoot(bytes.NewReader(image), wrong)
+	if err == nil {
+		t.Fatal("wrong root hash was accepted")
+	}
+	_, err = OpenWithRoot(bytes.NewReader(image), root[:10])
+	if err == nil {
+		t.Fatal("truncated root hash was accepted")
+	}
+
+	// Data block and its leaf hash are replaced consistently: leaf-only
+	// verification is fooled, full tree verification is not
+	const block = 7
+	tampered := bytes.Clone(image)
+	tampered[block*4096] ^= 0xff
+	leaf, err := v.digest(v.hash(), bytes.NewReader(tampered[block*4096:(block+1)*4096]), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(tampered[v.leafHashOffset+block*sha256.Size:], leaf)
+	unpinned, err := Open(bytes.NewReader(tampered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unpinned.Verify(bytes.NewReader(tampered), block*4096, 1)
+	if err != nil {
+		t.Fatalf("leaf-only verification should not detect consistent tampering: %v", err)
+	}
+	err = v.Verify(bytes.NewReader(tampered), block*4096, 1)
+	if err == nil {
+		t.Fatal("tampered hash tree was accepted")
+	}
+	_, err = OpenWithRoot(bytes.NewReader(tampered), root)
+	if err == nil {
+		t.Fatal("tampered hash tree was accepted at open")
+	}
+}
+
+func TestHashTreeLevels(t *testing.T) {
+	const blocks = 304 // 304 -> 19 -> 2 -> 1 with 16 hashes per block
+	tree := testTree{algorithm: "sha256", blockSize: 512}
+	data := squashfsStub(testData(blocks*tree.blockSize), 4095)
+	image, root := tree.appendTo(t, data)
+
+	v, err := OpenWithRoot(bytes.NewReader(image), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.levels) != 3 {
+		t.Fatalf("unexpected number of tree levels: %d", len(v.levels))
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := v.Verify(bytes.NewReader(image), 0, len(data))
+			if err != nil {
+				t.Errorf("verify whole image: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every level of hash tree is checked
+	for level := range v.levels {
+		tampered := bytes.Clone(image)
+		last := v.levels[level].blocks - 1
+		tampered[v.levels[level].offset+last*int64(tree.blockSize)] ^= 1
+		fresh, err := OpenWithRoot(bytes.NewReader(tampered), root)
+		if level == len(v.levels)-1 {
+			if err == nil {
+				t.Errorf("tampered top level hash block was accepted")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fresh.Verify(bytes.NewReader(tampered), int64(len(data)-1), 1)
+		if err == nil {
+			t.Errorf("tampered hash block at level %d was accepted", level)
+		}
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	for _, algorithm := range []string{"sha1", "sha256", "sha512"} {
+		tree := testTree{algorithm: algorithm, blockSize: 512}
+		data := squashfsStub(testData(104*tree.blockSize), 0)
+		image, root := tree.appendTo(t, data)
+		v, err := OpenWithRoot(bytes.NewReader(image), root)
+		if err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+			continue
+		}
+		err = v.Verify(bytes.NewReader(image), 0, len(data))
+		if err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+		}
+		image[len(data)/2] ^= 1
+		err = v.Verify(bytes.NewReader(image), 0, len(data))
+		if err == nil {
+			t.Errorf("%s: corrupted data was accepted", algorithm)
+		}
+	}
+
+	_, err := OpenLayout(nil, bytes.NewReader(make([]byte, 4096)), Layout{Params: &Params{
+		Algorithm:  "md5",
+		DataBlocks: 1,
+		Salt:       testData(32),
+	}}, nil)
+	if err == nil {
+		t.Error("unsupported hash algorithm was accepted")
+	}
+}
+
+func TestLayouts(t *testing.T) {
+	tree := testTree{algorithm: "sha256", blockSize: 4096}
+	data := testData(20 * tree.blockSize)
+	hashes, root := tree.build(data)
+	header := tree.superblock(t, len(data))
+	params := &Params{Salt: tree.salt()}
+
+	for _, tt := range []struct {
+		name   string
+		data   []byte
+		hashes []byte // separate hash device
+		layout Layout
+	}{
+		{
+			name:   "separate hash device",
+			data:   data,
+			hashes: concat(header, hashes),
+		},
+		{
+			name:   "separate hash device with offset",
+			data:   data,
+			hashes: concat(make([]byte, 1000), header[:tree.blockSize-1000], hashes),
+			layout: Layout{HashOffset: 1000},
+		},
+		{
+			name:   "hash offset",
+			data:   concat(data, header, hashes),
+			layout: Layout{HashOffset: int64(len(data))},
+		},
+		{
+			name:   "no superblock",
+			data:   concat(data, hashes),
+			layout: Layout{HashOffset: int64(len(data)), Params: params},
+		},
+		{
+			name:   "no superblock on separate hash device",
+			data:   data,
+			hashes: hashes,
+			layout: Layout{Params: &Params{DataBlocks: 20, Salt: tree.salt()}},
+		},
+	} {
+		var device io.ReaderAt
+		if tt.hashes != nil {
+			device = bytes.NewReader(tt.hashes)
+		}
+		v, err := OpenLayout(bytes.NewReader(tt.data), device, tt.layout, root)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		err = v.Verify(bytes.NewReader(tt.data), 0, len(data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	// Hash tree must cover everything before it
+	padded := concat(data, make([]byte, tree.blockSize), header, hashes)
+	_, err := OpenLayout(bytes.NewReader(padded), nil, Layout{HashOffset: int64(len(data) + tree.blockSize)}, root)
+	if err == nil {
+		t.Error("data not covered by hash tree was accepted")
+	}
+
+	// Separate hash device without superblock needs to know data size
+	_, err = OpenLayout(bytes.NewReader(data), bytes.NewReader(hashes), Layout{Params: params}, root)
+	if err == nil {
+		t.Error("unknown data size was accepted")
+	}
+}
+
+func TestFilesystems(t *testing.T) {
+	tree := testTree{algorithm: "sha256", blockSize: 4096}
+	data := testData(20 * tree.blockSize)
+	for name, partition := range map[string][]byte{
+		"squashfs": squashfsStub(data, 100),
+		"erofs":    erofsStub(data),
+		"ext4":     ext4Stub(data),
+	} {
+		image, root := tree.appendTo(t, partition)
+		v, err := OpenWithRoot(bytes.NewReader(image), root)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		err = v.Verify(bytes.NewReader(image), 0, len(data))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	_, err := Open(bytes.NewReader(data))
+	if err == nil {
+		t.Error("unknown filesystem was accepted")
+	}
+}
+
+func TestTreeBuilder(t *testing.T) {
+	image, err := os.ReadFile("testdata/pseudorandom.squashfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := Open(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := testTree{algorithm: "sha256", blockSize: int(v.HashBlockSize), salted: v.Salt[:v.SaltSize]}
+	hashes, root := tree.build(image[:v.DataSize()])
+	if hex.EncodeToString(root) != testdataRoot {
+		t.Fatalf("root hash mismatch: %x", root)
+	}
+	if !bytes.Equal(hashes, image[v.levels[len(v.levels)-1].offset:]) {
+		t.Fatal("hash tree differs from the one generated by veritysetup")
+	}
+}
+
+// Hash tree builder that mimics veritysetup (format version 1).
+// Data and hash block sizes are the same.
+type testTree struct {
+	algorithm string
+	blockSize int
+	salted    []byte // salt, fixed one is used if empty
+}
+
+func (tree testTree) salt() []byte {
+	if tree.salted != nil {
+		return tree.salted
+	}
+	return bytes.Repeat([]byte{0x5a}, 32)
+}
+
+// Calculate hash tree levels starting from the root
+func (tree testTree) build(data []byte) (hashes, root []byte) {
+	newHash := algorithms[tree.algorithm]
+	stride := 1
+	for stride < newHash().Size() {
+		stride *= 2
+	}
+	digest := func(block []byte) []byte {
+		hash := newHash()
+		hash.Write(tree.salt())
+		hash.Write(block)
+		return hash.Sum(nil)
+	}
+	var levels [][]byte
+	for level := data; ; {
+		var next []byte
+		for start := 0; start < len(level); start += tree.blockSize {
+			sum := digest(level[start : start+tree.blockSize])
+			next = append(next, sum...)
+			next = append(next, make([]byte, stride-len(sum))...)
+		}
+		if pad := len(next) % tree.blockSize; pad != 0 {
+			next = append(next, make([]byte, tree.blockSize-pad)...)
+		}
+		levels = append(levels, next)
+		if len(next) == tree.blockSize {
+			break
+		}
+		level = next
+	}
+	for i := len(levels) - 1; i >= 0; i-- {
+		hashes = append(hashes, levels[i]...)
+	}
+	return hashes, digest(levels[len(levels)-1])
+}
+
+// Verity superblock padded to hash block size
+func (tree testTree) superblock(t *testing.T, dataSize int) []byte {
+	t.Helper()
+	sb := veritySuperblock{
+		Version:        1,
+		Type:           1,
+		DataBlockSize:  uint32(tree.blockSize),
+		HashBlockSize:  uint32(tree.blockSize),
+		DataBlockCount: uint64(dataSize / tree.blockSize),
+		SaltSize:       uint16(len(tree.salt())),
+	}
+	copy(sb.Magic[:], "verity")
+	copy(sb.Algorithm[:], tree.algorithm)
+	copy(sb.Salt[:], tree.salt())
+	var header bytes.Buffer
+	err := binary.Write(&header, binary.LittleEndian, &sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Write(make([]byte, tree.blockSize-header.Len()))
+	return header.Bytes()
+}
+
+// Append verity superblock and hash tree to data partition
+func (tree testTree) appendTo(t *testing.T, data []byte) (image, root []byte) {
+	t.Helper()
+	hashes, root := tree.build(data)
+	return concat(data, tree.superblock(t, len(data)), hashes), root
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
+
+// Pseudorandom data
+func testData(size int) []byte {
+	data := make([]byte, size)
+	_, _ = rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// Data partitions with fake filesystem superblocks that only declare
+// filesystem size. Sizes are expected to be multiples of 4096.
+
+func squashfsStub(data []byte, padding int) []byte {
+	data = bytes.Clone(data)
+	binary.LittleEndian.PutUint32(data[0:], 0x73717368)                 // Magic
+	binary.LittleEndian.PutUint16(data[28:], 4)                         // VersionMajor
+	binary.LittleEndian.PutUint16(data[30:], 0)                         // VersionMinor
+	binary.LittleEndian.PutUint64(data[40:], uint64(len(data)-padding)) // BytesUsed
+	return data
+}
+
+func erofsStub(data []byte) []byte {
+	data = bytes.Clone(data)
+	sb := data[superblockOffset:]
+	binary.LittleEndian.PutUint32(sb[0:], 0xe0f5e1e2)              // Magic
+	sb[12] = 12                                                    // BlockSizeBits
+	binary.LittleEndian.PutUint32(sb[36:], uint32(len(data)/4096)) // Blocks
+	return data
+}
+
+func ext4Stub(data []byte) []byte {
+	data = bytes.Clone(data)
+	sb := data[superblockOffset:]
+	binary.LittleEndian.PutUint32(sb[0x4:], uint32(len(data)/1024)) // BlocksCountLo
+	binary.LittleEndian.PutUint32(sb[0x18:], 0)                     // LogBlockSize
+	binary.LittleEndian.PutUint16(sb[0x38:], 0xef53)                // Magic
+	binary.LittleEndian.PutUint32(sb[0x60:], 0)                     // FeatureIncompat
+	return data
+}